@@ -1,23 +1,78 @@
 package main
 
 import (
+	"context"
 	"cse224/proj4/pkg/surfstore"
 	"flag"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // Arguments
 const ARG_COUNT int = 3
 
 // Usage strings
-const USAGE_STRING = "./run-client.sh -d host:port baseDir blockSize"
+const USAGE_STRING = "./run-client.sh -config file -d -rehash -include prefixes -exclude prefixes -ca file -cert file -key file -token token -encrypt mode -encrypt-names -passphrase-file file -salt-file file -compress algorithm -trace exporter host:port baseDir blockSize"
+const SUBCOMMAND_USAGE_STRING = `./run-client.sh [flags] share host:port path user [ro|rw]
+       ./run-client.sh [flags] revoke host:port path user
+       ./run-client.sh [flags] shares host:port
+       ./run-client.sh [flags] usage host:port
+       ./run-client.sh [flags] audit host:port [path [from [to]]]
+       ./run-client.sh [flags] rotate blockstore-host:port`
+
+const CONFIG_NAME = "config"
+const CONFIG_USAGE = "YAML config file; SURFSTORE_* environment variables, flags and arguments override it"
 
 const DEBUG_NAME = "d"
-const DEBUG_USAGE = "Output log statements"
+const DEBUG_USAGE = "Output debug log statements"
+
+const REHASH_NAME = "rehash"
+const REHASH_USAGE = "Rehash every file instead of skipping files whose size and mtime are unchanged"
+
+const INCLUDE_NAME = "include"
+const INCLUDE_USAGE = "Comma separated path prefixes to sync, saved for later runs (empty to select everything)"
+
+const EXCLUDE_NAME = "exclude"
+const EXCLUDE_USAGE = "Comma separated path prefixes not to sync, saved for later runs"
+
+const CA_NAME = "ca"
+const CA_USAGE = "CA certificate file to verify the servers with, enables TLS"
+
+const CERT_NAME = "cert"
+const CERT_USAGE = "Client certificate file for mutual TLS, enables TLS"
+
+const KEY_NAME = "key"
+const KEY_USAGE = "Client private key file for mutual TLS"
+
+const TOKEN_NAME = "token"
+const TOKEN_USAGE = "Token to authenticate with (needs TLS), defaults to $" + TOKEN_ENV
+
+const TOKEN_ENV = "SURFSTORE_TOKEN"
+
+const ENCRYPT_NAME = "encrypt"
+const ENCRYPT_USAGE = "Encrypt blocks before uploading them: convergent (keeps deduplication) or random (a random key per file)"
+
+const ENCRYPT_NAMES_NAME = "encrypt-names"
+const ENCRYPT_NAMES_USAGE = "Encrypt file names and symlink targets"
+
+const PASSPHRASE_FILE_NAME = "passphrase-file"
+const PASSPHRASE_FILE_USAGE = "File holding the encryption passphrase, defaults to $" + PASSPHRASE_ENV
+
+const PASSPHRASE_ENV = "SURFSTORE_PASSPHRASE"
+
+const SALT_FILE_NAME = "salt-file"
+const SALT_FILE_USAGE = "File holding the encryption salt, created in the base dir if missing; subcommands need it with -" + ENCRYPT_NAMES_NAME
+
+const COMPRESS_NAME = "compress"
+const COMPRESS_USAGE = "Compress uploaded blocks with gzip, zstd or snappy, unless they do not get smaller"
+
+const TRACE_NAME = "trace"
+const TRACE_USAGE = "Export OpenTelemetry spans to file:<path>, otlp (configured by $OTEL_EXPORTER_OTLP_*) or otlp:<host:port>"
 
 const ADDR_NAME = "host:port"
 const ADDR_USAGE = "IP address and port of the MetaStore the client is syncing to"
@@ -28,6 +83,9 @@ const BASEDIR_USAGE = "Base directory of the client"
 const BLOCK_NAME = "blockSize"
 const BLOCK_USAGE = "Size of the blocks used to fragment files"
 
+// Subcommands and their allowed argument counts, including the subcommand
+var SUBCOMMANDS = map[string][]int{"share": {4, 5}, "revoke": {4}, "shares": {2}, "usage": {2}, "audit": {2, 3, 4, 5}, "rotate": {2}}
+
 // Exit codes
 const EX_USAGE int = 64
 
@@ -36,38 +94,375 @@ func main() {
 	flag.Usage = func() {
 		w := flag.CommandLine.Output()
 		fmt.Fprintf(w, "Usage of %s:\n", USAGE_STRING)
+		fmt.Fprintf(w, "   or %s\n", SUBCOMMAND_USAGE_STRING)
+		fmt.Fprintf(w, "  -%s: %v\n", CONFIG_NAME, CONFIG_USAGE)
 		fmt.Fprintf(w, "  -%s: %v\n", DEBUG_NAME, DEBUG_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", REHASH_NAME, REHASH_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", INCLUDE_NAME, INCLUDE_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", EXCLUDE_NAME, EXCLUDE_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", CA_NAME, CA_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", CERT_NAME, CERT_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", KEY_NAME, KEY_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", TOKEN_NAME, TOKEN_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", ENCRYPT_NAME, ENCRYPT_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", ENCRYPT_NAMES_NAME, ENCRYPT_NAMES_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", PASSPHRASE_FILE_NAME, PASSPHRASE_FILE_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", SALT_FILE_NAME, SALT_FILE_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", COMPRESS_NAME, COMPRESS_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", TRACE_NAME, TRACE_USAGE)
 		fmt.Fprintf(w, "  %s: %v\n", ADDR_NAME, ADDR_USAGE)
 		fmt.Fprintf(w, "  %s: %v\n", BASEDIR_NAME, BASEDIR_USAGE)
 		fmt.Fprintf(w, "  %s: %v\n", BLOCK_NAME, BLOCK_USAGE)
 	}
 
 	// Parse command-line arguments and flags
-	debug := flag.Bool("d", false, DEBUG_USAGE)
+	configFile := flag.String(CONFIG_NAME, "", CONFIG_USAGE)
+	debug := flag.Bool(DEBUG_NAME, false, DEBUG_USAGE)
+	rehash := flag.Bool(REHASH_NAME, false, REHASH_USAGE)
+	include := flag.String(INCLUDE_NAME, "", INCLUDE_USAGE)
+	exclude := flag.String(EXCLUDE_NAME, "", EXCLUDE_USAGE)
+	caFile := flag.String(CA_NAME, "", CA_USAGE)
+	certFile := flag.String(CERT_NAME, "", CERT_USAGE)
+	keyFile := flag.String(KEY_NAME, "", KEY_USAGE)
+	token := flag.String(TOKEN_NAME, "", TOKEN_USAGE)
+	encrypt := flag.String(ENCRYPT_NAME, "", ENCRYPT_USAGE)
+	encryptNames := flag.Bool(ENCRYPT_NAMES_NAME, false, ENCRYPT_NAMES_USAGE)
+	passphraseFile := flag.String(PASSPHRASE_FILE_NAME, "", PASSPHRASE_FILE_USAGE)
+	saltFile := flag.String(SALT_FILE_NAME, "", SALT_FILE_USAGE)
+	compress := flag.String(COMPRESS_NAME, "", COMPRESS_USAGE)
+	traceExporter := flag.String(TRACE_NAME, "", TRACE_USAGE)
 	flag.Parse()
 
 	// Use tail arguments to hold non-flag arguments
 	args := flag.Args()
 
-	if len(args) != ARG_COUNT {
-		flag.Usage()
+	config := surfstore.NewClientConfig()
+	if err := surfstore.LoadConfig(*configFile, config); err != nil {
+		fmt.Fprintln(os.Stderr, err)
 		os.Exit(EX_USAGE)
 	}
 
-	hostPort := args[0]
-	baseDir := args[1]
-	blockSize, err := strconv.Atoi(args[2])
+	// Flags given on the command line override the config
+	selectionSet := false
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case DEBUG_NAME:
+			config.Log.Debug = *debug
+		case REHASH_NAME:
+			config.Rehash = *rehash
+		case INCLUDE_NAME, EXCLUDE_NAME:
+			selectionSet = true
+		case CA_NAME:
+			config.TLS.CA = *caFile
+		case CERT_NAME:
+			config.TLS.Cert = *certFile
+		case KEY_NAME:
+			config.TLS.Key = *keyFile
+		case TOKEN_NAME:
+			config.Token = *token
+		case ENCRYPT_NAME:
+			config.Encryption.Mode = *encrypt
+		case ENCRYPT_NAMES_NAME:
+			config.Encryption.EncryptNames = *encryptNames
+		case PASSPHRASE_FILE_NAME:
+			config.Encryption.PassphraseFile = *passphraseFile
+		case SALT_FILE_NAME:
+			config.Encryption.SaltFile = *saltFile
+		case COMPRESS_NAME:
+			config.Compression = *compress
+		case TRACE_NAME:
+			config.Tracing.Exporter = *traceExporter
+		}
+	})
+
+	// Log at the configured level, everything with -d
+	logger, err := config.Log.Logger(os.Stderr)
 	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(EX_USAGE)
+	}
+	slog.SetDefault(logger)
+
+	// Export the spans of the sync or subcommand if asked to
+	stopTracing := func() {}
+	if config.Tracing.Exporter != "" {
+		shutdown, err := surfstore.StartTracing("surfstore-client", config.Tracing.Exporter)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(EX_USAGE)
+		}
+		stopTracing = func() {
+			if err := shutdown(context.Background()); err != nil {
+				slog.Error("Flushing traces failed", "error", err)
+			}
+		}
+	}
+
+	if len(args) > 0 {
+		if argCounts, ok := SUBCOMMANDS[args[0]]; ok {
+			if !validArgCount(len(args), argCounts) {
+				flag.Usage()
+				os.Exit(EX_USAGE)
+			}
+			config.MetaStore = args[1]
+			// subcommands never read or write blocks, only names
+			config.Encryption.Mode = ""
+			rpcClient, err := newRPCClient(config)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(EX_USAGE)
+			}
+			err = runSubcommand(args, rpcClient)
+			stopTracing()
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	// The arguments may be left to the config
+	if len(args) == ARG_COUNT {
+		blockSize, err := strconv.Atoi(args[2])
+		if err != nil {
+			flag.Usage()
+			os.Exit(EX_USAGE)
+		}
+		config.MetaStore, config.BaseDir, config.BlockSize = args[0], args[1], blockSize
+	} else if len(args) != 0 {
 		flag.Usage()
 		os.Exit(EX_USAGE)
 	}
 
-	// Disable log outputs if debug flag is missing
-	if !(*debug) {
-		log.SetFlags(0)
-		log.SetOutput(ioutil.Discard)
+	if err := config.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(EX_USAGE)
+	}
+	rpcClient, err := newRPCClient(config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(EX_USAGE)
+	}
+
+	// Replace the saved selective sync selection if asked to
+	if selectionSet {
+		sel := surfstore.NewSelection(strings.Split(*include, ","), strings.Split(*exclude, ","))
+		if err := surfstore.WriteSelection(sel, config.BaseDir); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
 	}
 
-	rpcClient := surfstore.NewSurfstoreRPCClient(hostPort, baseDir, blockSize)
-	surfstore.ClientSync(rpcClient)
+	err = surfstore.ClientSync(rpcClient)
+	stopTracing()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// newRPCClient creates the client described by config, loading the TLS
+// credentials and encryption keys it names.
+func newRPCClient(config *surfstore.ClientConfig) (surfstore.RPCClient, error) {
+	rpcClient := surfstore.NewSurfstoreRPCClient(config.MetaStore, config.BaseDir, config.BlockSize)
+	rpcClient.Rehash = config.Rehash
+	rpcClient.Token = config.Token
+	rpcClient.Timeout = config.Timeouts.RPC
+
+	if config.TLS.CA != "" || config.TLS.Cert != "" || config.TLS.Key != "" {
+		tlsConfig, err := surfstore.NewClientTLSConfig(config.TLS.CA, config.TLS.Cert, config.TLS.Key)
+		if err != nil {
+			return rpcClient, err
+		}
+		rpcClient.TLSConfig = tlsConfig
+	}
+
+	saltFile := config.Encryption.SaltFile
+	if saltFile == "" && config.BaseDir != "" {
+		saltFile = surfstore.ConcatPath(config.BaseDir, surfstore.DEFAULT_ENCRYPTION_SALT_FILENAME)
+	}
+	encryption, err := newEncryption(config.Encryption.Mode, config.Encryption.EncryptNames, config.Encryption.PassphraseFile, saltFile)
+	if err != nil {
+		return rpcClient, err
+	}
+	rpcClient.Encryption = encryption
+
+	rpcClient.Compression, err = surfstore.ParseCompression(config.Compression)
+	return rpcClient, err
+}
+
+// newEncryption sets up client side encryption if it was asked for, reading
+// the passphrase from passphraseFile or the environment and the salt from
+// saltFile.
+func newEncryption(mode string, encryptNames bool, passphraseFile string, saltFile string) (*surfstore.ClientEncryption, error) {
+	encryptionMode, err := surfstore.ParseEncryptionMode(mode)
+	if err != nil {
+		return nil, err
+	}
+	if encryptionMode == surfstore.ENCRYPT_NONE && !encryptNames {
+		return nil, nil
+	}
+
+	passphrase := os.Getenv(PASSPHRASE_ENV)
+	if passphraseFile != "" {
+		data, err := ioutil.ReadFile(passphraseFile)
+		if err != nil {
+			return nil, err
+		}
+		passphrase = strings.TrimRight(string(data), "\r\n")
+	}
+	if saltFile == "" {
+		return nil, fmt.Errorf("encryption needs -%s outside a base dir", SALT_FILE_NAME)
+	}
+	salt, err := surfstore.LoadEncryptionSalt(saltFile)
+	if err != nil {
+		return nil, err
+	}
+	return surfstore.NewClientEncryption(passphrase, salt, encryptionMode, encryptNames)
+}
+
+func validArgCount(argCount int, argCounts []int) bool {
+	for _, count := range argCounts {
+		if argCount == count {
+			return true
+		}
+	}
+	return false
+}
+
+// How often the rotate subcommand reports the progress of a rotation
+const ROTATION_POLL_INTERVAL = time.Second
+
+// runSubcommand manages shared folders: "share" shares a folder read-only
+// (ro, the default) or read-write (rw), "revoke" takes a share back and
+// "shares" lists the shares made by and with the user. "usage" shows the
+// storage used by the user's files and their quota. "audit" lists the
+// audited updates, renames and purges of files below path between the RFC
+// 3339 times from and to, and "rotate" rewraps the blocks stored by a
+// BlockStore with its current master key, both for admins.
+func runSubcommand(args []string, rpcClient surfstore.RPCClient) error {
+	switch args[0] {
+	case "share", "revoke":
+		share := &surfstore.Share{Path: args[2], User: args[3]}
+		if len(args) == 5 {
+			switch args[4] {
+			case "ro":
+				share.Permission = surfstore.Permission_READ
+			case "rw":
+				share.Permission = surfstore.Permission_READ_WRITE
+			default:
+				return fmt.Errorf("unknown permission %q, expected ro or rw", args[4])
+			}
+		}
+
+		var succ bool
+		if args[0] == "share" {
+			if err := rpcClient.ShareFolder(share, &succ); err != nil {
+				return err
+			}
+		} else {
+			if err := rpcClient.RevokeShare(share, &succ); err != nil {
+				return err
+			}
+			if !succ {
+				return fmt.Errorf("%s is not shared with %s", share.Path, share.User)
+			}
+		}
+	case "shares":
+		var shares []*surfstore.Share
+		if err := rpcClient.ListShares(&shares); err != nil {
+			return err
+		}
+		for _, share := range shares {
+			permission := "ro"
+			if share.Permission == surfstore.Permission_READ_WRITE {
+				permission = "rw"
+			}
+			fmt.Printf("%s:%s -> %s (%s)\n", share.Owner, share.Path, share.User, permission)
+		}
+	case "rotate":
+		var rotation surfstore.RotationStatus
+		if err := rpcClient.RotateBlockKeys(args[1], &rotation); err != nil {
+			return err
+		}
+		for rotation.Running {
+			fmt.Printf("Rotating to key %s: checked %d blocks, rotated %d\n", rotation.KeyId, rotation.Checked, rotation.Rotated)
+			time.Sleep(ROTATION_POLL_INTERVAL)
+			if err := rpcClient.GetRotationStatus(args[1], &rotation); err != nil {
+				return err
+			}
+		}
+		if rotation.Error != "" {
+			return fmt.Errorf("rotation failed after %d blocks: %s", rotation.Rotated, rotation.Error)
+		}
+		fmt.Printf("Rotated %d of %d blocks to key %s\n", rotation.Rotated, rotation.Checked, rotation.KeyId)
+	case "usage":
+		var usage surfstore.Usage
+		if err := rpcClient.GetUsage(&usage); err != nil {
+			return err
+		}
+		fmt.Printf("Files:         %d\n", usage.Files)
+		fmt.Printf("Logical size:  %s\n", formatBytes(usage.LogicalBytes))
+		fmt.Printf("Unique blocks: %s\n", formatBytes(usage.UniqueBlockBytes))
+		if usage.QuotaBytes > 0 {
+			fmt.Printf("Quota:         %s\n", formatBytes(usage.QuotaBytes))
+		} else {
+			fmt.Println("Quota:         none")
+		}
+	case "audit":
+		query := &surfstore.AuditQuery{}
+		if len(args) > 2 {
+			query.Path = args[2]
+		}
+		for i, bound := range []*int64{&query.From, &query.To} {
+			if len(args) > 3+i {
+				t, err := time.Parse(time.RFC3339, args[3+i])
+				if err != nil {
+					return err
+				}
+				*bound = t.UnixNano()
+			}
+		}
+		var entries []*surfstore.AuditEntry
+		if err := rpcClient.QueryAuditLog(query, &entries); err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			file := entry.Owner + ":" + entry.OwnerFilename
+			if entry.OwnerFilename == "" {
+				// rejected before the owner was known
+				file = entry.Filename
+			}
+			if entry.Action == surfstore.AuditAction_RENAME {
+				if entry.NewOwnerFilename != "" {
+					file += " -> " + entry.NewOwnerFilename
+				} else {
+					file += " -> " + entry.NewFilename
+				}
+			}
+			outcome := "accepted"
+			if !entry.Accepted {
+				outcome = "rejected: " + entry.Error
+			}
+			fmt.Printf("%d %s %s@%s %s %s v%d->v%d %.12s %s\n", entry.Sequence,
+				time.Unix(0, entry.Time).UTC().Format(time.RFC3339Nano), entry.User, entry.Peer,
+				strings.ToLower(entry.Action.String()), file, entry.OldVersion, entry.NewVersion, entry.HashListDigest, outcome)
+		}
+	}
+	return nil
+}
+
+// formatBytes formats n bytes with a binary unit.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
 }
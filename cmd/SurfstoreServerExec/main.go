@@ -1,24 +1,29 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"cse224/proj4/pkg/surfstore"
 	"flag"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"log/slog"
 	"net"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	healthgrpc "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
 )
 
 // Usage String
-const USAGE_STRING = "./run-server.sh -s <service_type> -p <port> -l -d (blockStoreAddr*)"
-
-// Set of valid services
-var SERVICE_TYPES = map[string]bool{"meta": true, "block": true, "both": true}
+const USAGE_STRING = "./run-server.sh -config <file> -s <service_type> -p <port> -l -d -cert <file> -key <file> -clientca <file> -tokens <file> -certauth -capkey <file> -blockdir <dir> -blockkey <file> -admins <users> -scrub <interval> -quota <bytes> -quotafile <file> -quotablocks -ratelimit <rps> -burst <rpcs> -maxblocksize <bytes> -retention <duration> -clientexpiry <duration> -auditlog <file> -metrics <addr> -trace <exporter> -reflection (blockStoreAddr*)"
 
 // Exit codes
 const EX_USAGE int = 64
@@ -35,54 +40,347 @@ func main() {
 	}
 
 	// Parse command-line argument flags
-	service := flag.String("s", "", "(required) Service Type of the Server: meta, block, both")
+	configFile := flag.String("config", "", "YAML config file; SURFSTORE_* environment variables, flags and (blockStoreAddr*) override it")
+	service := flag.String("s", "", "(required here or in the config) Service Type of the Server: meta, block, both")
 	port := flag.Int("p", 8080, "(default = 8080) Port to accept connections")
 	localOnly := flag.Bool("l", false, "Only listen on localhost")
-	debug := flag.Bool("d", false, "Output log statements")
+	debug := flag.Bool("d", false, "Output debug log statements")
+	certFile := flag.String("cert", "", "TLS certificate file, enables TLS together with -key")
+	keyFile := flag.String("key", "", "TLS private key file")
+	clientCAFile := flag.String("clientca", "", "CA certificate file to require and verify client certificates (mutual TLS)")
+	tokenFile := flag.String("tokens", "", "File of user,token lines; clients must authenticate with one of the tokens")
+	certAuth := flag.Bool("certauth", false, "Authenticate clients by the common name of their TLS certificate (needs -clientca)")
+	capKeyFile := flag.String("capkey", "", "File with the hex key shared by MetaStore and BlockStore to sign and check block tokens")
+	blockDirPath := flag.String("blockdir", "", "Directory to store blocks in durably instead of in memory")
+	scrubInterval := flag.Duration("scrub", 0, "How often to check every stored block against its hash, e.g. 24h (0 disables)")
+	blockKeyFile := flag.String("blockkey", "", "File of id,hexkey master keys to encrypt stored blocks with (needs -blockdir); the last key is current, SIGHUP or the rotate subcommand reloads it and rotates stored blocks to it")
+	admins := flag.String("admins", "", "Comma separated users allowed to query the audit log and rotate block keys")
+	quotaBytes := flag.Int64("quota", 0, "Bytes each user may store, counted over the files they own (0 for no limit)")
+	quotaFile := flag.String("quotafile", "", "File of user,bytes lines overriding -quota for single users")
+	quotaBlocks := flag.Bool("quotablocks", false, "Count each distinct block of a user once against the quota instead of file sizes")
+	rateLimit := flag.Float64("ratelimit", 0, "RPCs per second each client can sustain (0 for no limit)")
+	burst := flag.Int("burst", surfstore.DEFAULT_RATE_LIMIT_BURST, "RPCs each client can send at once with -ratelimit")
+	maxBlockSize := flag.Int("maxblocksize", surfstore.DEFAULT_MAX_BLOCK_SIZE, "Largest block in bytes the BlockStore accepts")
+	retention := flag.Duration("retention", 0, "How long to keep deleted files at least before purging them once every client synced the deletion, e.g. 720h (0 keeps them)")
+	clientExpiry := flag.Duration("clientexpiry", surfstore.DEFAULT_CLIENT_EXPIRY, "How long a client can stay away before deleted files are purged without waiting for it (0 waits forever)")
+	auditLogFile := flag.String("auditlog", "", "File to append a hash-chained audit entry to for every file update")
+	metricsAddr := flag.String("metrics", "", "host:port to serve Prometheus metrics on at /metrics")
+	traceExporter := flag.String("trace", "", "Export OpenTelemetry spans to file:<path>, otlp (configured by $OTEL_EXPORTER_OTLP_*) or otlp:<host:port>")
+	serveReflection := flag.Bool("reflection", false, "Serve the gRPC reflection service for debugging with tools like grpcurl")
 	flag.Parse()
 
+	config := surfstore.NewServerConfig()
+	if err := surfstore.LoadConfig(*configFile, config); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(EX_USAGE)
+	}
+
+	// Flags given on the command line override the config
+	listenSet := false
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "s":
+			config.Service = *service
+		case "p", "l":
+			listenSet = true
+		case "d":
+			config.Log.Debug = *debug
+		case "cert":
+			config.TLS.Cert = *certFile
+		case "key":
+			config.TLS.Key = *keyFile
+		case "clientca":
+			config.TLS.ClientCA = *clientCAFile
+		case "tokens":
+			config.Auth.TokensFile = *tokenFile
+		case "certauth":
+			config.Auth.CertAuth = *certAuth
+		case "capkey":
+			config.Auth.CapKeyFile = *capKeyFile
+		case "blockdir":
+			config.Storage.BlockDir = *blockDirPath
+		case "blockkey":
+			config.Storage.BlockKeyFile = *blockKeyFile
+		case "scrub":
+			config.Storage.ScrubInterval = *scrubInterval
+		case "admins":
+			config.Auth.Admins = strings.Split(*admins, ",")
+		case "quota":
+			config.Quota.Bytes = *quotaBytes
+		case "quotafile":
+			config.Quota.File = *quotaFile
+		case "quotablocks":
+			config.Quota.UniqueBlocks = *quotaBlocks
+		case "ratelimit":
+			config.Limits.Rate = *rateLimit
+		case "burst":
+			config.Limits.Burst = *burst
+		case "maxblocksize":
+			config.Limits.MaxBlockSize = *maxBlockSize
+		case "retention":
+			config.Tombstones.Retention = *retention
+		case "clientexpiry":
+			config.Tombstones.ClientExpiry = *clientExpiry
+		case "auditlog":
+			config.Audit.LogFile = *auditLogFile
+		case "metrics":
+			config.Metrics.Listen = *metricsAddr
+		case "trace":
+			config.Tracing.Exporter = *traceExporter
+		case "reflection":
+			config.Health.Reflection = *serveReflection
+		}
+	})
+	config.Service = strings.ToLower(config.Service)
+
+	// Add localhost if necessary
+	if listenSet {
+		addr := ""
+		if *localOnly {
+			addr += "localhost"
+		}
+		config.Listen = addr + ":" + strconv.Itoa(*port)
+	}
+
 	// Use tail arguments to hold BlockStore address
-	args := flag.Args()
-	blockStoreAddr := ""
-	if len(args) == 1 {
-		blockStoreAddr = args[0]
+	if args := flag.Args(); len(args) == 1 {
+		config.BlockStores = []string{args[0]}
 	}
 
-	// Valid service type argument
-	if _, ok := SERVICE_TYPES[strings.ToLower(*service)]; !ok {
-		flag.Usage()
+	if err := config.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
 		os.Exit(EX_USAGE)
 	}
 
-	// Add localhost if necessary
-	addr := ""
-	if *localOnly {
-		addr += "localhost"
+	// Log at the configured level, everything with -d
+	logger, err := config.Log.Logger(os.Stderr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(EX_USAGE)
+	}
+	slog.SetDefault(logger)
+
+	// Load TLS credentials if requested
+	var tlsConfig *tls.Config
+	if config.TLS.Cert != "" {
+		tlsConfig, err = surfstore.NewServerTLSConfig(config.TLS.Cert, config.TLS.Key, config.TLS.ClientCA)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(EX_USAGE)
+		}
+	}
+
+	// Authenticate clients if requested, giving each user its own files
+	var auth *surfstore.Authenticator
+	if config.Auth.TokensFile != "" || config.Auth.CertAuth {
+		auth = &surfstore.Authenticator{UseClientCerts: config.Auth.CertAuth}
+		if config.Auth.TokensFile != "" {
+			auth.Tokens, err = surfstore.LoadTokenFile(config.Auth.TokensFile)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(EX_USAGE)
+			}
+		}
 	}
-	addr += ":" + strconv.Itoa(*port)
 
-	// Disable log outputs if debug flag is missing
-	if !(*debug) {
-		log.SetFlags(0)
-		log.SetOutput(ioutil.Discard)
+	// Only serve blocks to clients holding a token from the MetaStore
+	var capKey []byte
+	if config.Auth.CapKeyFile != "" {
+		capKey, err = surfstore.LoadBlockTokenKey(config.Auth.CapKeyFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(EX_USAGE)
+		}
 	}
 
-	log.Fatal(startServer(addr, strings.ToLower(*service), blockStoreAddr))
+	// Limit the bytes each user stores
+	var quotas *surfstore.Quotas
+	if config.Quota.Bytes > 0 || config.Quota.File != "" {
+		quotas = &surfstore.Quotas{DefaultBytes: config.Quota.Bytes, UniqueBlocks: config.Quota.UniqueBlocks}
+		if config.Quota.File != "" {
+			quotas.UserBytes, err = surfstore.LoadQuotaFile(config.Quota.File)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(EX_USAGE)
+			}
+		}
+	}
+
+	// Record who changed which file when
+	var auditLog *surfstore.AuditLog
+	if config.Audit.LogFile != "" {
+		auditLog, err = surfstore.OpenAuditLog(config.Audit.LogFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(EX_USAGE)
+		}
+		defer auditLog.Close()
+		sequence, hash := auditLog.Head()
+		slog.Info("Opened audit log", "file", config.Audit.LogFile, "entries", sequence, "head", hash)
+	}
+
+	// Store blocks on disk, encrypted at rest if there are keys
+	var blockDir *surfstore.BlockDir
+	if config.Storage.BlockDir != "" {
+		var keys *surfstore.KeyRing
+		if config.Storage.BlockKeyFile != "" {
+			keys, err = surfstore.LoadKeyRing(config.Storage.BlockKeyFile)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(EX_USAGE)
+			}
+		}
+		blockDir, err = surfstore.NewBlockDir(config.Storage.BlockDir, keys)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(EX_USAGE)
+		}
+	}
+
+	// Trace RPCs, continuing the traces of clients
+	stopTracing := func(context.Context) error { return nil }
+	if config.Tracing.Exporter != "" {
+		stopTracing, err = surfstore.StartTracing("surfstore-"+config.Service, config.Tracing.Exporter)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(EX_USAGE)
+		}
+	}
+
+	err = startServer(config, tlsConfig, auth, capKey, quotas, auditLog, blockDir)
+	if flushErr := stopTracing(context.Background()); flushErr != nil {
+		slog.Error("Flushing traces failed", "error", flushErr)
+	}
+	if err != nil {
+		slog.Error("Server stopped", "error", err)
+		os.Exit(1)
+	}
+}
+
+// rotateOnHangup reloads the block keys on SIGHUP and rewraps the stored
+// blocks with the new current key while the server keeps running.
+func rotateOnHangup(rotator *surfstore.KeyRotator) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	for range hangup {
+		// the outcome is logged by Rotate
+		rotator.Rotate()
+	}
 }
 
-func startServer(hostAddr string, serviceType string, blockStoreAddr string) error {
+// scrubPeriodically detects blocks that rotted in storage.
+func scrubPeriodically(blockStore *surfstore.BlockStore, interval time.Duration) {
+	for range time.Tick(interval) {
+		checked, corrupt, err := blockStore.Scrub()
+		if err != nil {
+			slog.Error("Scrubbing blocks failed", "error", err)
+		}
+		slog.Info("Scrubbed blocks", "checked", checked, "corrupt", corrupt)
+	}
+}
+
+func startServer(config *surfstore.ServerConfig, tlsConfig *tls.Config, auth *surfstore.Authenticator, capKey []byte, quotas *surfstore.Quotas, auditLog *surfstore.AuditLog, blockDir *surfstore.BlockDir) error {
+	hostAddr, serviceType, blockStoreAddr := config.Listen, config.Service, config.BlockStoreAddr()
+
 	// Create a new RPC server
-	grpcServer := grpc.NewServer()
+	opts := []grpc.ServerOption{
+		grpc.ConnectionTimeout(config.Timeouts.Connection),
+		grpc.MaxRecvMsgSize(surfstore.MaxMessageSize(config.Limits.MaxBlockSize, config.Limits.MaxHashes)),
+	}
+	var interceptors []grpc.UnaryServerInterceptor
+	if config.Tracing.Exporter != "" {
+		interceptors = append(interceptors, otelgrpc.UnaryServerInterceptor())
+	}
+	var metrics *surfstore.Metrics
+	if config.Metrics.Listen != "" {
+		metrics = surfstore.NewMetrics()
+		interceptors = append(interceptors, metrics.UnaryInterceptor)
+	}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	interceptors = append(interceptors, surfstore.LoggingUnaryInterceptor)
+	if auth != nil {
+		interceptors = append(interceptors, auth.UnaryInterceptor)
+	}
+	if config.Limits.Rate > 0 {
+		rateLimiter := surfstore.NewRateLimiter(config.Limits.Rate, config.Limits.Burst)
+		interceptors = append(interceptors, rateLimiter.UnaryInterceptor)
+	}
+	if capKey != nil && (serviceType == "both" || serviceType == "block") {
+		verifier := &surfstore.BlockTokenVerifier{Key: capKey, MaxBlockSize: config.Limits.MaxBlockSize}
+		interceptors = append(interceptors, verifier.UnaryInterceptor)
+	}
+	opts = append(opts, grpc.ChainUnaryInterceptor(interceptors...))
+	grpcServer := grpc.NewServer(opts...)
 
 	// Register RPC services
 	metaStore := surfstore.NewMetaStore(blockStoreAddr)
+	metaStore.BlockTokenKey = capKey
+	metaStore.Quotas = quotas
+	metaStore.MaxHashes = config.Limits.MaxHashes
+	metaStore.MaxFilenameLength = config.Limits.MaxFilenameLength
+	metaStore.AuditLog = auditLog
+	metaStore.TombstoneRetention = config.Tombstones.Retention
+	metaStore.ClientExpiry = config.Tombstones.ClientExpiry
+	metaStore.Admins = make(map[string]bool)
+	for _, admin := range config.Auth.Admins {
+		metaStore.Admins[admin] = true
+	}
 	blockStore := surfstore.NewBlockStore()
+	blockStore.BlockDir = blockDir
+	blockStore.MaxBlockSize = config.Limits.MaxBlockSize
 
 	if serviceType == "both" || serviceType == "block" {
 		surfstore.RegisterBlockStoreServer(grpcServer, blockStore)
+		if metrics != nil {
+			metrics.RegisterBlockStore(blockStore)
+		}
+		if config.Storage.ScrubInterval > 0 {
+			go scrubPeriodically(blockStore, config.Storage.ScrubInterval)
+		}
+		if blockDir != nil && blockDir.Keys != nil {
+			rotator := &surfstore.KeyRotator{BlockDir: blockDir, KeyFile: config.Storage.BlockKeyFile, Admins: make(map[string]bool)}
+			for _, admin := range config.Auth.Admins {
+				if admin != "" {
+					rotator.Admins[admin] = true
+				}
+			}
+			surfstore.RegisterBlockStoreAdminServer(grpcServer, rotator)
+			go rotateOnHangup(rotator)
+		}
 	}
 	if serviceType == "both" || serviceType == "meta" {
 		surfstore.RegisterMetaStoreServer(grpcServer, metaStore)
+		if metrics != nil {
+			metrics.RegisterMetaStore(metaStore)
+		}
+		if config.Tombstones.Retention > 0 {
+			go metaStore.CompactPeriodically()
+		}
+	}
+
+	// Report the health of the served stores, and optionally their schema
+	var servedBlockStore *surfstore.BlockStore
+	var servedMetaStore *surfstore.MetaStore
+	if serviceType == "both" || serviceType == "block" {
+		servedBlockStore = blockStore
+	}
+	if serviceType == "both" || serviceType == "meta" {
+		servedMetaStore = metaStore
+	}
+	healthChecker := surfstore.NewHealthChecker(servedBlockStore, servedMetaStore)
+	healthgrpc.RegisterHealthServer(grpcServer, healthChecker.Server)
+	go healthChecker.Run(config.Health.CheckInterval)
+	if config.Health.Reflection {
+		reflection.Register(grpcServer)
+	}
+
+	if metrics != nil {
+		go func() {
+			slog.Error("Serving metrics failed", "error", metrics.Serve(config.Metrics.Listen))
+			os.Exit(1)
+		}()
 	}
 
 	// Start listening and serving
@@ -91,10 +389,55 @@ func startServer(hostAddr string, serviceType string, blockStoreAddr string) err
 		return fmt.Errorf("failed to listen: %v", err)
 	}
 
-	err = grpcServer.Serve(listener)
-	if err != nil {
+	// Stop gracefully on SIGTERM or SIGINT
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	served := make(chan error, 1)
+	go func() {
+		served <- grpcServer.Serve(listener)
+	}()
+
+	slog.Info("Serving", "service", serviceType, "listen", listener.Addr().String())
+	select {
+	case err := <-served:
 		return fmt.Errorf("failed to serve: %v", err)
+	case sig := <-stop:
+		slog.Info("Shutting down", "signal", sig.String())
+	}
+
+	// Tell load balancers to stop sending RPCs, and give them time to notice
+	// before refusing them. Another signal cuts the wait short.
+	healthChecker.Server.Shutdown()
+	if delay := config.Timeouts.ShutdownDelay; delay > 0 {
+		slog.Info("Waiting before draining", "delay", delay)
+		select {
+		case <-time.After(delay):
+		case sig := <-stop:
+			slog.Info("Draining now", "signal", sig.String())
+		}
+	}
+	drain(grpcServer, config.Timeouts.Drain)
+	if err := blockStore.Flush(); err != nil {
+		return fmt.Errorf("failed to flush blocks: %v", err)
 	}
+	slog.Info("Stopped")
 	return nil
 	// panic("todo")
 }
+
+// drain stops accepting connections and waits up to timeout for running RPCs
+// to finish before closing the remaining connections.
+func drain(grpcServer *grpc.Server, timeout time.Duration) {
+	drained := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(timeout):
+		slog.Warn("Draining timed out, closing remaining connections", "timeout", timeout)
+		grpcServer.Stop()
+		<-drained
+	}
+}
@@ -2,23 +2,91 @@ package surfstore
 
 import (
 	context "context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type BlockStore struct {
+	mu       sync.RWMutex
 	BlockMap map[string]*Block
+
+	// BlockDir stores the blocks on disk instead of in BlockMap when set
+	BlockDir *BlockDir
+	// MaxBlockSize is the largest block accepted, 0 for no limit
+	MaxBlockSize int
+
+	// puts and duplicatePuts count the stored blocks and those that were
+	// already stored, which is how often deduplication saved storage
+	puts, duplicatePuts uint64
 	UnimplementedBlockStoreServer
 }
 
+// BlockStoreStats describes what a BlockStore holds.
+type BlockStoreStats struct {
+	Blocks int
+	// Bytes is the stored, compressed size of the blocks
+	Bytes         int64
+	Puts          uint64
+	DuplicatePuts uint64
+}
+
+// GetBlock returns the block with the given hash, failing with NotFound if
+// there is none.
 func (bs *BlockStore) GetBlock(ctx context.Context, blockHash *BlockHash) (*Block, error) {
 	// TODO: Figure out why ctx is needed
-	return bs.BlockMap[blockHash.Hash], nil
+	if !validBlockHash(blockHash.Hash) {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid block hash %q", blockHash.Hash)
+	}
+
+	var block *Block
+	if bs.BlockDir != nil {
+		var err error
+		if block, err = bs.BlockDir.Get(blockHash.Hash); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	} else {
+		bs.mu.RLock()
+		block = bs.BlockMap[blockHash.Hash]
+		bs.mu.RUnlock()
+	}
+	if block == nil {
+		return nil, status.Errorf(codes.NotFound, "no block %s", blockHash.Hash)
+	}
+	return block, nil
 	// panic("todo")
 }
 
 func (bs *BlockStore) PutBlock(ctx context.Context, block *Block) (*Success, error) {
-	// TODO: Figure out why ctx is needed
-	blockHash := GetBlockHashString(block.BlockData)
+	// blocks are addressed by the hash of their uncompressed data, which
+	// must be BlockSize bytes long. Blocks over MaxBlockSize are refused by
+	// BlockHashOf before decompressing, here or in the BlockTokenVerifier.
+	blockHash, ok := blockHashFromContext(ctx)
+	if !ok {
+		var err error
+		if blockHash, err = BlockHashOf(block, bs.MaxBlockSize); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+	atomic.AddUint64(&bs.puts, 1)
+	if bs.BlockDir != nil {
+		if bs.BlockDir.Has(blockHash) {
+			atomic.AddUint64(&bs.duplicatePuts, 1)
+		}
+		if err := bs.BlockDir.Put(blockHash, block); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		return &Success{Flag: true}, nil
+	}
+	bs.mu.Lock()
+	if _, exists := bs.BlockMap[blockHash]; exists {
+		atomic.AddUint64(&bs.duplicatePuts, 1)
+	}
 	bs.BlockMap[blockHash] = block
+	bs.mu.Unlock()
 
 	return &Success{Flag: true}, nil
 	// panic("todo")
@@ -30,8 +98,14 @@ func (bs *BlockStore) HasBlocks(ctx context.Context, blockHashesIn *BlockHashes)
 	// TODO: Figure out why ctx is needed
 	var blockHashesOut BlockHashes
 	var hashesOut = make([]string, 0)
+	bs.mu.RLock()
+	defer bs.mu.RUnlock()
 	for _, hash := range blockHashesIn.Hashes {
-		if _, blockExists := bs.BlockMap[hash]; blockExists {
+		if bs.BlockDir != nil {
+			if bs.BlockDir.Has(hash) {
+				hashesOut = append(hashesOut, hash)
+			}
+		} else if _, blockExists := bs.BlockMap[hash]; blockExists {
 			hashesOut = append(hashesOut, hash)
 		}
 	}
@@ -41,6 +115,65 @@ func (bs *BlockStore) HasBlocks(ctx context.Context, blockHashesIn *BlockHashes)
 	// panic("todo")
 }
 
+// Scrub checks every stored block against its hash and drops the corrupt
+// ones, so they are reported missing instead of being served.
+func (bs *BlockStore) Scrub() (checked, corrupt int, err error) {
+	if bs.BlockDir != nil {
+		return bs.BlockDir.Scrub()
+	}
+
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	for hash, block := range bs.BlockMap {
+		checked++
+		if blockHash, err := BlockHashOf(block, 0); err != nil || blockHash != hash {
+			slog.Warn("Dropping corrupt block", "hash", hash)
+			delete(bs.BlockMap, hash)
+			corrupt++
+		}
+	}
+	return checked, corrupt, nil
+}
+
+// CheckHealth reports whether blocks can be stored.
+func (bs *BlockStore) CheckHealth() error {
+	if bs.BlockDir != nil {
+		return bs.BlockDir.CheckHealth()
+	}
+	return nil
+}
+
+// Flush makes the stored blocks durable. In-memory stores have nothing to
+// flush.
+func (bs *BlockStore) Flush() error {
+	if bs.BlockDir != nil {
+		return bs.BlockDir.Sync()
+	}
+	return nil
+}
+
+// Stats counts the stored blocks and their size. With a BlockDir this walks
+// the whole directory.
+func (bs *BlockStore) Stats() (BlockStoreStats, error) {
+	stats := BlockStoreStats{
+		Puts:          atomic.LoadUint64(&bs.puts),
+		DuplicatePuts: atomic.LoadUint64(&bs.duplicatePuts),
+	}
+	if bs.BlockDir != nil {
+		var err error
+		stats.Blocks, stats.Bytes, err = bs.BlockDir.Usage()
+		return stats, err
+	}
+
+	bs.mu.RLock()
+	defer bs.mu.RUnlock()
+	stats.Blocks = len(bs.BlockMap)
+	for _, block := range bs.BlockMap {
+		stats.Bytes += int64(len(block.GetBlockData()))
+	}
+	return stats, nil
+}
+
 // This line guarantees all method for BlockStore are implemented
 var _ BlockStoreInterface = new(BlockStore)
 
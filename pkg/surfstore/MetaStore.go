@@ -2,39 +2,510 @@ package surfstore
 
 import (
 	context "context"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	emptypb "google.golang.org/protobuf/types/known/emptypb"
 )
 
 type MetaStore struct {
-	mu             sync.Mutex
-	FileMetaMap    map[string]*FileMetaData
+	mu sync.Mutex
+	// FileMetaMaps holds a separate file meta map per user. Servers that do
+	// not authenticate clients keep every file under the "" user.
+	FileMetaMaps map[string]map[string]*FileMetaData
+	// Shares holds the folders each user shared with others, keyed by owner
+	Shares         map[string][]*Share
 	BlockStoreAddr string
+	// BlockTokenKey signs the block tokens checked by the BlockStore. No
+	// tokens are issued without it.
+	BlockTokenKey []byte
+	// Quotas limits the bytes stored per owner, nil for no limits
+	Quotas *Quotas
+	// MaxHashes and MaxFilenameLength limit the block hash list and the
+	// filename length of updates, 0 for no limit
+	MaxHashes         int
+	MaxFilenameLength int
+	// AuditLog records every update, nil for none
+	AuditLog *AuditLog
+	// Admins are the users allowed to query the audit log. Servers that do
+	// not authenticate clients let everyone query it.
+	Admins map[string]bool
+
+	// TombstoneRetention is how long deleted files are kept at least, 0 to
+	// keep them forever, and ClientExpiry how long a client can stay away
+	// before tombstones are purged without waiting for it
+	TombstoneRetention time.Duration
+	ClientExpiry       time.Duration
+
+	// revision counts the changes of all files, and each file records the
+	// revision it last changed at. Revisions continue from baseRevision, the
+	// time the MetaStore was created, so those of a restarted server are
+	// higher than any a client got before.
+	revision, baseRevision int64
+	// clients holds the revision each client acknowledged, per user and
+	// client id
+	clients map[string]map[string]*clientAck
+	// expiredUsers holds the users whose clients all expired, who no longer
+	// hold back tombstones until one of their clients acknowledges again
+	expiredUsers map[string]bool
+	// deletedAt holds when each tombstone was stored, per owner
+	deletedAt map[string]map[string]time.Time
+	// usage holds the running usage of each owner
+	usage map[string]*ownerUsage
+	// claims holds the block sizes claimed for each block token that has not
+	// expired, keyed by token id, until the BlockStore confirms them
+	claims map[string]*blockClaim
+
+	// conflicts counts updates and renames rejected for being outdated, and
+	// purged the tombstones purged
+	conflicts, purged uint64
 	UnimplementedMetaStoreServer
 }
 
+// MetaStoreStats describes what a MetaStore holds.
+type MetaStoreStats struct {
+	// Files counts the files of all users that are not deleted, and
+	// Tombstones those that are
+	Files      int
+	Tombstones int
+	Conflicts  uint64
+	Purged     uint64
+}
+
+// fileMetaMap returns the file meta map of user, creating it if needed.
+// The caller must hold m.mu.
+func (m *MetaStore) fileMetaMap(user string) map[string]*FileMetaData {
+	fileMetaMap, exists := m.FileMetaMaps[user]
+	if !exists {
+		fileMetaMap = make(map[string]*FileMetaData)
+		m.FileMetaMaps[user] = fileMetaMap
+	}
+	return fileMetaMap
+}
+
+// renamedFileMetaData copies fileMetaData under a different filename.
+func renamedFileMetaData(fileMetaData *FileMetaData, filename string) *FileMetaData {
+	return &FileMetaData{
+		Filename:      filename,
+		Version:       fileMetaData.GetVersion(),
+		BlockHashList: fileMetaData.GetBlockHashList(),
+		Mode:          fileMetaData.GetMode(),
+		Mtime:         fileMetaData.GetMtime(),
+		Size:          fileMetaData.GetSize(),
+		FileType:      fileMetaData.GetFileType(),
+		LinkTarget:    fileMetaData.GetLinkTarget(),
+		EncryptedKey:  fileMetaData.GetEncryptedKey(),
+		Revision:      fileMetaData.GetRevision(),
+		Deleted:       fileMetaData.GetDeleted(),
+		DeletedTime:   fileMetaData.GetDeletedTime(),
+	}
+}
+
+// sharedPath is where a file of owner shows up for the users it is shared with.
+func sharedPath(owner, filename string) string {
+	return SHARED_DIR + "/" + owner + "/" + filename
+}
+
+// resolvePath maps a filename as seen by user to the user owning the file,
+// its name in the owner's namespace and the permission user has on it.
+// Paths below SHARED_DIR are only accessible through a share of their owner.
+// The caller must hold m.mu.
+func (m *MetaStore) resolvePath(user, filename string) (owner, ownerFilename string, permission Permission, ok bool) {
+	if user == "" || !hasPathPrefix(filename, SHARED_DIR) {
+		return user, filename, Permission_READ_WRITE, true
+	}
+
+	items := strings.SplitN(filename, "/", 3)
+	if len(items) < 3 {
+		return "", "", Permission_READ, false
+	}
+	owner, ownerFilename = items[1], items[2]
+
+	longest := -1
+	for _, share := range m.Shares[owner] {
+		if share.User == user && hasPathPrefix(ownerFilename, share.Path) && len(share.Path) > longest {
+			permission, ok, longest = share.Permission, true, len(share.Path)
+		}
+	}
+	return owner, ownerFilename, permission, ok
+}
+
 func (m *MetaStore) GetFileInfoMap(ctx context.Context, _ *emptypb.Empty) (*FileInfoMap, error) {
-	var fim FileInfoMap
-	fim.FileInfoMap = m.FileMetaMap
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-	return &fim, nil
+	return &FileInfoMap{
+		FileInfoMap:  m.fileInfoMap(UserFromContext(ctx)),
+		Revision:     m.revision,
+		BaseRevision: m.baseRevision,
+	}, nil
 	// panic("todo")
 }
 
+// fileInfoMap returns the files visible to user: their own files, and the
+// files shared with them below SHARED_DIR/<owner>/ along with the
+// directories leading to each shared folder. The caller must hold m.mu.
+func (m *MetaStore) fileInfoMap(user string) map[string]*FileMetaData {
+	fileInfoMap := make(map[string]*FileMetaData)
+	for filename, fileMetaData := range m.fileMetaMap(user) {
+		fileInfoMap[filename] = fileMetaData
+	}
+
+	if user == "" {
+		return fileInfoMap
+	}
+	for owner, shares := range m.Shares {
+		for _, share := range shares {
+			if share.User != user {
+				continue
+			}
+			for filename, fileMetaData := range m.FileMetaMaps[owner] {
+				if hasPathPrefix(filename, share.Path) {
+					fileInfoMap[sharedPath(owner, filename)] = renamedFileMetaData(fileMetaData, sharedPath(owner, filename))
+				}
+			}
+			for dir := sharedPath(owner, share.Path); strings.Contains(dir, "/"); {
+				dir = dir[:strings.LastIndex(dir, "/")]
+				if _, exists := fileInfoMap[dir]; !exists {
+					// a revision tells clients the directory exists on the
+					// server, so they remove it once the share is revoked
+					fileInfoMap[dir] = &FileMetaData{
+						Filename:      dir,
+						Version:       1,
+						BlockHashList: []string{},
+						FileType:      FileType_DIRECTORY,
+						Revision:      m.baseRevision + 1,
+					}
+				}
+			}
+		}
+	}
+
+	return fileInfoMap
+}
+
+// checkFilenameLength rejects filenames longer than MaxFilenameLength.
+func (m *MetaStore) checkFilenameLength(filename string) error {
+	if m.MaxFilenameLength > 0 && len(filename) > m.MaxFilenameLength {
+		return status.Errorf(codes.InvalidArgument, "filenames may have at most %d bytes", m.MaxFilenameLength)
+	}
+	return nil
+}
+
+// UpdateFile stores fileMetaData if its version is newer than the server's,
+// and fails with FailedPrecondition, detailing the server's version,
+// otherwise. Every update is recorded in the audit log, if there is one,
+// before it is applied, and is on disk before UpdateFile returns.
 func (m *MetaStore) UpdateFile(ctx context.Context, fileMetaData *FileMetaData) (*Version, error) {
+	version, sequence, err := m.updateFile(ctx, fileMetaData)
+	if err := m.syncAudit(ctx, sequence, err); err != nil {
+		return nil, err
+	}
+	return version, nil
+	// panic("todo")
+}
+
+// updateFile does UpdateFile under m.mu, returning the sequence number of
+// its audit entry, 0 for none.
+func (m *MetaStore) updateFile(ctx context.Context, fileMetaData *FileMetaData) (*Version, int64, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	if _, exists := m.FileMetaMap[fileMetaData.Filename]; exists {
-		if m.FileMetaMap[fileMetaData.Filename].GetVersion() >= fileMetaData.GetVersion() {
-			return &Version{Version: int32(-1)}, nil
+	entry := &AuditEntry{
+		Filename:       fileMetaData.GetFilename(),
+		NewVersion:     fileMetaData.GetVersion(),
+		HashListDigest: hashListDigest(fileMetaData.GetBlockHashList()),
+	}
+	fileMetaMap, fileMetaData, err := m.checkUpdate(ctx, fileMetaData, nil, entry)
+	sequence, err := m.audit(ctx, entry, err)
+	if err != nil {
+		return nil, sequence, err
+	}
+	m.storeFile(entry.GetOwner(), fileMetaMap, fileMetaData)
+	m.revision++
+	m.noteRevision(entry.GetOwner(), fileMetaData.GetFilename(), fileMetaData, m.revision)
+
+	return &Version{Version: fileMetaData.GetVersion(), Revision: m.revision}, sequence, nil
+}
+
+// audit appends entry to the audit log, if there is one, for a change that
+// failed with err or, if err is nil, is about to be applied. It returns the
+// sequence number of the entry, 0 if none was appended, and err, or an
+// error if an accepted change cannot be recorded. The caller must hold m.mu.
+func (m *MetaStore) audit(ctx context.Context, entry *AuditEntry, err error) (int64, error) {
+	if m.AuditLog == nil {
+		return 0, err
+	}
+	entry.Accepted = err == nil
+	if err != nil {
+		entry.Error = status.Convert(err).Message()
+	}
+	sequence, auditErr := m.AuditLog.Append(ctx, entry)
+	if auditErr != nil {
+		loggerFromContext(ctx).Error("Recording audit entry failed", "error", auditErr)
+		if err == nil {
+			return 0, status.Error(codes.Internal, "recording the update in the audit log failed")
 		}
 	}
-	m.FileMetaMap[fileMetaData.Filename] = fileMetaData
+	return sequence, err
+}
 
-	return &Version{Version: fileMetaData.GetVersion()}, nil
-	// panic("todo")
+// syncAudit waits for the audit entries up to sequence to be on disk and
+// returns err, or an error if an accepted change did not make it to disk.
+// The caller must not hold m.mu, so other updates go on meanwhile.
+func (m *MetaStore) syncAudit(ctx context.Context, sequence int64, err error) error {
+	if sequence == 0 {
+		return err
+	}
+	if syncErr := m.AuditLog.Sync(sequence); syncErr != nil {
+		loggerFromContext(ctx).Error("Recording audit entry failed", "error", syncErr)
+		if err == nil {
+			return status.Error(codes.Internal, "recording the update in the audit log failed")
+		}
+	}
+	return err
+}
+
+// checkUpdate decides whether the caller can store fileMetaData, returning
+// the file meta map of the file's owner and the metadata to store there, and
+// notes the owner and the replaced version in entry. claimed holds the sizes
+// of blocks not confirmed yet, if any. The caller must hold m.mu.
+func (m *MetaStore) checkUpdate(ctx context.Context, fileMetaData *FileMetaData, claimed map[string]int32, entry *AuditEntry) (map[string]*FileMetaData, *FileMetaData, error) {
+	if !validFilename(fileMetaData.GetFilename()) {
+		return nil, nil, status.Errorf(codes.InvalidArgument, "invalid filename %q", fileMetaData.GetFilename())
+	}
+	if err := m.checkFilenameLength(fileMetaData.GetFilename()); err != nil {
+		return nil, nil, err
+	}
+	if m.MaxHashes > 0 && len(fileMetaData.GetBlockHashList()) > m.MaxHashes {
+		return nil, nil, status.Errorf(codes.InvalidArgument, "files may have at most %d blocks", m.MaxHashes)
+	}
+
+	owner, filename, permission, ok := m.resolvePath(UserFromContext(ctx), fileMetaData.Filename)
+	entry.Owner, entry.OwnerFilename = owner, filename
+	if existing, exists := m.FileMetaMaps[owner][filename]; ok && exists {
+		entry.OldVersion = existing.GetVersion()
+	}
+	if !ok || permission != Permission_READ_WRITE {
+		return nil, nil, status.Errorf(codes.PermissionDenied, "no write access to %s", fileMetaData.Filename)
+	}
+	if owner != UserFromContext(ctx) {
+		fileMetaData = renamedFileMetaData(fileMetaData, filename)
+	}
+
+	fileMetaMap := m.fileMetaMap(owner)
+	if _, exists := fileMetaMap[filename]; exists {
+		if fileMetaMap[filename].GetVersion() >= fileMetaData.GetVersion() {
+			atomic.AddUint64(&m.conflicts, 1)
+			loggerFromContext(ctx).Info("Rejected outdated update", "file", fileMetaData.GetFilename(),
+				"version", fileMetaData.GetVersion(), "server_version", fileMetaMap[filename].GetVersion())
+			return nil, nil, versionConflictError(fileMetaData.GetFilename(), fileMetaMap[filename].GetVersion())
+		}
+	}
+	// updates that free space or keep usage level are let through even when
+	// over quota, so users can clean up after their quota was lowered
+	if quota := m.Quotas.Limit(owner); quota > 0 {
+		current := m.ownerUsage(owner)
+		usage, err := current.change(fileMetaMap[filename], fileMetaData, claimed, false)
+		if err != nil {
+			return nil, nil, status.Errorf(codes.InvalidArgument, "%v, upload the blocks of %s first", err, fileMetaData.GetFilename())
+		}
+		used := m.Quotas.used(usage)
+		if used > quota && used > m.Quotas.used(current.usage()) {
+			loggerFromContext(ctx).Info("Rejected update over quota", "file", fileMetaData.GetFilename(),
+				"owner", owner, "used", used, "quota", quota)
+			usage.QuotaBytes = quota
+			return nil, nil, quotaExceededError(owner, usage, used, quota)
+		}
+	}
+	return fileMetaMap, fileMetaData, nil
+}
+
+// RenameFile moves oldFilename to newFilename if the caller has the latest
+// version of oldFilename and newFilename is unused or deleted. The new entry
+// continues the old entry's version history and the old name is left
+// deleted so other clients remove it. The new entry takes the mode and
+// mtime of the file at its new path, if given. Files cannot be moved between
+// the caller's own files and a shared folder. Renames are audited like
+// updates.
+func (m *MetaStore) RenameFile(ctx context.Context, renameRequest *RenameRequest) (*Version, error) {
+	version, sequence, err := m.renameFile(ctx, renameRequest)
+	if err := m.syncAudit(ctx, sequence, err); err != nil {
+		return nil, err
+	}
+	return version, nil
+}
+
+// renameFile does RenameFile under m.mu, returning the sequence number of
+// its audit entry, 0 for none.
+func (m *MetaStore) renameFile(ctx context.Context, renameRequest *RenameRequest) (*Version, int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry := &AuditEntry{
+		Action:      AuditAction_RENAME,
+		Filename:    renameRequest.GetOldFilename(),
+		NewFilename: renameRequest.GetNewFilename(),
+		OldVersion:  renameRequest.GetVersion(),
+	}
+	fileMetaMap, renamed, err := m.checkRename(ctx, renameRequest, entry)
+	sequence, err := m.audit(ctx, entry, err)
+	if err != nil {
+		return nil, sequence, err
+	}
+
+	owner, oldFilename, newFilename := entry.GetOwner(), entry.GetOwnerFilename(), entry.GetNewOwnerFilename()
+	m.storeFile(owner, fileMetaMap, renamed)
+	m.storeFile(owner, fileMetaMap, newTombstone(oldFilename, entry.GetOldVersion()+1))
+	m.revision++
+	m.noteRevision(owner, newFilename, fileMetaMap[newFilename], m.revision)
+	m.noteRevision(owner, oldFilename, fileMetaMap[oldFilename], m.revision)
+
+	return &Version{Version: renamed.GetVersion(), Revision: m.revision}, sequence, nil
+}
+
+// checkRename decides whether the caller can do renameRequest, returning the
+// file meta map of the owner and the renamed metadata to store there, and
+// notes the owner, both names as the owner sees them and the versions in
+// entry. The caller must hold m.mu.
+func (m *MetaStore) checkRename(ctx context.Context, renameRequest *RenameRequest, entry *AuditEntry) (map[string]*FileMetaData, *FileMetaData, error) {
+	if !validFilename(renameRequest.GetOldFilename()) || !validFilename(renameRequest.GetNewFilename()) {
+		return nil, nil, status.Errorf(codes.InvalidArgument, "invalid filename %q or %q", renameRequest.GetOldFilename(), renameRequest.GetNewFilename())
+	}
+	if err := m.checkFilenameLength(renameRequest.GetNewFilename()); err != nil {
+		return nil, nil, err
+	}
+
+	user := UserFromContext(ctx)
+	owner, oldFilename, oldPermission, oldOk := m.resolvePath(user, renameRequest.OldFilename)
+	newOwner, newFilename, newPermission, newOk := m.resolvePath(user, renameRequest.NewFilename)
+	entry.Owner, entry.OwnerFilename, entry.NewOwnerFilename = owner, oldFilename, newFilename
+	if !oldOk || !newOk || oldPermission != Permission_READ_WRITE || newPermission != Permission_READ_WRITE {
+		return nil, nil, status.Errorf(codes.PermissionDenied, "no write access to %s or %s", renameRequest.OldFilename, renameRequest.NewFilename)
+	}
+	if owner != newOwner {
+		return nil, nil, status.Errorf(codes.InvalidArgument, "cannot move %s to another owner's %s", renameRequest.OldFilename, renameRequest.NewFilename)
+	}
+
+	fileMetaMap := m.fileMetaMap(owner)
+	oldFileMetaData, exists := fileMetaMap[oldFilename]
+	if !exists || isDeleted(oldFileMetaData) {
+		return nil, nil, status.Errorf(codes.NotFound, "%s does not exist", renameRequest.OldFilename)
+	}
+	entry.HashListDigest = hashListDigest(oldFileMetaData.GetBlockHashList())
+	if oldFileMetaData.GetVersion() != renameRequest.GetVersion() {
+		atomic.AddUint64(&m.conflicts, 1)
+		loggerFromContext(ctx).Info("Rejected outdated rename", "file", renameRequest.OldFilename,
+			"version", renameRequest.GetVersion(), "server_version", oldFileMetaData.GetVersion())
+		return nil, nil, versionConflictError(renameRequest.OldFilename, oldFileMetaData.GetVersion())
+	}
+
+	newVersion := oldFileMetaData.GetVersion() + 1
+	if newFileMetaData, exists := fileMetaMap[newFilename]; exists {
+		if !isDeleted(newFileMetaData) {
+			return nil, nil, status.Errorf(codes.AlreadyExists, "%s exists", renameRequest.NewFilename)
+		}
+		if newFileMetaData.GetVersion() >= newVersion {
+			newVersion = newFileMetaData.GetVersion() + 1
+		}
+	}
+	entry.NewVersion = newVersion
+
+	renamed := renamedFileMetaData(oldFileMetaData, newFilename)
+	renamed.Version = newVersion
+	if renameRequest.GetMode() != 0 {
+		renamed.Mode = renameRequest.GetMode()
+	}
+	if renameRequest.GetMtime() != 0 {
+		renamed.Mtime = renameRequest.GetMtime()
+	}
+	return fileMetaMap, renamed, nil
+}
+
+// ShareFolder gives share.User access to the caller's files below share.Path,
+// replacing the permission of an existing share of the same folder.
+func (m *MetaStore) ShareFolder(ctx context.Context, share *Share) (*Success, error) {
+	owner := UserFromContext(ctx)
+	if owner == "" {
+		return nil, status.Error(codes.FailedPrecondition, "sharing needs an authenticating server")
+	}
+	path := cleanPathPrefix(share.Path)
+	if path == "" || hasPathPrefix(path, SHARED_DIR) {
+		return nil, status.Errorf(codes.InvalidArgument, "cannot share %q", share.Path)
+	}
+	if share.User == "" || share.User == owner {
+		return nil, status.Errorf(codes.InvalidArgument, "cannot share with %q", share.User)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, existing := range m.Shares[owner] {
+		if existing.Path == path && existing.User == share.User {
+			existing.Permission = share.Permission
+			loggerFromContext(ctx).Info("Changed share", "path", path, "with", share.User, "permission", share.Permission.String())
+			return &Success{Flag: true}, nil
+		}
+	}
+	m.Shares[owner] = append(m.Shares[owner], &Share{
+		Owner:      owner,
+		Path:       path,
+		User:       share.User,
+		Permission: share.Permission,
+	})
+	loggerFromContext(ctx).Info("Shared folder", "path", path, "with", share.User, "permission", share.Permission.String())
+
+	return &Success{Flag: true}, nil
+}
+
+// RevokeShare removes a share of the caller's folder share.Path with
+// share.User. The flag is false if there was no such share.
+func (m *MetaStore) RevokeShare(ctx context.Context, share *Share) (*Success, error) {
+	owner := UserFromContext(ctx)
+	path := cleanPathPrefix(share.Path)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	shares := m.Shares[owner]
+	for i, existing := range shares {
+		if existing.Path == path && existing.User == share.User {
+			m.Shares[owner] = append(shares[:i:i], shares[i+1:]...)
+			loggerFromContext(ctx).Info("Revoked share", "path", path, "with", share.User)
+			return &Success{Flag: true}, nil
+		}
+	}
+
+	return &Success{Flag: false}, nil
+}
+
+// ListShares returns the shares the caller made and the shares made with
+// the caller.
+func (m *MetaStore) ListShares(ctx context.Context, _ *emptypb.Empty) (*Shares, error) {
+	user := UserFromContext(ctx)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var shares Shares
+	for owner, ownerShares := range m.Shares {
+		for _, share := range ownerShares {
+			if owner == user || share.User == user {
+				shares.Shares = append(shares.Shares, &Share{
+					Owner:      share.Owner,
+					Path:       share.Path,
+					User:       share.User,
+					Permission: share.Permission,
+				})
+			}
+		}
+	}
+
+	return &shares, nil
 }
 
 func (m *MetaStore) GetBlockStoreAddr(ctx context.Context, _ *emptypb.Empty) (*BlockStoreAddr, error) {
@@ -42,12 +513,226 @@ func (m *MetaStore) GetBlockStoreAddr(ctx context.Context, _ *emptypb.Empty) (*B
 	// panic("todo")
 }
 
+// GetBlockToken signs a short-lived block token that lets the caller read the
+// requested blocks used by files the caller can see, and write the requested
+// blocks of blockTokenRequest.File with the sizes in BlockSizes if the
+// MetaStore would accept it as an update, so rejected updates fail before
+// their blocks are uploaded. The token is empty if the MetaStore has no block
+// token key.
+func (m *MetaStore) GetBlockToken(ctx context.Context, blockTokenRequest *BlockTokenRequest) (*BlockToken, error) {
+	user := UserFromContext(ctx)
+	claims := &BlockTokenClaims{
+		User:        user,
+		Expiry:      time.Now().Add(BLOCK_TOKEN_TTL).Unix(),
+		WriteHashes: blockTokenRequest.WriteHashes,
+	}
+	if file := blockTokenRequest.GetFile(); file != nil {
+		var err error
+		claims.ID, claims.WriteSizes, err = m.claimBlockSizes(ctx, file, blockTokenRequest.BlockSizes, blockTokenRequest.WriteHashes)
+		if err != nil {
+			return nil, err
+		}
+	} else if len(blockTokenRequest.WriteHashes) > 0 && m.BlockTokenKey != nil {
+		return nil, status.Error(codes.InvalidArgument, "blocks can only be written for a file")
+	}
+	if m.BlockTokenKey == nil {
+		return &BlockToken{}, nil
+	}
+	if len(blockTokenRequest.ReadHashes)+len(blockTokenRequest.WriteHashes) > BLOCK_TOKEN_BATCH_SIZE {
+		return nil, status.Errorf(codes.InvalidArgument, "at most %d hashes per block token", BLOCK_TOKEN_BATCH_SIZE)
+	}
+
+	m.mu.Lock()
+	visibleHashes := make(map[string]bool)
+	for _, fileMetaData := range m.fileInfoMap(user) {
+		for _, hash := range fileMetaData.GetBlockHashList() {
+			visibleHashes[hash] = true
+		}
+	}
+	m.mu.Unlock()
+
+	for _, hash := range blockTokenRequest.ReadHashes {
+		if visibleHashes[hash] {
+			claims.ReadHashes = append(claims.ReadHashes, hash)
+		}
+	}
+
+	token, err := SignBlockToken(m.BlockTokenKey, claims)
+	if err != nil {
+		return nil, err
+	}
+	return &BlockToken{Token: token}, nil
+}
+
+// claimBlockSizes checks that file, with blocks of the given sizes, could be
+// stored, and returns the id of a new block token with the sizes of
+// writeHashes, which the BlockStore holds writers to. The sizes are claimed
+// for the token until the BlockStore confirms them. Without a block token key
+// nothing is confirmed, so the sizes of new blocks are recorded as claimed.
+func (m *MetaStore) claimBlockSizes(ctx context.Context, file *FileMetaData, blockSizes []int32, writeHashes []string) (string, []int32, error) {
+	if len(blockSizes) != len(file.GetBlockHashList()) {
+		return "", nil, status.Errorf(codes.InvalidArgument, "expected the sizes of all %d blocks of %s", len(file.GetBlockHashList()), file.GetFilename())
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	owner, _, _, _ := m.resolvePath(UserFromContext(ctx), file.GetFilename())
+	current := m.ownerUsage(owner)
+	fileSizes := make(map[string]int32)
+	for i, hash := range file.GetBlockHashList() {
+		size := blockSizes[i]
+		// confirmed sizes are facts, unconfirmed ones are kept as recorded
+		if known, exists := current.sizes[hash]; exists && size != known {
+			if m.BlockTokenKey != nil {
+				return "", nil, status.Errorf(codes.InvalidArgument, "wrong size %d for block %s", size, hash)
+			}
+			size = known
+		}
+		if other, exists := fileSizes[hash]; size < 0 || (exists && size != other) {
+			return "", nil, status.Errorf(codes.InvalidArgument, "wrong size %d for block %s", size, hash)
+		}
+		fileSizes[hash] = size
+	}
+	if _, _, err := m.checkUpdate(ctx, file, fileSizes, &AuditEntry{}); err != nil {
+		return "", nil, err
+	}
+
+	claim := &blockClaim{user: UserFromContext(ctx), owner: owner, sizes: make(map[string]int32), expiry: time.Now().Add(BLOCK_TOKEN_TTL)}
+	writeSizes := make([]int32, 0, len(writeHashes))
+	for _, hash := range writeHashes {
+		size, exists := fileSizes[hash]
+		if !exists {
+			return "", nil, status.Errorf(codes.InvalidArgument, "block %s is not part of %s", hash, file.GetFilename())
+		}
+		claim.sizes[hash] = size
+		writeSizes = append(writeSizes, size)
+	}
+	if m.BlockTokenKey == nil {
+		for hash, size := range claim.sizes {
+			current.setSize(hash, size)
+		}
+		return "", writeSizes, nil
+	}
+
+	m.dropExpiredClaims(time.Now())
+	tokenID, err := newBlockTokenID()
+	if err != nil {
+		return "", nil, err
+	}
+	m.claims[tokenID] = claim
+	return tokenID, writeSizes, nil
+}
+
+// ConfirmBlocks records the block sizes the BlockStore confirmed with its
+// receipts for the caller's block tokens. Receipts for expired tokens or for
+// sizes other than claimed are ignored. Without a block token key there is
+// nothing to confirm.
+func (m *MetaStore) ConfirmBlocks(ctx context.Context, blockReceipts *BlockReceipts) (*Success, error) {
+	if m.BlockTokenKey == nil {
+		return &Success{Flag: true}, nil
+	}
+	receipts := make([]*blockReceipt, 0, len(blockReceipts.GetReceipts()))
+	for _, signed := range blockReceipts.GetReceipts() {
+		receipt, err := verifyBlockReceipt(m.BlockTokenKey, signed)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, "invalid block receipt")
+		}
+		receipts = append(receipts, receipt)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.dropExpiredClaims(time.Now())
+	for _, receipt := range receipts {
+		claim, exists := m.claims[receipt.TokenID]
+		if !exists || claim.user != UserFromContext(ctx) {
+			continue
+		}
+		if size, claimed := claim.sizes[receipt.Hash]; claimed && size == receipt.Size {
+			m.ownerUsage(claim.owner).setSize(receipt.Hash, size)
+			delete(claim.sizes, receipt.Hash)
+		}
+		if len(claim.sizes) == 0 {
+			delete(m.claims, receipt.TokenID)
+		}
+	}
+	return &Success{Flag: true}, nil
+}
+
+// GetUsage returns the storage used by the caller's own files and their
+// quota, 0 for no limit. Files in folders shared with the caller count
+// against their owner.
+func (m *MetaStore) GetUsage(ctx context.Context, _ *emptypb.Empty) (*Usage, error) {
+	user := UserFromContext(ctx)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	usage := m.ownerUsage(user).usage()
+	usage.QuotaBytes = m.Quotas.Limit(user)
+	return usage, nil
+}
+
+// QueryAuditLog returns the audit entries matching query. Only admins can
+// query the audit log.
+func (m *MetaStore) QueryAuditLog(ctx context.Context, query *AuditQuery) (*AuditEntries, error) {
+	if user := UserFromContext(ctx); user != "" && !m.Admins[user] {
+		return nil, status.Error(codes.PermissionDenied, "only admins can query the audit log")
+	}
+	if m.AuditLog == nil {
+		return nil, status.Error(codes.FailedPrecondition, "the MetaStore keeps no audit log")
+	}
+	entries, err := m.AuditLog.Query(query)
+	if err != nil {
+		loggerFromContext(ctx).Error("Audit log is corrupt", "error", err)
+		return nil, status.Error(codes.DataLoss, err.Error())
+	}
+	return &AuditEntries{Entries: entries}, nil
+}
+
+// CheckHealth fails while updates cannot be audited, which makes them fail.
+// The rest of the MetaStore is held in memory and healthy while the server
+// runs.
+func (m *MetaStore) CheckHealth() error {
+	if m.AuditLog != nil {
+		return m.AuditLog.CheckHealth()
+	}
+	return nil
+}
+
+// Stats counts the files, tombstones, version conflicts and purged
+// tombstones of the MetaStore.
+func (m *MetaStore) Stats() MetaStoreStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stats := MetaStoreStats{Conflicts: atomic.LoadUint64(&m.conflicts), Purged: atomic.LoadUint64(&m.purged)}
+	for _, fileMetaMap := range m.FileMetaMaps {
+		for _, fileMetaData := range fileMetaMap {
+			if isDeleted(fileMetaData) {
+				stats.Tombstones++
+			} else {
+				stats.Files++
+			}
+		}
+	}
+	return stats
+}
+
 // This line guarantees all method for MetaStore are implemented
 var _ MetaStoreInterface = new(MetaStore)
 
 func NewMetaStore(blockStoreAddr string) *MetaStore {
+	baseRevision := time.Now().UnixNano()
 	return &MetaStore{
-		FileMetaMap:    map[string]*FileMetaData{},
+		FileMetaMaps:   map[string]map[string]*FileMetaData{},
+		Shares:         map[string][]*Share{},
 		BlockStoreAddr: blockStoreAddr,
+		usage:          map[string]*ownerUsage{},
+		claims:         map[string]*blockClaim{},
+		revision:       baseRevision,
+		baseRevision:   baseRevision,
 	}
 }
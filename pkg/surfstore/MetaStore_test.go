@@ -0,0 +1,233 @@
+package surfstore
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+)
+
+func TestRenameFile(t *testing.T) {
+	tests := []struct {
+		name        string
+		files       []*FileMetaData
+		version     int32
+		wantVersion int32
+		wantCode    codes.Code
+	}{
+		{
+			name:        "rename",
+			files:       []*FileMetaData{{Filename: "old", Version: 3, BlockHashList: []string{"h"}}},
+			version:     3,
+			wantVersion: 4,
+		},
+		{
+			name:     "outdated version",
+			files:    []*FileMetaData{{Filename: "old", Version: 3, BlockHashList: []string{"h"}}},
+			version:  2,
+			wantCode: codes.FailedPrecondition,
+		},
+		{
+			name:     "missing file",
+			version:  1,
+			wantCode: codes.NotFound,
+		},
+		{
+			name:     "deleted file",
+			files:    []*FileMetaData{{Filename: "old", Version: 2, BlockHashList: []string{"0"}}},
+			version:  2,
+			wantCode: codes.NotFound,
+		},
+		{
+			name: "new name in use",
+			files: []*FileMetaData{
+				{Filename: "old", Version: 1, BlockHashList: []string{"h"}},
+				{Filename: "new", Version: 1, BlockHashList: []string{"g"}},
+			},
+			version:  1,
+			wantCode: codes.AlreadyExists,
+		},
+		{
+			name: "new name deleted",
+			files: []*FileMetaData{
+				{Filename: "old", Version: 1, BlockHashList: []string{"h"}},
+				{Filename: "new", Version: 5, BlockHashList: []string{"0"}},
+			},
+			version:     1,
+			wantVersion: 6,
+		},
+	}
+	for _, test := range tests {
+		m := NewMetaStore("")
+		fileMetaMap := m.fileMetaMap("")
+		for _, fileMetaData := range test.files {
+			fileMetaMap[fileMetaData.Filename] = fileMetaData
+		}
+		version, err := m.RenameFile(context.Background(), &RenameRequest{OldFilename: "old", NewFilename: "new", Version: test.version})
+		if status.Code(err) != test.wantCode || version.GetVersion() != test.wantVersion {
+			t.Errorf("%s: RenameFile = %v, %v, want version %d, code %v", test.name, version, err, test.wantVersion, test.wantCode)
+			continue
+		}
+		if test.wantCode != codes.OK {
+			continue
+		}
+		if got := fileMetaMap["new"].GetBlockHashList(); !hashListsEqual(got, []string{"h"}) {
+			t.Errorf("%s: new has hash list %v, want [h]", test.name, got)
+		}
+		if old := fileMetaMap["old"]; !isDeleted(old) || old.GetVersion() != test.version+1 {
+			t.Errorf("%s: old is %v, want a tombstone at version %d", test.name, old, test.version+1)
+		}
+	}
+}
+
+func TestRenameFileTakesNewAttributes(t *testing.T) {
+	tests := []struct {
+		name      string
+		mode      uint32
+		mtime     int64
+		wantMode  uint32
+		wantMtime int64
+	}{
+		{"new attributes", 0600, 2000, 0600, 2000},
+		{"no attributes", 0, 0, 0644, 1000},
+	}
+	for _, test := range tests {
+		m := NewMetaStore("")
+		fileMetaMap := m.fileMetaMap("")
+		fileMetaMap["old"] = &FileMetaData{Filename: "old", Version: 1, BlockHashList: []string{"h"}, Mode: 0644, Mtime: 1000, Size: 1}
+		version, err := m.RenameFile(context.Background(), &RenameRequest{
+			OldFilename: "old", NewFilename: "new", Version: 1, Mode: test.mode, Mtime: test.mtime,
+		})
+		if err != nil || version.GetVersion() != 2 {
+			t.Fatalf("%s: RenameFile = %v, %v, want version 2", test.name, version, err)
+		}
+		renamed := fileMetaMap["new"]
+		if renamed.GetMode() != test.wantMode || renamed.GetMtime() != test.wantMtime {
+			t.Errorf("%s: renamed entry has mode %o and mtime %d, want %o and %d",
+				test.name, renamed.GetMode(), renamed.GetMtime(), test.wantMode, test.wantMtime)
+		}
+		if !isDeleted(fileMetaMap["old"]) {
+			t.Errorf("%s: old entry was not deleted", test.name)
+		}
+	}
+}
+
+// userContext returns a context for an RPC made by user.
+func userContext(user string) context.Context {
+	return context.WithValue(context.Background(), userContextKey{}, user)
+}
+
+func TestSharePermissions(t *testing.T) {
+	m := NewMetaStore("")
+	shares := []*Share{
+		{Path: "docs", User: "bob", Permission: Permission_READ},
+		{Path: "docs/team", User: "bob", Permission: Permission_READ_WRITE},
+		{Path: "photos", User: "carol", Permission: Permission_READ_WRITE},
+	}
+	for _, share := range shares {
+		if _, err := m.ShareFolder(userContext("alice"), share); err != nil {
+			t.Fatal(err)
+		}
+	}
+	alice := m.fileMetaMap("alice")
+	for _, filename := range []string{"docs/a", "docs/team/b", "photos/c", "private"} {
+		alice[filename] = &FileMetaData{Filename: filename, Version: 1, BlockHashList: []string{"h"}}
+	}
+
+	shared := SHARED_DIR + "/alice/"
+	tests := []struct {
+		user, filename string
+		allowed        bool
+	}{
+		{"alice", "docs/a", true},
+		{"alice", "new", true},
+		{"bob", shared + "docs/a", false},
+		{"bob", shared + "docs/new", false},
+		{"bob", shared + "docs/team/b", true},
+		{"bob", shared + "docs/team/new", true},
+		{"bob", shared + "photos/c", false},
+		{"bob", shared + "private", false},
+		{"bob", SHARED_DIR + "/alice", false},
+		{"bob", SHARED_DIR + "/mallory/docs/a", false},
+		{"carol", shared + "photos/c", true},
+		{"carol", shared + "docs/team/b", false},
+	}
+	for _, test := range tests {
+		_, err := m.UpdateFile(userContext(test.user), &FileMetaData{Filename: test.filename, Version: 2, BlockHashList: []string{"g"}})
+		if denied := status.Code(err) == codes.PermissionDenied; denied == test.allowed {
+			t.Errorf("%s updating %s: got %v, want allowed %v", test.user, test.filename, err, test.allowed)
+		}
+	}
+	if got := alice["docs/team/b"]; got.GetVersion() != 2 || got.GetFilename() != "docs/team/b" {
+		t.Errorf("bob's update of a read-write share stored %v", got)
+	}
+	if got := alice["docs/a"]; got.GetVersion() != 2 {
+		t.Errorf("alice's update of docs/a stored %v", got)
+	}
+
+	renames := []struct {
+		user, oldFilename, newFilename string
+		allowed                        bool
+	}{
+		{"bob", shared + "docs/team/b", shared + "docs/team/moved", true},
+		{"bob", shared + "docs/a", shared + "docs/team/a", false},
+		{"bob", shared + "docs/team/new", shared + "docs/new", false},
+		{"bob", shared + "private", shared + "docs/team/private", false},
+		{"carol", shared + "docs/team/moved", shared + "photos/moved", false},
+	}
+	for _, test := range renames {
+		version := alice[test.oldFilename[len(shared):]].GetVersion()
+		_, err := m.RenameFile(userContext(test.user), &RenameRequest{OldFilename: test.oldFilename, NewFilename: test.newFilename, Version: version})
+		if denied := status.Code(err) == codes.PermissionDenied; denied == test.allowed {
+			t.Errorf("%s moving %s to %s: got %v, want allowed %v", test.user, test.oldFilename, test.newFilename, err, test.allowed)
+		}
+	}
+	if !isDeleted(alice["docs/team/b"]) || alice["docs/team/moved"].GetVersion() != 3 {
+		t.Errorf("bob's rename in a read-write share left %v and %v", alice["docs/team/b"], alice["docs/team/moved"])
+	}
+}
+
+func TestSharedFileInfoMap(t *testing.T) {
+	m := NewMetaStore("")
+	if _, err := m.ShareFolder(userContext("alice"), &Share{Path: "docs", User: "bob", Permission: Permission_READ}); err != nil {
+		t.Fatal(err)
+	}
+	alice := m.fileMetaMap("alice")
+	for _, filename := range []string{"docs/a", "docsx", "private"} {
+		alice[filename] = &FileMetaData{Filename: filename, Version: 1, BlockHashList: []string{"h"}}
+	}
+
+	tests := []struct {
+		user  string
+		files []string
+	}{
+		{"alice", []string{"docs/a", "docsx", "private"}},
+		{"bob", []string{SHARED_DIR, SHARED_DIR + "/alice", SHARED_DIR + "/alice/docs/a"}},
+		{"carol", nil},
+	}
+	for _, test := range tests {
+		fileInfoMap, err := m.GetFileInfoMap(userContext(test.user), &emptypb.Empty{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var files []string
+		for filename := range fileInfoMap.GetFileInfoMap() {
+			files = append(files, filename)
+		}
+		sort.Strings(files)
+		if !reflect.DeepEqual(files, test.files) {
+			t.Errorf("%s sees %v, want %v", test.user, files, test.files)
+		}
+	}
+
+	if _, err := m.RevokeShare(userContext("alice"), &Share{Path: "docs", User: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+	if fileInfoMap, _ := m.GetFileInfoMap(userContext("bob"), &emptypb.Empty{}); len(fileInfoMap.GetFileInfoMap()) != 0 {
+		t.Errorf("bob still sees %v after the share was revoked", fileInfoMap.GetFileInfoMap())
+	}
+}
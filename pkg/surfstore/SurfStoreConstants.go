@@ -1,10 +1,31 @@
 package surfstore
 
 const DEFAULT_META_FILENAME string = "index.txt"
+const DEFAULT_IGNORE_FILENAME string = ".surfignore"
+const DEFAULT_SELECTION_FILENAME string = "selection.txt"
+const DEFAULT_CLIENT_ID_FILENAME string = "client-id.txt"
+const DEFAULT_ENCRYPTION_SALT_FILENAME string = "encryption-salt.txt"
+const DEFAULT_KEY_ID_FILENAME string = "encryption.txt"
+
+// Deleted files also carry the block hash list [TOMBSTONE_HASH] for clients
+// predating FileMetaData.Deleted
+const TOMBSTONE_HASH string = "0"
+
+// Folders shared by other users show up below SHARED_DIR/<owner>/
+const SHARED_DIR string = "@shared"
 
 const FILENAME_INDEX int = 0
 const VERSION_INDEX int = 1
 const HASH_LIST_INDEX int = 2
+const MODE_INDEX int = 3
+const MTIME_INDEX int = 4
+const SIZE_INDEX int = 5
+const FILE_TYPE_INDEX int = 6
+const LINK_TARGET_INDEX int = 7
+const INODE_INDEX int = 8
+const REJECTED_INDEX int = 9
+const ENCRYPTED_KEY_INDEX int = 10
+const REVISION_INDEX int = 11
 
 const CONFIG_DELIMITER string = ","
 const HASH_DELIMITER string = " "
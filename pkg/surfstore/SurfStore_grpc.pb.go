@@ -179,7 +179,17 @@ var BlockStore_ServiceDesc = grpc.ServiceDesc{
 type MetaStoreClient interface {
 	GetFileInfoMap(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*FileInfoMap, error)
 	UpdateFile(ctx context.Context, in *FileMetaData, opts ...grpc.CallOption) (*Version, error)
+	RenameFile(ctx context.Context, in *RenameRequest, opts ...grpc.CallOption) (*Version, error)
 	GetBlockStoreAddr(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*BlockStoreAddr, error)
+	ShareFolder(ctx context.Context, in *Share, opts ...grpc.CallOption) (*Success, error)
+	RevokeShare(ctx context.Context, in *Share, opts ...grpc.CallOption) (*Success, error)
+	ListShares(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*Shares, error)
+	GetBlockToken(ctx context.Context, in *BlockTokenRequest, opts ...grpc.CallOption) (*BlockToken, error)
+	// Record the sizes of the blocks the BlockStore confirmed storing
+	ConfirmBlocks(ctx context.Context, in *BlockReceipts, opts ...grpc.CallOption) (*Success, error)
+	GetUsage(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*Usage, error)
+	QueryAuditLog(ctx context.Context, in *AuditQuery, opts ...grpc.CallOption) (*AuditEntries, error)
+	AcknowledgeRevision(ctx context.Context, in *Acknowledgement, opts ...grpc.CallOption) (*Success, error)
 }
 
 type metaStoreClient struct {
@@ -208,6 +218,15 @@ func (c *metaStoreClient) UpdateFile(ctx context.Context, in *FileMetaData, opts
 	return out, nil
 }
 
+func (c *metaStoreClient) RenameFile(ctx context.Context, in *RenameRequest, opts ...grpc.CallOption) (*Version, error) {
+	out := new(Version)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/RenameFile", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (c *metaStoreClient) GetBlockStoreAddr(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*BlockStoreAddr, error) {
 	out := new(BlockStoreAddr)
 	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/GetBlockStoreAddr", in, out, opts...)
@@ -217,13 +236,95 @@ func (c *metaStoreClient) GetBlockStoreAddr(ctx context.Context, in *emptypb.Emp
 	return out, nil
 }
 
+func (c *metaStoreClient) ShareFolder(ctx context.Context, in *Share, opts ...grpc.CallOption) (*Success, error) {
+	out := new(Success)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/ShareFolder", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaStoreClient) RevokeShare(ctx context.Context, in *Share, opts ...grpc.CallOption) (*Success, error) {
+	out := new(Success)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/RevokeShare", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaStoreClient) ListShares(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*Shares, error) {
+	out := new(Shares)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/ListShares", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaStoreClient) GetBlockToken(ctx context.Context, in *BlockTokenRequest, opts ...grpc.CallOption) (*BlockToken, error) {
+	out := new(BlockToken)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/GetBlockToken", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaStoreClient) ConfirmBlocks(ctx context.Context, in *BlockReceipts, opts ...grpc.CallOption) (*Success, error) {
+	out := new(Success)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/ConfirmBlocks", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaStoreClient) GetUsage(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*Usage, error) {
+	out := new(Usage)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/GetUsage", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaStoreClient) QueryAuditLog(ctx context.Context, in *AuditQuery, opts ...grpc.CallOption) (*AuditEntries, error) {
+	out := new(AuditEntries)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/QueryAuditLog", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaStoreClient) AcknowledgeRevision(ctx context.Context, in *Acknowledgement, opts ...grpc.CallOption) (*Success, error) {
+	out := new(Success)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/AcknowledgeRevision", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // MetaStoreServer is the server API for MetaStore service.
 // All implementations must embed UnimplementedMetaStoreServer
 // for forward compatibility
 type MetaStoreServer interface {
 	GetFileInfoMap(context.Context, *emptypb.Empty) (*FileInfoMap, error)
 	UpdateFile(context.Context, *FileMetaData) (*Version, error)
+	RenameFile(context.Context, *RenameRequest) (*Version, error)
 	GetBlockStoreAddr(context.Context, *emptypb.Empty) (*BlockStoreAddr, error)
+	ShareFolder(context.Context, *Share) (*Success, error)
+	RevokeShare(context.Context, *Share) (*Success, error)
+	ListShares(context.Context, *emptypb.Empty) (*Shares, error)
+	GetBlockToken(context.Context, *BlockTokenRequest) (*BlockToken, error)
+	// Record the sizes of the blocks the BlockStore confirmed storing
+	ConfirmBlocks(context.Context, *BlockReceipts) (*Success, error)
+	GetUsage(context.Context, *emptypb.Empty) (*Usage, error)
+	QueryAuditLog(context.Context, *AuditQuery) (*AuditEntries, error)
+	AcknowledgeRevision(context.Context, *Acknowledgement) (*Success, error)
 	mustEmbedUnimplementedMetaStoreServer()
 }
 
@@ -237,9 +338,36 @@ func (UnimplementedMetaStoreServer) GetFileInfoMap(context.Context, *emptypb.Emp
 func (UnimplementedMetaStoreServer) UpdateFile(context.Context, *FileMetaData) (*Version, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method UpdateFile not implemented")
 }
+func (UnimplementedMetaStoreServer) RenameFile(context.Context, *RenameRequest) (*Version, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RenameFile not implemented")
+}
 func (UnimplementedMetaStoreServer) GetBlockStoreAddr(context.Context, *emptypb.Empty) (*BlockStoreAddr, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method GetBlockStoreAddr not implemented")
 }
+func (UnimplementedMetaStoreServer) ShareFolder(context.Context, *Share) (*Success, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ShareFolder not implemented")
+}
+func (UnimplementedMetaStoreServer) RevokeShare(context.Context, *Share) (*Success, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RevokeShare not implemented")
+}
+func (UnimplementedMetaStoreServer) ListShares(context.Context, *emptypb.Empty) (*Shares, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListShares not implemented")
+}
+func (UnimplementedMetaStoreServer) GetBlockToken(context.Context, *BlockTokenRequest) (*BlockToken, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetBlockToken not implemented")
+}
+func (UnimplementedMetaStoreServer) ConfirmBlocks(context.Context, *BlockReceipts) (*Success, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ConfirmBlocks not implemented")
+}
+func (UnimplementedMetaStoreServer) GetUsage(context.Context, *emptypb.Empty) (*Usage, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetUsage not implemented")
+}
+func (UnimplementedMetaStoreServer) QueryAuditLog(context.Context, *AuditQuery) (*AuditEntries, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method QueryAuditLog not implemented")
+}
+func (UnimplementedMetaStoreServer) AcknowledgeRevision(context.Context, *Acknowledgement) (*Success, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AcknowledgeRevision not implemented")
+}
 func (UnimplementedMetaStoreServer) mustEmbedUnimplementedMetaStoreServer() {}
 
 // UnsafeMetaStoreServer may be embedded to opt out of forward compatibility for this service.
@@ -289,6 +417,24 @@ func _MetaStore_UpdateFile_Handler(srv interface{}, ctx context.Context, dec fun
 	return interceptor(ctx, in, info, handler)
 }
 
+func _MetaStore_RenameFile_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RenameRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).RenameFile(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/RenameFile",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).RenameFile(ctx, req.(*RenameRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 func _MetaStore_GetBlockStoreAddr_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
 	in := new(emptypb.Empty)
 	if err := dec(in); err != nil {
@@ -307,6 +453,150 @@ func _MetaStore_GetBlockStoreAddr_Handler(srv interface{}, ctx context.Context,
 	return interceptor(ctx, in, info, handler)
 }
 
+func _MetaStore_ShareFolder_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Share)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).ShareFolder(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/ShareFolder",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).ShareFolder(ctx, req.(*Share))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetaStore_RevokeShare_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Share)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).RevokeShare(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/RevokeShare",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).RevokeShare(ctx, req.(*Share))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetaStore_ListShares_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).ListShares(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/ListShares",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).ListShares(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetaStore_GetBlockToken_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BlockTokenRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).GetBlockToken(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/GetBlockToken",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).GetBlockToken(ctx, req.(*BlockTokenRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetaStore_ConfirmBlocks_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BlockReceipts)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).ConfirmBlocks(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/ConfirmBlocks",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).ConfirmBlocks(ctx, req.(*BlockReceipts))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetaStore_GetUsage_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).GetUsage(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/GetUsage",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).GetUsage(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetaStore_QueryAuditLog_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AuditQuery)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).QueryAuditLog(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/QueryAuditLog",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).QueryAuditLog(ctx, req.(*AuditQuery))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetaStore_AcknowledgeRevision_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Acknowledgement)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).AcknowledgeRevision(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/AcknowledgeRevision",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).AcknowledgeRevision(ctx, req.(*Acknowledgement))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // MetaStore_ServiceDesc is the grpc.ServiceDesc for MetaStore service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -322,10 +612,170 @@ var MetaStore_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "UpdateFile",
 			Handler:    _MetaStore_UpdateFile_Handler,
 		},
+		{
+			MethodName: "RenameFile",
+			Handler:    _MetaStore_RenameFile_Handler,
+		},
 		{
 			MethodName: "GetBlockStoreAddr",
 			Handler:    _MetaStore_GetBlockStoreAddr_Handler,
 		},
+		{
+			MethodName: "ShareFolder",
+			Handler:    _MetaStore_ShareFolder_Handler,
+		},
+		{
+			MethodName: "RevokeShare",
+			Handler:    _MetaStore_RevokeShare_Handler,
+		},
+		{
+			MethodName: "ListShares",
+			Handler:    _MetaStore_ListShares_Handler,
+		},
+		{
+			MethodName: "GetBlockToken",
+			Handler:    _MetaStore_GetBlockToken_Handler,
+		},
+		{
+			MethodName: "ConfirmBlocks",
+			Handler:    _MetaStore_ConfirmBlocks_Handler,
+		},
+		{
+			MethodName: "GetUsage",
+			Handler:    _MetaStore_GetUsage_Handler,
+		},
+		{
+			MethodName: "QueryAuditLog",
+			Handler:    _MetaStore_QueryAuditLog_Handler,
+		},
+		{
+			MethodName: "AcknowledgeRevision",
+			Handler:    _MetaStore_AcknowledgeRevision_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "pkg/surfstore/SurfStore.proto",
+}
+
+// BlockStoreAdminClient is the client API for BlockStoreAdmin service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type BlockStoreAdminClient interface {
+	// Start rewrapping the stored blocks with the current master key
+	RotateBlockKeys(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*RotationStatus, error)
+	GetRotationStatus(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*RotationStatus, error)
+}
+
+type blockStoreAdminClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewBlockStoreAdminClient(cc grpc.ClientConnInterface) BlockStoreAdminClient {
+	return &blockStoreAdminClient{cc}
+}
+
+func (c *blockStoreAdminClient) RotateBlockKeys(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*RotationStatus, error) {
+	out := new(RotationStatus)
+	err := c.cc.Invoke(ctx, "/surfstore.BlockStoreAdmin/RotateBlockKeys", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *blockStoreAdminClient) GetRotationStatus(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*RotationStatus, error) {
+	out := new(RotationStatus)
+	err := c.cc.Invoke(ctx, "/surfstore.BlockStoreAdmin/GetRotationStatus", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// BlockStoreAdminServer is the server API for BlockStoreAdmin service.
+// All implementations must embed UnimplementedBlockStoreAdminServer
+// for forward compatibility
+type BlockStoreAdminServer interface {
+	// Start rewrapping the stored blocks with the current master key
+	RotateBlockKeys(context.Context, *emptypb.Empty) (*RotationStatus, error)
+	GetRotationStatus(context.Context, *emptypb.Empty) (*RotationStatus, error)
+	mustEmbedUnimplementedBlockStoreAdminServer()
+}
+
+// UnimplementedBlockStoreAdminServer must be embedded to have forward compatible implementations.
+type UnimplementedBlockStoreAdminServer struct {
+}
+
+func (UnimplementedBlockStoreAdminServer) RotateBlockKeys(context.Context, *emptypb.Empty) (*RotationStatus, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RotateBlockKeys not implemented")
+}
+func (UnimplementedBlockStoreAdminServer) GetRotationStatus(context.Context, *emptypb.Empty) (*RotationStatus, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetRotationStatus not implemented")
+}
+func (UnimplementedBlockStoreAdminServer) mustEmbedUnimplementedBlockStoreAdminServer() {}
+
+// UnsafeBlockStoreAdminServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to BlockStoreAdminServer will
+// result in compilation errors.
+type UnsafeBlockStoreAdminServer interface {
+	mustEmbedUnimplementedBlockStoreAdminServer()
+}
+
+func RegisterBlockStoreAdminServer(s grpc.ServiceRegistrar, srv BlockStoreAdminServer) {
+	s.RegisterService(&BlockStoreAdmin_ServiceDesc, srv)
+}
+
+func _BlockStoreAdmin_RotateBlockKeys_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BlockStoreAdminServer).RotateBlockKeys(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.BlockStoreAdmin/RotateBlockKeys",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BlockStoreAdminServer).RotateBlockKeys(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _BlockStoreAdmin_GetRotationStatus_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BlockStoreAdminServer).GetRotationStatus(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.BlockStoreAdmin/GetRotationStatus",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BlockStoreAdminServer).GetRotationStatus(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// BlockStoreAdmin_ServiceDesc is the grpc.ServiceDesc for BlockStoreAdmin service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var BlockStoreAdmin_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "surfstore.BlockStoreAdmin",
+	HandlerType: (*BlockStoreAdminServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "RotateBlockKeys",
+			Handler:    _BlockStoreAdmin_RotateBlockKeys_Handler,
+		},
+		{
+			MethodName: "GetRotationStatus",
+			Handler:    _BlockStoreAdmin_GetRotationStatus_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "pkg/surfstore/SurfStore.proto",
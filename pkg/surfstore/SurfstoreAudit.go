@@ -0,0 +1,247 @@
+package surfstore
+
+import (
+	"bufio"
+	context "context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/peer"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// AUDIT_GENESIS_HASH is the previous hash of the first entry of an audit log
+const AUDIT_GENESIS_HASH string = "0000000000000000000000000000000000000000000000000000000000000000"
+
+// AUDIT_MAX_STRING_LENGTH cuts filenames and errors recorded in the audit
+// log, which keeps its lines short
+const AUDIT_MAX_STRING_LENGTH int = 4096
+
+// AuditLog appends an entry for every update, rename and tombstone purge of
+// the MetaStore to a file of JSON lines. Each entry carries the hash of the
+// previous one and its own hash over both, so editing, dropping or reordering
+// entries breaks the chain at that point.
+type AuditLog struct {
+	mu       sync.Mutex
+	path     string
+	file     *os.File
+	sequence int64
+	lastHash string
+	// syncMu serializes syncs, which cover every entry written before them,
+	// up to synced
+	syncMu sync.Mutex
+	synced int64
+	// err is the first failed write. The log may end in a partial entry
+	// then, so nothing more is appended.
+	err error
+}
+
+// OpenAuditLog opens the audit log at path for appending, creating it if
+// needed, after checking the chain of the entries already in it.
+func OpenAuditLog(path string) (*AuditLog, error) {
+	a := &AuditLog{path: path, lastHash: AUDIT_GENESIS_HASH}
+	err := a.scan(-1, func(entry *AuditEntry) {
+		a.sequence, a.lastHash = entry.GetSequence(), entry.GetHash()
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	a.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	a.synced = a.sequence
+	return a, nil
+}
+
+// hashAuditEntry hashes entry, whose Hash must be empty, with the hash of the
+// previous entry it carries.
+func hashAuditEntry(entry *AuditEntry) (string, error) {
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(entry)
+	if err != nil {
+		return "", err
+	}
+	return GetBlockHashString(data), nil
+}
+
+// hashListDigest summarizes a block hash list in a single hash.
+func hashListDigest(hashList []string) string {
+	return GetBlockHashString([]byte(strings.Join(hashList, HASH_DELIMITER)))
+}
+
+// truncateAuditString cuts s to AUDIT_MAX_STRING_LENGTH bytes.
+func truncateAuditString(s string) string {
+	if len(s) <= AUDIT_MAX_STRING_LENGTH {
+		return s
+	}
+	return strings.ToValidUTF8(s[:AUDIT_MAX_STRING_LENGTH], "")
+}
+
+// Append writes entry to the log, filling in its sequence number, time,
+// chain hashes and the client of the RPC in ctx, and returns its sequence
+// number. The entry is only on disk once Sync of that number returns, which
+// callers can do without holding their own locks.
+func (a *AuditLog) Append(ctx context.Context, entry *AuditEntry) (int64, error) {
+	entry.Filename = truncateAuditString(entry.Filename)
+	entry.OwnerFilename = truncateAuditString(entry.OwnerFilename)
+	entry.NewFilename = truncateAuditString(entry.NewFilename)
+	entry.NewOwnerFilename = truncateAuditString(entry.NewOwnerFilename)
+	entry.Error = truncateAuditString(entry.Error)
+	entry.User = UserFromContext(ctx)
+	entry.RequestId = requestIDFromContext(ctx)
+	if p, ok := peer.FromContext(ctx); ok {
+		entry.Peer = p.Addr.String()
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.err != nil {
+		return 0, fmt.Errorf("audit log failed earlier: %w", a.err)
+	}
+
+	entry.Sequence = a.sequence + 1
+	entry.Time = time.Now().UnixNano()
+	entry.PrevHash = a.lastHash
+	entry.Hash = ""
+	hash, err := hashAuditEntry(entry)
+	if err != nil {
+		return 0, err
+	}
+	entry.Hash = hash
+
+	line, err := protojson.Marshal(entry)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		a.err = err
+		return 0, err
+	}
+	a.sequence, a.lastHash = entry.Sequence, entry.Hash
+	return entry.Sequence, nil
+}
+
+// Sync waits until the entries up to sequence are on disk. Concurrent
+// callers share a single fsync.
+func (a *AuditLog) Sync(sequence int64) error {
+	a.syncMu.Lock()
+	defer a.syncMu.Unlock()
+	if a.synced >= sequence {
+		return nil
+	}
+
+	a.mu.Lock()
+	last, err := a.sequence, a.err
+	a.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("audit log failed earlier: %w", err)
+	}
+	if err := a.file.Sync(); err != nil {
+		a.mu.Lock()
+		if a.err == nil {
+			a.err = err
+		}
+		a.mu.Unlock()
+		return err
+	}
+	a.synced = last
+	return nil
+}
+
+// CheckHealth fails if entries can no longer be recorded, which makes every
+// update fail.
+func (a *AuditLog) CheckHealth() error {
+	a.mu.Lock()
+	err := a.err
+	a.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if _, err := a.file.Stat(); err != nil {
+		return err
+	}
+	a.syncMu.Lock()
+	defer a.syncMu.Unlock()
+	return a.file.Sync()
+}
+
+// Query returns the entries about files below query.Path, as named by their
+// owner or by the caller, before or after a rename, of query.Owner, "" for
+// all, made between query.From and query.To in Unix nanoseconds, 0 for no
+// bound. The whole chain is checked on the way. Entries recorded during the
+// query are left out.
+func (a *AuditLog) Query(query *AuditQuery) ([]*AuditEntry, error) {
+	a.mu.Lock()
+	last := a.sequence
+	a.mu.Unlock()
+
+	path := cleanPathPrefix(query.GetPath())
+	var entries []*AuditEntry
+	err := a.scan(last, func(entry *AuditEntry) {
+		if path != "" && !hasPathPrefix(entry.GetOwnerFilename(), path) && !hasPathPrefix(entry.GetFilename(), path) &&
+			!hasPathPrefix(entry.GetNewOwnerFilename(), path) && !hasPathPrefix(entry.GetNewFilename(), path) {
+			return
+		}
+		if query.GetOwner() != "" && entry.GetOwner() != query.GetOwner() {
+			return
+		}
+		if (query.GetFrom() != 0 && entry.GetTime() < query.GetFrom()) || (query.GetTo() != 0 && entry.GetTime() > query.GetTo()) {
+			return
+		}
+		entries = append(entries, entry)
+	})
+	return entries, err
+}
+
+// scan calls visit with the entries of the audit log in order up to
+// sequence number last, or all for -1, failing at the first entry that does
+// not continue the chain.
+func (a *AuditLog) scan(last int64, visit func(entry *AuditEntry)) error {
+	f, err := os.Open(a.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sequence, lastHash := int64(0), AUDIT_GENESIS_HASH
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for lineNum := 1; sequence != last && scanner.Scan(); lineNum++ {
+		entry := &AuditEntry{}
+		if err := protojson.Unmarshal(scanner.Bytes(), entry); err != nil {
+			return fmt.Errorf("%s:%d: %v", a.path, lineNum, err)
+		}
+		hash := entry.GetHash()
+		entry.Hash = ""
+		expected, err := hashAuditEntry(entry)
+		if err != nil {
+			return err
+		}
+		if entry.GetSequence() != sequence+1 || entry.GetPrevHash() != lastHash || hash != expected {
+			return fmt.Errorf("%s:%d: audit log chain broken at entry %d", a.path, lineNum, entry.GetSequence())
+		}
+		entry.Hash = hash
+		sequence, lastHash = entry.GetSequence(), hash
+		visit(entry)
+	}
+	return scanner.Err()
+}
+
+// Head returns the sequence number and hash of the last entry. Keeping them
+// elsewhere also reveals entries dropped from the end of the log.
+func (a *AuditLog) Head() (int64, string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.sequence, a.lastHash
+}
+
+// Close closes the audit log file.
+func (a *AuditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.file.Close()
+}
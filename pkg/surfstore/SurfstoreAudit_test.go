@@ -0,0 +1,251 @@
+package surfstore
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// newTestAuditLog returns the path of an audit log holding an entry for
+// each of filenames.
+func newTestAuditLog(t *testing.T, filenames ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "audit.log")
+	a, err := OpenAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	for i, filename := range filenames {
+		entry := &AuditEntry{Filename: filename, Owner: "alice", OwnerFilename: filename, NewVersion: int32(i + 1), Accepted: true}
+		sequence, err := a.Append(userContext("alice"), entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := a.Sync(sequence); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+func TestAuditLogChain(t *testing.T) {
+	// rehash recomputes the hash of an edited entry, which still breaks the
+	// chain at the next entry
+	rehash := func(t *testing.T, line string, edit func(entry *AuditEntry)) string {
+		entry := &AuditEntry{}
+		if err := protojson.Unmarshal([]byte(line), entry); err != nil {
+			t.Fatal(err)
+		}
+		edit(entry)
+		entry.Hash = ""
+		hash, err := hashAuditEntry(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry.Hash = hash
+		data, err := protojson.Marshal(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	tests := []struct {
+		name   string
+		tamper func(t *testing.T, lines []string) []string
+		valid  bool
+		// head is the sequence number of the last entry of a valid log
+		head int64
+	}{
+		{"intact", func(t *testing.T, lines []string) []string { return lines }, true, 3},
+		{"edited entry", func(t *testing.T, lines []string) []string {
+			lines[1] = strings.Replace(lines[1], "b.txt", "x.txt", -1)
+			return lines
+		}, false, 0},
+		{"edited and rehashed entry", func(t *testing.T, lines []string) []string {
+			lines[1] = rehash(t, lines[1], func(entry *AuditEntry) { entry.Accepted = false })
+			return lines
+		}, false, 0},
+		{"rehashed last entry", func(t *testing.T, lines []string) []string {
+			// the head logged on startup reveals this one
+			lines[2] = rehash(t, lines[2], func(entry *AuditEntry) { entry.User = "mallory" })
+			return lines
+		}, true, 3},
+		{"dropped entry", func(t *testing.T, lines []string) []string { return append(lines[:1], lines[2:]...) }, false, 0},
+		{"reordered entries", func(t *testing.T, lines []string) []string {
+			lines[0], lines[1] = lines[1], lines[0]
+			return lines
+		}, false, 0},
+		{"dropped last entry", func(t *testing.T, lines []string) []string { return lines[:2] }, true, 2},
+		{"garbage", func(t *testing.T, lines []string) []string { return append(lines, "not json") }, false, 0},
+	}
+	for _, test := range tests {
+		path := newTestAuditLog(t, "a.txt", "b.txt", "c.txt")
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := test.tamper(t, strings.Split(strings.TrimSuffix(string(data), "\n"), "\n"))
+		if err := ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		a, err := OpenAuditLog(path)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: OpenAuditLog error = %v, want valid %v", test.name, err, test.valid)
+		}
+		if err != nil {
+			continue
+		}
+		if sequence, _ := a.Head(); sequence != test.head {
+			t.Errorf("%s: Head = %d, want %d", test.name, sequence, test.head)
+		}
+		// appending continues the chain
+		if _, err := a.Append(context.Background(), &AuditEntry{Filename: "d.txt"}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := a.Query(&AuditQuery{}); err != nil {
+			t.Errorf("%s: Query after appending: %v", test.name, err)
+		}
+		a.Close()
+	}
+}
+
+func TestAuditLogQuery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	a, err := OpenAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	entries := []*AuditEntry{
+		{Filename: "docs/a", Owner: "alice", OwnerFilename: "docs/a"},
+		{Filename: SHARED_DIR + "/alice/docs/b", Owner: "alice", OwnerFilename: "docs/b"},
+		{Filename: "docs2/c", Owner: "bob", OwnerFilename: "docs2/c"},
+		{Action: AuditAction_RENAME, Filename: "tmp/d", NewFilename: "docs/d", Owner: "bob", OwnerFilename: "tmp/d", NewOwnerFilename: "docs/d"},
+	}
+	for _, entry := range entries {
+		if _, err := a.Append(context.Background(), entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		query *AuditQuery
+		// sequences are those of the matching entries
+		sequences []int64
+	}{
+		{"everything", &AuditQuery{}, []int64{1, 2, 3, 4}},
+		{"folder", &AuditQuery{Path: "docs"}, []int64{1, 2, 4}},
+		{"folder with slash", &AuditQuery{Path: "docs/"}, []int64{1, 2, 4}},
+		{"as named by the client", &AuditQuery{Path: SHARED_DIR + "/alice"}, []int64{2}},
+		{"rename source", &AuditQuery{Path: "tmp"}, []int64{4}},
+		{"owner", &AuditQuery{Owner: "bob"}, []int64{3, 4}},
+		{"folder and owner", &AuditQuery{Path: "docs", Owner: "bob"}, []int64{4}},
+		{"from", &AuditQuery{From: entries[2].Time}, []int64{3, 4}},
+		{"to", &AuditQuery{To: entries[1].Time}, []int64{1, 2}},
+		{"nothing", &AuditQuery{Path: "other"}, nil},
+	}
+	for _, test := range tests {
+		got, err := a.Query(test.query)
+		if err != nil {
+			t.Fatalf("%s: Query: %v", test.name, err)
+		}
+		var sequences []int64
+		for _, entry := range got {
+			sequences = append(sequences, entry.Sequence)
+		}
+		if len(sequences) != len(test.sequences) {
+			t.Errorf("%s: Query = %v, want %v", test.name, sequences, test.sequences)
+			continue
+		}
+		for i := range sequences {
+			if sequences[i] != test.sequences[i] {
+				t.Errorf("%s: Query = %v, want %v", test.name, sequences, test.sequences)
+				break
+			}
+		}
+	}
+}
+
+func TestMetaStoreAudit(t *testing.T) {
+	m := NewMetaStore("")
+	a, err := OpenAuditLog(filepath.Join(t.TempDir(), "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	m.AuditLog = a
+	m.Admins = map[string]bool{"carol": true}
+	alice := userContext("alice")
+
+	changes := []struct {
+		name   string
+		change func() error
+		want   *AuditEntry
+	}{
+		{"update", func() error {
+			_, err := m.UpdateFile(alice, &FileMetaData{Filename: "a", Version: 1, BlockHashList: []string{"h"}})
+			return err
+		}, &AuditEntry{Action: AuditAction_UPDATE, Owner: "alice", OwnerFilename: "a", NewVersion: 1, Accepted: true}},
+		{"outdated update", func() error {
+			_, err := m.UpdateFile(alice, &FileMetaData{Filename: "a", Version: 1, BlockHashList: []string{"g"}})
+			return err
+		}, &AuditEntry{Action: AuditAction_UPDATE, Owner: "alice", OwnerFilename: "a", OldVersion: 1, NewVersion: 1}},
+		{"rename", func() error {
+			_, err := m.RenameFile(alice, &RenameRequest{OldFilename: "a", NewFilename: "b", Version: 1})
+			return err
+		}, &AuditEntry{Action: AuditAction_RENAME, Owner: "alice", OwnerFilename: "a", NewOwnerFilename: "b", OldVersion: 1, NewVersion: 2, Accepted: true}},
+		{"rename of a missing file", func() error {
+			_, err := m.RenameFile(alice, &RenameRequest{OldFilename: "a", NewFilename: "c", Version: 2})
+			return err
+		}, &AuditEntry{Action: AuditAction_RENAME, Owner: "alice", OwnerFilename: "a", NewOwnerFilename: "c", OldVersion: 2}},
+	}
+	for _, change := range changes {
+		err := change.change()
+		if (err == nil) != change.want.Accepted {
+			t.Errorf("%s: error = %v, want accepted %v", change.name, err, change.want.Accepted)
+		}
+	}
+
+	entries, err := m.QueryAuditLog(userContext("carol"), &AuditQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries.Entries) != len(changes) {
+		t.Fatalf("QueryAuditLog returned %d entries, want %d", len(entries.Entries), len(changes))
+	}
+	for i, got := range entries.Entries {
+		want := changes[i].want
+		if got.Action != want.Action || got.User != "alice" || got.Owner != want.Owner || got.OwnerFilename != want.OwnerFilename ||
+			got.NewOwnerFilename != want.NewOwnerFilename || got.OldVersion != want.OldVersion || got.NewVersion != want.NewVersion ||
+			got.Accepted != want.Accepted || (got.Error == "") != want.Accepted {
+			t.Errorf("%s: entry %v, want %v", changes[i].name, got, want)
+		}
+	}
+
+	queries := []struct {
+		name string
+		ctx  context.Context
+		code codes.Code
+	}{
+		{"admin", userContext("carol"), codes.OK},
+		{"other user", alice, codes.PermissionDenied},
+		{"unauthenticated server", context.Background(), codes.OK},
+	}
+	for _, query := range queries {
+		if _, err := m.QueryAuditLog(query.ctx, &AuditQuery{}); status.Code(err) != query.code {
+			t.Errorf("%s: QueryAuditLog got %v, want %v", query.name, err, query.code)
+		}
+	}
+	if err := m.CheckHealth(); err != nil {
+		t.Errorf("CheckHealth: %v", err)
+	}
+}
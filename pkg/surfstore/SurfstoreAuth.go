@@ -0,0 +1,118 @@
+package surfstore
+
+import (
+	"bufio"
+	context "context"
+	"fmt"
+	"os"
+	"strings"
+
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const AUTH_METADATA_KEY string = "authorization"
+const AUTH_SCHEME string = "Bearer "
+
+type userContextKey struct{}
+
+// Authenticator identifies the user behind each RPC, either by a bearer
+// token sent in the request metadata or by the common name of a verified
+// TLS client certificate.
+type Authenticator struct {
+	Tokens         map[string]string // token -> user
+	UseClientCerts bool
+}
+
+// LoadTokenFile reads "user,token" lines into a token -> user map. Blank
+// lines and lines starting with "#" are skipped.
+func LoadTokenFile(tokenFile string) (map[string]string, error) {
+	f, err := os.Open(tokenFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tokens := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		items := strings.SplitN(line, CONFIG_DELIMITER, 2)
+		if len(items) != 2 || items[0] == "" || items[1] == "" {
+			return nil, fmt.Errorf("%s:%d: expected user,token", tokenFile, lineNum)
+		}
+		tokens[items[1]] = items[0]
+	}
+	return tokens, scanner.Err()
+}
+
+// Authenticate returns the user making the RPC in ctx.
+func (a *Authenticator) Authenticate(ctx context.Context) (string, error) {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for _, value := range md.Get(AUTH_METADATA_KEY) {
+			if !strings.HasPrefix(value, AUTH_SCHEME) {
+				continue
+			}
+			if user, ok := a.Tokens[strings.TrimPrefix(value, AUTH_SCHEME)]; ok {
+				return user, nil
+			}
+			return "", status.Error(codes.Unauthenticated, "invalid token")
+		}
+	}
+
+	if a.UseClientCerts {
+		if p, ok := peer.FromContext(ctx); ok {
+			if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(tlsInfo.State.VerifiedChains) > 0 {
+				if user := tlsInfo.State.VerifiedChains[0][0].Subject.CommonName; user != "" {
+					return user, nil
+				}
+			}
+		}
+	}
+
+	return "", status.Error(codes.Unauthenticated, "missing credentials")
+}
+
+// UnaryInterceptor rejects unauthenticated RPCs and records the caller in
+// the context passed on to the handler and in its logger. Health checks need
+// no credentials.
+func (a *Authenticator) UnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if strings.HasPrefix(info.FullMethod, HEALTH_SERVICE_PREFIX) {
+		return handler(ctx, req)
+	}
+	user, err := a.Authenticate(ctx)
+	if err != nil {
+		loggerFromContext(ctx).Warn("Rejected unauthenticated RPC", "error", err)
+		return nil, err
+	}
+	ctx = context.WithValue(ctx, userContextKey{}, user)
+	return handler(context.WithValue(ctx, loggerKey{}, loggerFromContext(ctx).With("user", user)), req)
+}
+
+// UserFromContext returns the authenticated user of an RPC, or "" if the
+// server does not authenticate clients.
+func UserFromContext(ctx context.Context) string {
+	user, _ := ctx.Value(userContextKey{}).(string)
+	return user
+}
+
+// tokenCredentials attaches a bearer token to every RPC of a connection.
+type tokenCredentials struct {
+	token string
+}
+
+func (t tokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{AUTH_METADATA_KEY: AUTH_SCHEME + t.token}, nil
+}
+
+// RequireTransportSecurity keeps tokens from being sent in plaintext.
+func (t tokenCredentials) RequireTransportSecurity() bool {
+	return true
+}
@@ -0,0 +1,434 @@
+package surfstore
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// Stored blocks start with BLOCK_FILE_MAGIC, their compression and their
+// uncompressed size, then the length and id of the master key and the length
+// and value of the wrapped data key, followed by the encrypted data. Blocks
+// stored without a key ring have an empty key id and are followed directly by
+// their data.
+const BLOCK_FILE_MAGIC string = "SSB2"
+
+// Blocks stored before compression was supported have neither a compression
+// nor a size
+const BLOCK_FILE_MAGIC_V1 string = "SSB1"
+
+const BLOCK_DATA_KEY_SIZE int = 32
+
+const BLOCK_FILE_CORRUPT_SUFFIX string = ".corrupt"
+
+const BLOCK_HEALTH_PROBE_PATTERN string = ".health-*"
+
+var errCorruptBlockFile = errors.New("corrupt block file")
+
+// BlockDir stores blocks durably in a directory, one file per block, sharded
+// by the first two characters of the hash. With a key ring, every block is
+// encrypted with its own data key, which is stored wrapped by a master key.
+type BlockDir struct {
+	Dir  string
+	Keys *KeyRing
+}
+
+// NewBlockDir creates dir if needed. keys may be nil to store blocks
+// unencrypted.
+func NewBlockDir(dir string, keys *KeyRing) (*BlockDir, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &BlockDir{Dir: dir, Keys: keys}, nil
+}
+
+func validBlockHash(hash string) bool {
+	if len(hash) != 2*32 {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
+
+// blockPath returns where the block with hash is stored, refusing anything
+// that is not a SHA-256 hash so clients cannot name other files.
+func (d *BlockDir) blockPath(hash string) (string, error) {
+	if !validBlockHash(hash) {
+		return "", fmt.Errorf("invalid block hash %q", hash)
+	}
+	return filepath.Join(d.Dir, hash[:2], hash), nil
+}
+
+// Get returns the block with hash, or nil if it is not stored.
+func (d *BlockDir) Get(hash string) (*Block, error) {
+	blockPath, err := d.blockPath(hash)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := ioutil.ReadFile(blockPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	stored, err := parseStoredBlock(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", blockPath, err)
+	}
+	data, err := d.decrypt(hash, stored)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", blockPath, err)
+	}
+	if stored.compression == Compression_NONE {
+		stored.blockSize = int32(len(data))
+	}
+	return &Block{BlockData: data, BlockSize: stored.blockSize, Compression: stored.compression}, nil
+}
+
+// Put stores block, compressed as it is, under hash unless it is already
+// stored.
+func (d *BlockDir) Put(hash string, block *Block) error {
+	blockPath, err := d.blockPath(hash)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(blockPath); err == nil {
+		return nil
+	}
+
+	stored, err := d.encrypt(hash, block.GetBlockData())
+	if err != nil {
+		return err
+	}
+	stored.compression = block.GetCompression()
+	stored.blockSize = block.GetBlockSize()
+	return writeFileAtomic(blockPath, stored.bytes())
+}
+
+// Has reports whether the block with hash is stored.
+func (d *BlockDir) Has(hash string) bool {
+	blockPath, err := d.blockPath(hash)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(blockPath)
+	return err == nil
+}
+
+// CheckHealth writes and removes a probe file to check that blocks can be
+// stored.
+func (d *BlockDir) CheckHealth() error {
+	f, err := ioutil.TempFile(d.Dir, BLOCK_HEALTH_PROBE_PATTERN)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write([]byte(BLOCK_FILE_MAGIC))
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if removeErr := os.Remove(f.Name()); err == nil {
+		err = removeErr
+	}
+	return err
+}
+
+// Sync makes the blocks stored so far durable by syncing the directories
+// their files were renamed into.
+func (d *BlockDir) Sync() error {
+	return filepath.Walk(d.Dir, func(dirPath string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return err
+		}
+		dir, err := os.Open(dirPath)
+		if err != nil {
+			return err
+		}
+		err = dir.Sync()
+		if closeErr := dir.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	})
+}
+
+// Usage counts the stored blocks and the size of their files, which includes
+// the headers and encryption overhead.
+func (d *BlockDir) Usage() (blocks int, bytes int64, err error) {
+	err = filepath.Walk(d.Dir, func(blockPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() && validBlockHash(info.Name()) {
+			blocks++
+			bytes += info.Size()
+		}
+		return nil
+	})
+	return blocks, bytes, err
+}
+
+// Rotate rewraps the data key of every block that is not under the current
+// master key, and encrypts blocks stored before there was a key ring. Blocks
+// are replaced one at a time, so the BlockStore keeps serving meanwhile.
+// progress, if not nil, is called after every checked block.
+func (d *BlockDir) Rotate(progress func(checked, rotated int)) (rotated int, err error) {
+	if d.Keys == nil {
+		return 0, errors.New("no key ring to rotate to")
+	}
+	currentID := d.Keys.CurrentID()
+
+	checked := 0
+	err = filepath.Walk(d.Dir, func(blockPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		hash := info.Name()
+		if !info.Mode().IsRegular() || !validBlockHash(hash) {
+			return nil
+		}
+		checked++
+		if progress != nil {
+			defer func() { progress(checked, rotated) }()
+		}
+
+		raw, err := ioutil.ReadFile(blockPath)
+		if err != nil {
+			return err
+		}
+		stored, err := parseStoredBlock(raw)
+		if err != nil {
+			return fmt.Errorf("%s: %v", blockPath, err)
+		}
+		if stored.keyID == currentID {
+			return nil
+		}
+
+		if stored.keyID == "" {
+			var encrypted *storedBlock
+			encrypted, err = d.encrypt(hash, stored.data)
+			if err == nil {
+				stored.keyID, stored.wrappedKey, stored.data = encrypted.keyID, encrypted.wrappedKey, encrypted.data
+			}
+		} else {
+			var dataKey []byte
+			dataKey, err = d.Keys.unwrapKey(stored.keyID, stored.wrappedKey, []byte(hash))
+			if err == nil {
+				stored.keyID = currentID
+				stored.wrappedKey, err = d.Keys.wrapKey(currentID, dataKey, []byte(hash))
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", blockPath, err)
+		}
+		if err := writeFileAtomic(blockPath, stored.bytes()); err != nil {
+			return err
+		}
+		rotated++
+		return nil
+	})
+	return rotated, err
+}
+
+// Scrub reads back every stored block and checks it against its hash. Corrupt
+// blocks are renamed with BLOCK_FILE_CORRUPT_SUFFIX, so they are reported
+// missing instead of being served, but are kept for inspection.
+func (d *BlockDir) Scrub() (checked, corrupt int, err error) {
+	err = filepath.Walk(d.Dir, func(blockPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		hash := info.Name()
+		if !info.Mode().IsRegular() || !validBlockHash(hash) {
+			return nil
+		}
+
+		checked++
+		block, err := d.Get(hash)
+		if errors.Is(err, errUnknownKeyID) {
+			return err
+		}
+		if err == nil && block != nil {
+			var blockHash string
+			if blockHash, err = BlockHashOf(block, 0); err == nil && blockHash != hash {
+				err = fmt.Errorf("hash is %s", blockHash)
+			}
+		}
+		if err == nil {
+			return nil
+		}
+
+		slog.Warn("Quarantining corrupt block", "path", blockPath, "error", err)
+		corrupt++
+		return os.Rename(blockPath, blockPath+BLOCK_FILE_CORRUPT_SUFFIX)
+	})
+	return checked, corrupt, err
+}
+
+// storedBlock is the on-disk form of a block.
+type storedBlock struct {
+	compression Compression
+	// blockSize is the uncompressed size, which blocks stored before
+	// compression was supported lack
+	blockSize  int32
+	keyID      string
+	wrappedKey []byte
+	data       []byte
+}
+
+func parseStoredBlock(raw []byte) (*storedBlock, error) {
+	stored := &storedBlock{}
+	switch {
+	case bytes.HasPrefix(raw, []byte(BLOCK_FILE_MAGIC)):
+		raw = raw[len(BLOCK_FILE_MAGIC):]
+		if len(raw) < 5 {
+			return nil, errCorruptBlockFile
+		}
+		stored.compression = Compression(raw[0])
+		stored.blockSize = int32(binary.BigEndian.Uint32(raw[1:5]))
+		raw = raw[5:]
+	case bytes.HasPrefix(raw, []byte(BLOCK_FILE_MAGIC_V1)):
+		raw = raw[len(BLOCK_FILE_MAGIC_V1):]
+	default:
+		return nil, errCorruptBlockFile
+	}
+
+	keyID, raw, err := readLengthPrefixed(raw)
+	if err != nil {
+		return nil, err
+	}
+	if len(keyID) == 0 {
+		stored.data = raw
+		return stored, nil
+	}
+	stored.keyID = string(keyID)
+	stored.wrappedKey, stored.data, err = readLengthPrefixed(raw)
+	if err != nil {
+		return nil, err
+	}
+	return stored, nil
+}
+
+// readLengthPrefixed splits a field prefixed by its one byte length off raw.
+func readLengthPrefixed(raw []byte) (field, rest []byte, err error) {
+	if len(raw) < 1 || len(raw) < 1+int(raw[0]) {
+		return nil, nil, errCorruptBlockFile
+	}
+	return raw[1 : 1+int(raw[0])], raw[1+int(raw[0]):], nil
+}
+
+func (b *storedBlock) bytes() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(BLOCK_FILE_MAGIC)
+	buf.WriteByte(byte(b.compression))
+	binary.Write(&buf, binary.BigEndian, uint32(b.blockSize))
+	buf.WriteByte(byte(len(b.keyID)))
+	buf.WriteString(b.keyID)
+	if b.keyID != "" {
+		buf.WriteByte(byte(len(b.wrappedKey)))
+		buf.Write(b.wrappedKey)
+	}
+	buf.Write(b.data)
+	return buf.Bytes()
+}
+
+func newDataCipher(dataKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encrypt encrypts data under a new data key wrapped by the current master
+// key. The hash is authenticated along with the data, so a block file cannot
+// be passed off as another block.
+func (d *BlockDir) encrypt(hash string, data []byte) (*storedBlock, error) {
+	if d.Keys == nil {
+		return &storedBlock{data: data}, nil
+	}
+
+	dataKey := make([]byte, BLOCK_DATA_KEY_SIZE)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	aead, err := newDataCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	keyID := d.Keys.CurrentID()
+	wrappedKey, err := d.Keys.wrapKey(keyID, dataKey, []byte(hash))
+	if err != nil {
+		return nil, err
+	}
+	return &storedBlock{
+		keyID:      keyID,
+		wrappedKey: wrappedKey,
+		data:       aead.Seal(nonce, nonce, data, []byte(hash)),
+	}, nil
+}
+
+func (d *BlockDir) decrypt(hash string, stored *storedBlock) ([]byte, error) {
+	if stored.keyID == "" {
+		return stored.data, nil
+	}
+	if d.Keys == nil {
+		return nil, errors.New("block is encrypted but there is no key ring")
+	}
+
+	dataKey, err := d.Keys.unwrapKey(stored.keyID, stored.wrappedKey, []byte(hash))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newDataCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(stored.data) < aead.NonceSize() {
+		return nil, errCorruptBlockFile
+	}
+	return aead.Open(nil, stored.data[:aead.NonceSize()], stored.data[aead.NonceSize():], []byte(hash))
+}
+
+// writeFileAtomic replaces the file at filePath with data, so readers see
+// either the old or the new contents, and syncs it to disk.
+func writeFileAtomic(filePath string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(filePath), 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(filePath), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filePath)
+}
@@ -0,0 +1,146 @@
+package surfstore
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestKeyRing(t *testing.T, lines string) *KeyRing {
+	t.Helper()
+	keyFile := filepath.Join(t.TempDir(), "keys.txt")
+	if err := ioutil.WriteFile(keyFile, []byte(lines), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := LoadKeyRing(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestBlockDirScrubQuarantine(t *testing.T) {
+	const key1 = "k1,000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f\n"
+	data := []byte("block contents")
+	hash := GetBlockHashString(data)
+	otherHash := GetBlockHashString([]byte("other contents"))
+
+	flipLastByte := func(raw []byte) []byte {
+		raw[len(raw)-1] ^= 0xff
+		return raw
+	}
+	tests := []struct {
+		name      string
+		encrypted bool
+		// corrupt changes the stored file, nil leaves it intact
+		corrupt func(raw []byte) []byte
+		// storeAs is the hash the block is stored under, hash if empty
+		storeAs     string
+		quarantined bool
+	}{
+		{"intact", false, nil, "", false},
+		{"intact encrypted", true, nil, "", false},
+		{"flipped data", false, flipLastByte, "", true},
+		{"flipped ciphertext", true, flipLastByte, "", true},
+		{"truncated", false, func(raw []byte) []byte { return raw[:2] }, "", true},
+		{"wrong hash", false, nil, otherHash, true},
+	}
+	for _, test := range tests {
+		var keys *KeyRing
+		if test.encrypted {
+			keys = newTestKeyRing(t, key1)
+		}
+		d, err := NewBlockDir(t.TempDir(), keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		storeAs := hash
+		if test.storeAs != "" {
+			storeAs = test.storeAs
+		}
+		if err := d.Put(storeAs, &Block{BlockData: data, BlockSize: int32(len(data))}); err != nil {
+			t.Fatal(err)
+		}
+		blockPath, _ := d.blockPath(storeAs)
+		if test.corrupt != nil {
+			raw, err := ioutil.ReadFile(blockPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(blockPath, test.corrupt(raw), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		checked, corrupt, err := d.Scrub()
+		if err != nil {
+			t.Errorf("%s: Scrub: %v", test.name, err)
+			continue
+		}
+		wantCorrupt := 0
+		if test.quarantined {
+			wantCorrupt = 1
+		}
+		if checked != 1 || corrupt != wantCorrupt {
+			t.Errorf("%s: Scrub = %d checked, %d corrupt, want 1, %d", test.name, checked, corrupt, wantCorrupt)
+		}
+		if has := d.Has(storeAs); has == test.quarantined {
+			t.Errorf("%s: Has after scrub = %v, want %v", test.name, has, !test.quarantined)
+		}
+		if _, err := os.Stat(blockPath + BLOCK_FILE_CORRUPT_SUFFIX); (err == nil) != test.quarantined {
+			t.Errorf("%s: quarantined file exists = %v, want %v", test.name, err == nil, test.quarantined)
+		}
+
+		// quarantined blocks are not checked again
+		if checked, _, _ := d.Scrub(); checked != 1-wantCorrupt {
+			t.Errorf("%s: second Scrub checked %d blocks, want %d", test.name, checked, 1-wantCorrupt)
+		}
+	}
+}
+
+func TestBlockDirScrubUnknownKey(t *testing.T) {
+	const key1 = "k1,000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f\n"
+	const key2 = "k2,1f1e1d1c1b1a191817161514131211100f0e0d0c0b0a09080706050403020100\n"
+	data := []byte("block contents")
+	hash := GetBlockHashString(data)
+
+	dir := t.TempDir()
+	d, err := NewBlockDir(dir, newTestKeyRing(t, key1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put(hash, &Block{BlockData: data, BlockSize: int32(len(data))}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a block under a key missing from the ring is not corrupt, the ring is
+	d.Keys = newTestKeyRing(t, key2)
+	if _, _, err := d.Scrub(); err == nil {
+		t.Errorf("Scrub with an unknown key succeeded")
+	}
+	if d.Keys = newTestKeyRing(t, key1); !d.Has(hash) {
+		t.Errorf("Scrub with an unknown key quarantined the block")
+	}
+}
+
+func TestBlockStoreScrub(t *testing.T) {
+	good := []byte("good block")
+	bad := []byte("bad block")
+	bs := NewBlockStore()
+	bs.BlockMap[GetBlockHashString(good)] = &Block{BlockData: good, BlockSize: int32(len(good))}
+	bs.BlockMap[GetBlockHashString(bad)] = &Block{BlockData: []byte("rotted"), BlockSize: int32(len(bad))}
+
+	checked, corrupt, err := bs.Scrub()
+	if err != nil || checked != 2 || corrupt != 1 {
+		t.Errorf("Scrub = %d, %d, %v, want 2 checked, 1 corrupt", checked, corrupt, err)
+	}
+	hashes, err := bs.HasBlocks(context.Background(), &BlockHashes{Hashes: []string{GetBlockHashString(good), GetBlockHashString(bad)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hashes.Hashes) != 1 || hashes.Hashes[0] != GetBlockHashString(good) {
+		t.Errorf("HasBlocks after scrub = %v, want only the good block", hashes.Hashes)
+	}
+}
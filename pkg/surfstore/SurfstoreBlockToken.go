@@ -0,0 +1,246 @@
+package surfstore
+
+import (
+	context "context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const BLOCK_TOKEN_METADATA_KEY string = "x-block-token"
+
+// BLOCK_RECEIPT_METADATA_KEY is the response header carrying the receipt of
+// a block the BlockStore stored
+const BLOCK_RECEIPT_METADATA_KEY string = "x-block-receipt"
+
+// BLOCK_TOKEN_TTL is how long a block token issued by the MetaStore is valid
+const BLOCK_TOKEN_TTL time.Duration = 5 * time.Minute
+
+// BLOCK_TOKEN_BATCH_SIZE bounds the hashes named in one token, keeping it
+// well below the gRPC metadata size limit
+const BLOCK_TOKEN_BATCH_SIZE int = 64
+
+var errInvalidBlockToken = errors.New("invalid block token")
+
+// BlockTokenClaims are the blocks a block token allows its holder to read
+// and write until it expires.
+type BlockTokenClaims struct {
+	// ID tells tokens apart, so the BlockStore's receipts can be matched to
+	// the block sizes claimed for the token
+	ID          string   `json:"i,omitempty"`
+	User        string   `json:"u"`
+	Expiry      int64    `json:"e"`
+	ReadHashes  []string `json:"r,omitempty"`
+	WriteHashes []string `json:"w,omitempty"`
+	// WriteSizes holds the size each block of WriteHashes must have
+	WriteSizes []int32 `json:"s,omitempty"`
+}
+
+func (claims *BlockTokenClaims) canRead(hash string) bool {
+	for _, h := range claims.ReadHashes {
+		if h == hash {
+			return true
+		}
+	}
+	return false
+}
+
+func (claims *BlockTokenClaims) canWrite(hash string, size int32) bool {
+	for i, h := range claims.WriteHashes {
+		if h == hash {
+			return i < len(claims.WriteSizes) && claims.WriteSizes[i] == size
+		}
+	}
+	return false
+}
+
+// LoadBlockTokenKey reads the hex encoded key shared by the MetaStore, which
+// signs block tokens, and the BlockStore, which verifies them.
+func LoadBlockTokenKey(keyFile string) ([]byte, error) {
+	keyHex, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(keyHex)))
+	if err != nil {
+		return nil, err
+	}
+	if len(key) < 16 {
+		return nil, errors.New("block token key must be at least 16 bytes")
+	}
+	return key, nil
+}
+
+// newBlockTokenID returns a random id for a block token.
+func newBlockTokenID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(id), nil
+}
+
+func signBlockTokenPayload(key []byte, payload string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signClaims encodes claims as "payload.signature", both base64url. The
+// signature also covers kind, so tokens and receipts cannot stand in for
+// each other.
+func signClaims(key []byte, kind string, claims interface{}) (string, error) {
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(claimsJSON)
+	return payload + "." + signBlockTokenPayload(key, kind+payload), nil
+}
+
+// verifyClaims checks the signature of signed and decodes its claims.
+func verifyClaims(key []byte, kind string, signed string, claims interface{}) error {
+	items := strings.Split(signed, ".")
+	if len(items) != 2 {
+		return errInvalidBlockToken
+	}
+	if !hmac.Equal([]byte(items[1]), []byte(signBlockTokenPayload(key, kind+items[0]))) {
+		return errInvalidBlockToken
+	}
+
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(items[0])
+	if err != nil {
+		return errInvalidBlockToken
+	}
+	if err := json.Unmarshal(claimsJSON, claims); err != nil {
+		return errInvalidBlockToken
+	}
+	return nil
+}
+
+// SignBlockToken encodes claims as "payload.signature", both base64url.
+func SignBlockToken(key []byte, claims *BlockTokenClaims) (string, error) {
+	return signClaims(key, "", claims)
+}
+
+// VerifyBlockToken checks the signature and expiry of token and returns its
+// claims.
+func VerifyBlockToken(key []byte, token string, now time.Time) (*BlockTokenClaims, error) {
+	var claims BlockTokenClaims
+	if err := verifyClaims(key, "", token, &claims); err != nil {
+		return nil, err
+	}
+	if now.Unix() > claims.Expiry {
+		return nil, errors.New("block token expired")
+	}
+	return &claims, nil
+}
+
+// blockReceipt is the BlockStore's confirmation that it stored the block
+// Hash of Size bytes under the block token TokenID.
+type blockReceipt struct {
+	TokenID string `json:"i"`
+	Hash    string `json:"h"`
+	Size    int32  `json:"s"`
+}
+
+func signBlockReceipt(key []byte, receipt *blockReceipt) (string, error) {
+	return signClaims(key, "receipt.", receipt)
+}
+
+func verifyBlockReceipt(key []byte, signed string) (*blockReceipt, error) {
+	var receipt blockReceipt
+	if err := verifyClaims(key, "receipt.", signed, &receipt); err != nil {
+		return nil, err
+	}
+	return &receipt, nil
+}
+
+// BlockTokenVerifier makes the BlockStore only serve and accept the blocks
+// named by a valid block token sent with each RPC.
+type BlockTokenVerifier struct {
+	Key []byte
+	// MaxBlockSize is the largest block accepted, 0 for no limit. Larger
+	// blocks are refused before they are decompressed to hash them.
+	MaxBlockSize int
+}
+
+type blockHashKey struct{}
+
+// blockHashFromContext returns the hash of the block of a PutBlock if an
+// interceptor already computed it, so blocks are only decompressed once.
+func blockHashFromContext(ctx context.Context) (string, bool) {
+	hash, ok := ctx.Value(blockHashKey{}).(string)
+	return hash, ok
+}
+
+// UnaryInterceptor checks BlockStore RPCs against their block token. Stored
+// blocks are confirmed with a receipt in the response header, which the
+// client hands to the MetaStore. RPCs of other services are passed through.
+func (v *BlockTokenVerifier) UnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if !strings.HasPrefix(info.FullMethod, "/surfstore.BlockStore/") {
+		return handler(ctx, req)
+	}
+
+	var token string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(BLOCK_TOKEN_METADATA_KEY); len(values) > 0 {
+			token = values[0]
+		}
+	}
+	if token == "" {
+		return nil, status.Error(codes.Unauthenticated, "missing block token")
+	}
+	claims, err := VerifyBlockToken(v.Key, token, time.Now())
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+
+	var receipt *blockReceipt
+	switch r := req.(type) {
+	case *BlockHash:
+		if !claims.canRead(r.Hash) {
+			return nil, status.Errorf(codes.PermissionDenied, "block token does not allow reading %s", r.Hash)
+		}
+	case *Block:
+		hash, err := BlockHashOf(r, v.MaxBlockSize)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		if !claims.canWrite(hash, r.BlockSize) {
+			return nil, status.Errorf(codes.PermissionDenied, "block token does not allow writing %s with %d bytes", hash, r.BlockSize)
+		}
+		ctx = context.WithValue(ctx, blockHashKey{}, hash)
+		receipt = &blockReceipt{TokenID: claims.ID, Hash: hash, Size: r.BlockSize}
+	case *BlockHashes:
+		// write rights are not enough, since they are granted for any block
+		// of an update and would reveal which blocks others stored
+		for _, hash := range r.Hashes {
+			if !claims.canRead(hash) {
+				return nil, status.Errorf(codes.PermissionDenied, "block token does not allow reading %s", hash)
+			}
+		}
+	default:
+		return nil, status.Errorf(codes.PermissionDenied, "block token does not allow %s", info.FullMethod)
+	}
+
+	resp, err := handler(ctx, req)
+	if err == nil && receipt != nil && receipt.TokenID != "" {
+		if signed, err := signBlockReceipt(v.Key, receipt); err == nil {
+			grpc.SetHeader(ctx, metadata.Pairs(BLOCK_RECEIPT_METADATA_KEY, signed))
+		}
+	}
+	return resp, err
+}
@@ -0,0 +1,161 @@
+package surfstore
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+var testBlockTokenKey = []byte("0123456789abcdef0123456789abcdef")
+
+func TestVerifyBlockToken(t *testing.T) {
+	now := time.Now()
+	claims := &BlockTokenClaims{User: "alice", Expiry: now.Add(time.Minute).Unix(), ReadHashes: []string{"r"}, WriteHashes: []string{"w"}, WriteSizes: []int32{4}}
+	token, err := SignBlockToken(testBlockTokenKey, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := SignBlockToken(testBlockTokenKey, &BlockTokenClaims{User: "alice", Expiry: now.Add(-time.Second).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, signature, _ := strings.Cut(token, ".")
+	otherPayload, _, _ := strings.Cut(expired, ".")
+
+	tests := []struct {
+		name  string
+		key   []byte
+		token string
+		now   time.Time
+		valid bool
+	}{
+		{"valid", testBlockTokenKey, token, now, true},
+		{"valid until expiry", testBlockTokenKey, token, now.Add(time.Minute), true},
+		{"expired", testBlockTokenKey, token, now.Add(2 * time.Minute), false},
+		{"issued expired", testBlockTokenKey, expired, now, false},
+		{"other key", []byte("fedcba9876543210fedcba9876543210"), token, now, false},
+		{"swapped payload", testBlockTokenKey, otherPayload + "." + signature, now, false},
+		{"no signature", testBlockTokenKey, payload, now, false},
+		{"empty signature", testBlockTokenKey, payload + ".", now, false},
+		{"extra part", testBlockTokenKey, token + ".x", now, false},
+		{"empty", testBlockTokenKey, "", now, false},
+	}
+	for _, test := range tests {
+		got, err := VerifyBlockToken(test.key, test.token, test.now)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: VerifyBlockToken = %v, %v, want valid %v", test.name, got, err, test.valid)
+			continue
+		}
+		if test.valid && (got.User != "alice" || !got.canRead("r") || !got.canWrite("w", 4) ||
+			got.canWrite("w", 5) || got.canRead("w") || got.canWrite("r", 4)) {
+			t.Errorf("%s: VerifyBlockToken returned claims %+v", test.name, got)
+		}
+	}
+}
+
+func TestBlockTokenVerifier(t *testing.T) {
+	block := &Block{BlockData: []byte("data"), BlockSize: 4}
+	hash := GetBlockHashString(block.BlockData)
+	sign := func(claims *BlockTokenClaims) string {
+		claims.Expiry = time.Now().Add(time.Minute).Unix()
+		token, err := SignBlockToken(testBlockTokenKey, claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	readToken := sign(&BlockTokenClaims{ReadHashes: []string{hash}})
+	writeToken := sign(&BlockTokenClaims{WriteHashes: []string{hash}, WriteSizes: []int32{4}})
+	wrongSizeToken := sign(&BlockTokenClaims{WriteHashes: []string{hash}, WriteSizes: []int32{5}})
+
+	tests := []struct {
+		name   string
+		method string
+		req    interface{}
+		token  string
+		code   codes.Code
+	}{
+		{"get with read rights", "GetBlock", &BlockHash{Hash: hash}, readToken, codes.OK},
+		{"get with write rights", "GetBlock", &BlockHash{Hash: hash}, writeToken, codes.PermissionDenied},
+		{"get other block", "GetBlock", &BlockHash{Hash: "other"}, readToken, codes.PermissionDenied},
+		{"get without token", "GetBlock", &BlockHash{Hash: hash}, "", codes.Unauthenticated},
+		{"get with forged token", "GetBlock", &BlockHash{Hash: hash}, readToken + "x", codes.Unauthenticated},
+		{"put with write rights", "PutBlock", block, writeToken, codes.OK},
+		{"put with read rights", "PutBlock", block, readToken, codes.PermissionDenied},
+		{"put with another size", "PutBlock", block, wrongSizeToken, codes.PermissionDenied},
+		{"has with read rights", "HasBlocks", &BlockHashes{Hashes: []string{hash}}, readToken, codes.OK},
+		{"has with write rights", "HasBlocks", &BlockHashes{Hashes: []string{hash}}, writeToken, codes.PermissionDenied},
+		{"has some other block", "HasBlocks", &BlockHashes{Hashes: []string{hash, "other"}}, readToken, codes.PermissionDenied},
+	}
+	verifier := &BlockTokenVerifier{Key: testBlockTokenKey}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) { return &Success{Flag: true}, nil }
+	for _, test := range tests {
+		ctx := context.Background()
+		if test.token != "" {
+			ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(BLOCK_TOKEN_METADATA_KEY, test.token))
+		}
+		info := &grpc.UnaryServerInfo{FullMethod: "/surfstore.BlockStore/" + test.method}
+		if _, err := verifier.UnaryInterceptor(ctx, test.req, info, handler); status.Code(err) != test.code {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.code)
+		}
+	}
+
+	// other services do not need block tokens
+	info := &grpc.UnaryServerInfo{FullMethod: "/surfstore.MetaStore/GetFileInfoMap"}
+	if _, err := verifier.UnaryInterceptor(context.Background(), nil, info, handler); err != nil {
+		t.Errorf("MetaStore RPC without block token: %v", err)
+	}
+}
+
+func TestGetBlockToken(t *testing.T) {
+	m := NewMetaStore("")
+	m.BlockTokenKey = testBlockTokenKey
+	if _, err := m.ShareFolder(userContext("alice"), &Share{Path: "ro", User: "bob", Permission: Permission_READ}); err != nil {
+		t.Fatal(err)
+	}
+	alice := m.fileMetaMap("alice")
+	alice["ro/a"] = &FileMetaData{Filename: "ro/a", Version: 1, BlockHashList: []string{"shared"}}
+	alice["private"] = &FileMetaData{Filename: "private", Version: 1, BlockHashList: []string{"secret"}}
+
+	tests := []struct {
+		name       string
+		user       string
+		request    *BlockTokenRequest
+		code       codes.Code
+		readHashes []string
+	}{
+		{"read own blocks", "alice", &BlockTokenRequest{ReadHashes: []string{"shared", "secret"}}, codes.OK, []string{"shared", "secret"}},
+		{"read shared blocks", "bob", &BlockTokenRequest{ReadHashes: []string{"shared", "secret"}}, codes.OK, []string{"shared"}},
+		{"read unknown blocks", "carol", &BlockTokenRequest{ReadHashes: []string{"shared"}}, codes.OK, nil},
+		{"write own file", "alice", &BlockTokenRequest{WriteHashes: []string{"h"}, File: &FileMetaData{Filename: "new", Version: 1, BlockHashList: []string{"h"}}, BlockSizes: []int32{1}}, codes.OK, nil},
+		{"write read-only share", "bob", &BlockTokenRequest{WriteHashes: []string{"h"}, File: &FileMetaData{Filename: SHARED_DIR + "/alice/ro/a", Version: 2, BlockHashList: []string{"h"}}, BlockSizes: []int32{1}}, codes.PermissionDenied, nil},
+		{"write blocks of another file", "alice", &BlockTokenRequest{WriteHashes: []string{"g"}, File: &FileMetaData{Filename: "new", Version: 1, BlockHashList: []string{"h"}}, BlockSizes: []int32{1}}, codes.InvalidArgument, nil},
+		{"write without sizes", "alice", &BlockTokenRequest{WriteHashes: []string{"h"}, File: &FileMetaData{Filename: "new", Version: 1, BlockHashList: []string{"h"}}}, codes.InvalidArgument, nil},
+		{"write without file", "alice", &BlockTokenRequest{WriteHashes: []string{"h"}}, codes.InvalidArgument, nil},
+	}
+	for _, test := range tests {
+		blockToken, err := m.GetBlockToken(userContext(test.user), test.request)
+		if status.Code(err) != test.code {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.code)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		claims, err := VerifyBlockToken(testBlockTokenKey, blockToken.GetToken(), time.Now())
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if claims.User != test.user || strings.Join(claims.ReadHashes, ",") != strings.Join(test.readHashes, ",") ||
+			strings.Join(claims.WriteHashes, ",") != strings.Join(test.request.WriteHashes, ",") {
+			t.Errorf("%s: got claims %+v", test.name, claims)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package surfstore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// zstdEncoder is safe for concurrent use through EncodeAll
+var zstdEncoder, _ = zstd.NewWriter(nil)
+
+// ParseCompression parses the -compress flag of the client.
+func ParseCompression(name string) (Compression, error) {
+	if name == "" {
+		return Compression_NONE, nil
+	}
+	if value, ok := Compression_value[strings.ToUpper(name)]; ok {
+		return Compression(value), nil
+	}
+	return Compression_NONE, fmt.Errorf("unknown compression %q, expected none, gzip, zstd or snappy", name)
+}
+
+// CompressBlock compresses the data of block, leaving it uncompressed if that
+// does not make it smaller. BlockSize stays the size of the uncompressed data,
+// which is also what the block's hash is computed from.
+func CompressBlock(block *Block, compression Compression) error {
+	if block.Compression != Compression_NONE {
+		return fmt.Errorf("block is already compressed with %v", block.Compression)
+	}
+
+	var compressed []byte
+	switch compression {
+	case Compression_NONE:
+		return nil
+	case Compression_GZIP:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(block.BlockData); err != nil {
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		compressed = buf.Bytes()
+	case Compression_ZSTD:
+		compressed = zstdEncoder.EncodeAll(block.BlockData, nil)
+	case Compression_SNAPPY:
+		compressed = snappy.Encode(nil, block.BlockData)
+	default:
+		return fmt.Errorf("unknown compression %v", compression)
+	}
+
+	// incompressible data, e.g. encrypted blocks, is sent as it is
+	if len(compressed) >= len(block.BlockData) {
+		return nil
+	}
+	block.BlockData = compressed
+	block.Compression = compression
+	return nil
+}
+
+// DecompressBlock returns the uncompressed data of block, which must be
+// exactly BlockSize bytes long. No more than that is decompressed, so a small
+// block cannot expand to fill the reader's memory, and blocks claiming more
+// than maxSize bytes are refused before decompressing. maxSize 0 is no limit.
+func DecompressBlock(block *Block, maxSize int) ([]byte, error) {
+	if maxSize > 0 && (int(block.GetBlockSize()) > maxSize || len(block.GetBlockData()) > maxSize) {
+		return nil, fmt.Errorf("blocks may have at most %d bytes", maxSize)
+	}
+	size := int64(block.GetBlockSize())
+	var r io.Reader
+	switch block.GetCompression() {
+	case Compression_NONE:
+		if int64(len(block.GetBlockData())) != size {
+			return nil, fmt.Errorf("block has %d bytes, expected %d", len(block.GetBlockData()), size)
+		}
+		return block.GetBlockData(), nil
+	case Compression_GZIP:
+		gzipReader, err := gzip.NewReader(bytes.NewReader(block.GetBlockData()))
+		if err != nil {
+			return nil, err
+		}
+		defer gzipReader.Close()
+		r = gzipReader
+	case Compression_ZSTD:
+		zstdReader, err := zstd.NewReader(bytes.NewReader(block.GetBlockData()), zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		defer zstdReader.Close()
+		r = zstdReader
+	case Compression_SNAPPY:
+		decodedLen, err := snappy.DecodedLen(block.GetBlockData())
+		if err != nil {
+			return nil, err
+		}
+		if int64(decodedLen) != size {
+			return nil, fmt.Errorf("block decompresses to %d bytes, expected %d", decodedLen, size)
+		}
+		return snappy.Decode(nil, block.GetBlockData())
+	default:
+		return nil, fmt.Errorf("unknown compression %v", block.GetCompression())
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(r, size+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != size {
+		return nil, fmt.Errorf("block decompresses to more or less than %d bytes", size)
+	}
+	return data, nil
+}
+
+// BlockHashOf returns the hash of the uncompressed data of block, refusing
+// blocks of more than maxSize bytes like DecompressBlock.
+func BlockHashOf(block *Block, maxSize int) (string, error) {
+	data, err := DecompressBlock(block, maxSize)
+	if err != nil {
+		return "", err
+	}
+	return GetBlockHashString(data), nil
+}
@@ -0,0 +1,129 @@
+package surfstore
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/golang/snappy"
+)
+
+func TestCompressBlockRoundTrip(t *testing.T) {
+	compressible := bytes.Repeat([]byte("surfstore "), 400)
+	random := []byte("\x8f\x01\xd3\x5a\x77\xc0\x1e\x94")
+	tests := []struct {
+		compression Compression
+		data        []byte
+		// incompressible data stays uncompressed
+		compressed bool
+	}{
+		{Compression_NONE, compressible, false},
+		{Compression_GZIP, compressible, true},
+		{Compression_ZSTD, compressible, true},
+		{Compression_SNAPPY, compressible, true},
+		{Compression_GZIP, random, false},
+		{Compression_ZSTD, random, false},
+		{Compression_SNAPPY, random, false},
+	}
+	for _, test := range tests {
+		block := &Block{BlockData: append([]byte(nil), test.data...), BlockSize: int32(len(test.data))}
+		if err := CompressBlock(block, test.compression); err != nil {
+			t.Fatalf("%v: CompressBlock: %v", test.compression, err)
+		}
+		if got := block.Compression != Compression_NONE; got != test.compressed {
+			t.Errorf("%v of %d bytes: compressed = %v, want %v", test.compression, len(test.data), got, test.compressed)
+		}
+		if int(block.BlockSize) != len(test.data) {
+			t.Errorf("%v: BlockSize = %d, want the uncompressed %d", test.compression, block.BlockSize, len(test.data))
+		}
+		data, err := DecompressBlock(block, 0)
+		if err != nil || !bytes.Equal(data, test.data) {
+			t.Errorf("%v: DecompressBlock = %d bytes, %v, want the original %d bytes", test.compression, len(data), err, len(test.data))
+		}
+		if hash, err := BlockHashOf(block, 0); err != nil || hash != GetBlockHashString(test.data) {
+			t.Errorf("%v: BlockHashOf = %s, %v, want the hash of the uncompressed data", test.compression, hash, err)
+		}
+	}
+}
+
+func TestDecompressBlockBounded(t *testing.T) {
+	// a small block that expands far beyond the size it claims
+	bomb := bytes.Repeat([]byte{0}, 1<<20)
+	compressed := func(compression Compression, data []byte) []byte {
+		block := &Block{BlockData: data, BlockSize: int32(len(data))}
+		if err := CompressBlock(block, compression); err != nil {
+			t.Fatal(err)
+		}
+		return block.BlockData
+	}
+	tests := []struct {
+		name  string
+		block *Block
+		valid bool
+	}{
+		{"gzip exact", &Block{BlockData: compressed(Compression_GZIP, bomb), BlockSize: 1 << 20, Compression: Compression_GZIP}, true},
+		{"gzip bomb", &Block{BlockData: compressed(Compression_GZIP, bomb), BlockSize: 4096, Compression: Compression_GZIP}, false},
+		{"zstd bomb", &Block{BlockData: compressed(Compression_ZSTD, bomb), BlockSize: 4096, Compression: Compression_ZSTD}, false},
+		{"snappy bomb", &Block{BlockData: snappy.Encode(nil, bomb), BlockSize: 4096, Compression: Compression_SNAPPY}, false},
+		{"gzip short", &Block{BlockData: compressed(Compression_GZIP, bomb), BlockSize: 2 << 20, Compression: Compression_GZIP}, false},
+		{"gzip garbage", &Block{BlockData: []byte("not gzip"), BlockSize: 8, Compression: Compression_GZIP}, false},
+		{"unknown compression", &Block{BlockData: []byte("data"), BlockSize: 4, Compression: Compression(99)}, false},
+	}
+	for _, test := range tests {
+		data, err := DecompressBlock(test.block, 0)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: DecompressBlock error = %v, want valid %v", test.name, err, test.valid)
+		}
+		if len(data) > int(test.block.BlockSize) {
+			t.Errorf("%s: DecompressBlock returned %d bytes, more than the %d claimed", test.name, len(data), test.block.BlockSize)
+		}
+	}
+}
+
+func TestPutBlockUsesInterceptorHash(t *testing.T) {
+	data := []byte("block contents")
+	block := &Block{BlockData: data, BlockSize: int32(len(data))}
+	bs := NewBlockStore()
+
+	// the hash checked by the BlockTokenVerifier is used as is
+	ctx := context.WithValue(context.Background(), blockHashKey{}, "checked")
+	if _, err := bs.PutBlock(ctx, block); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := bs.BlockMap["checked"]; !ok {
+		t.Errorf("PutBlock stored %v, want the block under the hash from the context", bs.BlockMap)
+	}
+
+	if _, err := bs.PutBlock(context.Background(), block); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := bs.BlockMap[GetBlockHashString(data)]; !ok {
+		t.Errorf("PutBlock without a hash in the context did not hash the block")
+	}
+}
+
+func TestDecompressBlockMaxSize(t *testing.T) {
+	data := bytes.Repeat([]byte("surfstore "), 100)
+	compressed := &Block{BlockData: append([]byte(nil), data...), BlockSize: int32(len(data))}
+	if err := CompressBlock(compressed, Compression_GZIP); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		block   *Block
+		maxSize int
+		valid   bool
+	}{
+		{"no limit", &Block{BlockData: data, BlockSize: int32(len(data))}, 0, true},
+		{"at the limit", &Block{BlockData: data, BlockSize: int32(len(data))}, len(data), true},
+		{"over the limit", &Block{BlockData: data, BlockSize: int32(len(data))}, len(data) - 1, false},
+		// the claimed size is refused before decompressing
+		{"compressed over the limit", compressed, len(data) - 1, false},
+		{"data over the limit", &Block{BlockData: data, BlockSize: 1}, len(data) - 1, false},
+	}
+	for _, test := range tests {
+		if _, err := BlockHashOf(test.block, test.maxSize); (err == nil) != test.valid {
+			t.Errorf("%s: BlockHashOf error = %v, want valid %v", test.name, err, test.valid)
+		}
+	}
+}
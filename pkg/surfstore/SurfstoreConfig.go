@@ -0,0 +1,436 @@
+package surfstore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Every config setting can be overridden by an environment variable named
+// CONFIG_ENV_PREFIX followed by its upper cased YAML path joined with
+// underscores, e.g. SURFSTORE_TLS_CERT for tls.cert
+const CONFIG_ENV_PREFIX string = "SURFSTORE_"
+
+// TLSConfig names the certificate files of a server or client.
+type TLSConfig struct {
+	// CA verifies the servers (client only)
+	CA   string `yaml:"ca"`
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	// ClientCA makes the server require client certificates (server only)
+	ClientCA string `yaml:"client_ca"`
+}
+
+func (c *TLSConfig) enabled() bool {
+	return c.CA != "" || c.Cert != "" || c.Key != "" || c.ClientCA != ""
+}
+
+// TracingConfig enables OpenTelemetry tracing.
+type TracingConfig struct {
+	// Exporter is file:<path>, otlp or otlp:<host:port>, see StartTracing
+	Exporter string `yaml:"exporter"`
+}
+
+func (c *TracingConfig) validate() string {
+	if c.Exporter == "" {
+		return ""
+	}
+	if _, _, err := parseTraceExporter(c.Exporter); err != nil {
+		return fmt.Sprintf("tracing.exporter: %v", err)
+	}
+	return ""
+}
+
+// LogConfig configures the structured logs of an executable.
+type LogConfig struct {
+	// Debug logs everything, whatever the level
+	Debug bool `yaml:"debug"`
+	// Level is the least severe level logged: debug, info, warn or error
+	Level  string `yaml:"level"`
+	Format string `yaml:"format"`
+}
+
+// Logger creates the configured logger writing to w.
+func (c *LogConfig) Logger(w io.Writer) (*slog.Logger, error) {
+	level := c.Level
+	if c.Debug {
+		level = "debug"
+	}
+	return NewLogger(w, level, c.Format)
+}
+
+func (c *LogConfig) validate() string {
+	if _, err := c.Logger(ioutil.Discard); err != nil {
+		return fmt.Sprintf("log: %v", err)
+	}
+	return ""
+}
+
+// ServerConfig configures SurfstoreServerExec.
+type ServerConfig struct {
+	// Service is meta, block or both
+	Service string `yaml:"service"`
+	// Listen is the host:port to accept connections on
+	Listen string `yaml:"listen"`
+	// BlockStores are the addresses of the BlockStores the MetaStore hands
+	// out. Only one is supported.
+	BlockStores []string  `yaml:"block_stores"`
+	TLS         TLSConfig `yaml:"tls"`
+
+	Auth struct {
+		TokensFile string `yaml:"tokens_file"`
+		CertAuth   bool   `yaml:"cert_auth"`
+		CapKeyFile string `yaml:"cap_key_file"`
+		// Admins are the users allowed to query the audit log and rotate
+		// block keys
+		Admins []string `yaml:"admins"`
+	} `yaml:"auth"`
+
+	Storage struct {
+		// BlockDir stores blocks on disk instead of in memory
+		BlockDir      string        `yaml:"block_dir"`
+		BlockKeyFile  string        `yaml:"block_key_file"`
+		ScrubInterval time.Duration `yaml:"scrub_interval"`
+	} `yaml:"storage"`
+
+	Quota struct {
+		// Bytes is the quota of users not listed in File, 0 for no limit
+		Bytes int64 `yaml:"bytes"`
+		// File holds "user,bytes" lines with the quotas of single users
+		File string `yaml:"file"`
+		// UniqueBlocks counts distinct blocks instead of file sizes
+		UniqueBlocks bool `yaml:"unique_blocks"`
+	} `yaml:"quota"`
+
+	Limits struct {
+		// Rate is the RPCs per second each client can sustain, 0 for no limit
+		Rate float64 `yaml:"rate"`
+		// Burst is the RPCs a client can send at once after being idle
+		Burst int `yaml:"burst"`
+		// MaxBlockSize is the largest block the BlockStore accepts
+		MaxBlockSize int `yaml:"max_block_size"`
+		// MaxHashes is the most blocks a file can have
+		MaxHashes int `yaml:"max_hashes"`
+		// MaxFilenameLength is the longest filename in bytes
+		MaxFilenameLength int `yaml:"max_filename_length"`
+	} `yaml:"limits"`
+
+	Tombstones struct {
+		// Retention is how long deleted files are kept at least before they
+		// are purged, once every client synced their deletion (0 keeps them)
+		Retention time.Duration `yaml:"retention"`
+		// ClientExpiry is how long a client can stay away before deleted
+		// files are purged without waiting for it
+		ClientExpiry time.Duration `yaml:"client_expiry"`
+	} `yaml:"tombstones"`
+
+	Audit struct {
+		// LogFile records every update of the MetaStore
+		LogFile string `yaml:"log_file"`
+	} `yaml:"audit"`
+
+	Timeouts struct {
+		// Connection bounds the TLS and HTTP/2 handshake of new connections
+		Connection time.Duration `yaml:"connection"`
+		// ShutdownDelay is how long a stopping server keeps serving after
+		// reporting NOT_SERVING, for load balancers to stop routing to it
+		ShutdownDelay time.Duration `yaml:"shutdown_delay"`
+		// Drain bounds how long a stopping server waits for RPCs to finish
+		Drain time.Duration `yaml:"drain"`
+	} `yaml:"timeouts"`
+
+	Metrics struct {
+		// Listen is the host:port to serve Prometheus metrics on, if any
+		Listen string `yaml:"listen"`
+	} `yaml:"metrics"`
+
+	Tracing TracingConfig `yaml:"tracing"`
+
+	Health struct {
+		// CheckInterval is how often the storage health is checked
+		CheckInterval time.Duration `yaml:"check_interval"`
+		// Reflection serves the gRPC reflection service, e.g. for grpcurl
+		Reflection bool `yaml:"reflection"`
+	} `yaml:"health"`
+
+	Log LogConfig `yaml:"log"`
+}
+
+// NewServerConfig returns the defaults of the server.
+func NewServerConfig() *ServerConfig {
+	config := &ServerConfig{Listen: ":8080"}
+	config.Log.Level = "info"
+	config.Timeouts.Connection = 120 * time.Second
+	config.Timeouts.Drain = 30 * time.Second
+	config.Health.CheckInterval = DEFAULT_HEALTH_CHECK_INTERVAL
+	config.Tombstones.ClientExpiry = DEFAULT_CLIENT_EXPIRY
+	config.Limits.Burst = DEFAULT_RATE_LIMIT_BURST
+	config.Limits.MaxBlockSize = DEFAULT_MAX_BLOCK_SIZE
+	config.Limits.MaxHashes = DEFAULT_MAX_HASHES
+	config.Limits.MaxFilenameLength = DEFAULT_MAX_FILENAME_LENGTH
+	return config
+}
+
+// BlockStoreAddr returns the BlockStore the MetaStore hands out, if any. A
+// server that is both defaults to its own listen address.
+func (c *ServerConfig) BlockStoreAddr() string {
+	if len(c.BlockStores) == 0 {
+		if c.Service == "both" {
+			return c.Listen
+		}
+		return ""
+	}
+	return c.BlockStores[0]
+}
+
+// Validate checks the config for settings the server cannot start with.
+func (c *ServerConfig) Validate() error {
+	var errs []string
+	switch c.Service {
+	case "meta":
+		if len(c.BlockStores) == 0 {
+			errs = append(errs, "block_stores: the MetaStore needs a BlockStore address")
+		}
+	case "both":
+	case "block":
+	default:
+		errs = append(errs, fmt.Sprintf("service: %q is not meta, block or both", c.Service))
+	}
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		errs = append(errs, fmt.Sprintf("listen: %v", err))
+	}
+	if c.Metrics.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.Metrics.Listen); err != nil {
+			errs = append(errs, fmt.Sprintf("metrics.listen: %v", err))
+		}
+	}
+	if err := c.Tracing.validate(); err != "" {
+		errs = append(errs, err)
+	}
+	if err := c.Log.validate(); err != "" {
+		errs = append(errs, err)
+	}
+	if len(c.BlockStores) > 1 {
+		errs = append(errs, "block_stores: only one BlockStore is supported")
+	}
+	for _, addr := range c.BlockStores {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			errs = append(errs, fmt.Sprintf("block_stores: %v", err))
+		}
+	}
+	if c.TLS.enabled() && (c.TLS.Cert == "" || c.TLS.Key == "") {
+		errs = append(errs, "tls: cert and key are both required")
+	}
+	if c.TLS.CA != "" {
+		errs = append(errs, "tls.ca: only clients verify servers, use client_ca")
+	}
+	if c.Auth.CertAuth && c.TLS.ClientCA == "" {
+		errs = append(errs, "auth.cert_auth: needs tls.client_ca")
+	}
+	if c.Storage.BlockKeyFile != "" && c.Storage.BlockDir == "" {
+		errs = append(errs, "storage.block_key_file: needs storage.block_dir")
+	}
+	if c.Storage.ScrubInterval < 0 || c.Timeouts.Connection < 0 || c.Timeouts.Drain < 0 || c.Timeouts.ShutdownDelay < 0 ||
+		c.Tombstones.Retention < 0 || c.Tombstones.ClientExpiry < 0 {
+		errs = append(errs, "durations must not be negative")
+	}
+	if c.Quota.Bytes < 0 {
+		errs = append(errs, "quota.bytes: must not be negative")
+	}
+	if c.Limits.Rate < 0 || (c.Limits.Rate > 0 && c.Limits.Burst < 1) {
+		errs = append(errs, "limits: rate must not be negative and burst must be positive")
+	}
+	if c.Limits.MaxBlockSize < 0 || c.Limits.MaxHashes < 0 || c.Limits.MaxFilenameLength < 0 {
+		errs = append(errs, "limits: maximums must not be negative")
+	}
+	if c.Health.CheckInterval <= 0 {
+		errs = append(errs, "health.check_interval: must be positive")
+	}
+	return configErrors(errs)
+}
+
+// ClientConfig configures SurfstoreClientExec.
+type ClientConfig struct {
+	// MetaStore is the host:port of the MetaStore to sync with
+	MetaStore string    `yaml:"meta_store"`
+	BaseDir   string    `yaml:"base_dir"`
+	BlockSize int       `yaml:"block_size"`
+	Rehash    bool      `yaml:"rehash"`
+	TLS       TLSConfig `yaml:"tls"`
+	// Token authenticates the client; prefer setting it in the environment
+	Token string `yaml:"token"`
+
+	Encryption struct {
+		// Mode is convergent, random or empty for no block encryption
+		Mode           string `yaml:"mode"`
+		EncryptNames   bool   `yaml:"encrypt_names"`
+		PassphraseFile string `yaml:"passphrase_file"`
+		// SaltFile defaults to DEFAULT_ENCRYPTION_SALT_FILENAME in the base dir
+		SaltFile string `yaml:"salt_file"`
+	} `yaml:"encryption"`
+
+	// Compression is gzip, zstd, snappy or empty
+	Compression string `yaml:"compression"`
+
+	Timeouts struct {
+		// RPC bounds every call to the servers
+		RPC time.Duration `yaml:"rpc"`
+	} `yaml:"timeouts"`
+
+	Tracing TracingConfig `yaml:"tracing"`
+
+	Log LogConfig `yaml:"log"`
+}
+
+// NewClientConfig returns the defaults of the client.
+func NewClientConfig() *ClientConfig {
+	config := &ClientConfig{}
+	config.Log.Level = "warn"
+	config.Timeouts.RPC = DEFAULT_RPC_TIMEOUT
+	return config
+}
+
+// Validate checks the config for settings the client cannot sync with.
+func (c *ClientConfig) Validate() error {
+	var errs []string
+	if _, _, err := net.SplitHostPort(c.MetaStore); err != nil {
+		errs = append(errs, fmt.Sprintf("meta_store: %v", err))
+	}
+	if c.BaseDir == "" {
+		errs = append(errs, "base_dir: missing")
+	} else if info, err := os.Stat(c.BaseDir); err != nil || !info.IsDir() {
+		errs = append(errs, fmt.Sprintf("base_dir: %s is not a directory", c.BaseDir))
+	}
+	if c.BlockSize <= 0 {
+		errs = append(errs, "block_size: must be positive")
+	}
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		errs = append(errs, "tls: cert and key must be given together")
+	}
+	if c.TLS.ClientCA != "" {
+		errs = append(errs, "tls.client_ca: only servers verify clients, use ca")
+	}
+	if _, err := ParseEncryptionMode(c.Encryption.Mode); err != nil {
+		errs = append(errs, fmt.Sprintf("encryption.mode: %v", err))
+	}
+	if _, err := ParseCompression(c.Compression); err != nil {
+		errs = append(errs, fmt.Sprintf("compression: %v", err))
+	}
+	if c.Timeouts.RPC <= 0 {
+		errs = append(errs, "timeouts.rpc: must be positive")
+	}
+	if err := c.Tracing.validate(); err != "" {
+		errs = append(errs, err)
+	}
+	if err := c.Log.validate(); err != "" {
+		errs = append(errs, err)
+	}
+	return configErrors(errs)
+}
+
+func configErrors(errs []string) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return errors.New("invalid config:\n  " + strings.Join(errs, "\n  "))
+}
+
+// LoadConfig fills config, a *ServerConfig or *ClientConfig holding the
+// defaults, from the YAML file configFile, if not empty, and then from the
+// environment. Unknown settings in the file are errors.
+func LoadConfig(configFile string, config interface{}) error {
+	if configFile != "" {
+		data, err := ioutil.ReadFile(configFile)
+		if err != nil {
+			return err
+		}
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		// an empty file leaves the defaults
+		if err := decoder.Decode(config); err != nil && err != io.EOF {
+			return fmt.Errorf("%s: %v", configFile, err)
+		}
+	}
+	return applyConfigEnv(reflect.ValueOf(config).Elem(), CONFIG_ENV_PREFIX)
+}
+
+// applyConfigEnv overrides the fields of the config struct v with the
+// environment variables named after their YAML paths.
+func applyConfigEnv(v reflect.Value, prefix string) error {
+	for i := 0; i < v.NumField(); i++ {
+		field, fieldType := v.Field(i), v.Type().Field(i)
+		name := strings.Split(fieldType.Tag.Get("yaml"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		envName := prefix + strings.ToUpper(name)
+		if field.Kind() == reflect.Struct {
+			if err := applyConfigEnv(field, envName+"_"); err != nil {
+				return err
+			}
+			continue
+		}
+
+		value, ok := os.LookupEnv(envName)
+		if !ok {
+			continue
+		}
+		if err := setConfigValue(field, value); err != nil {
+			return fmt.Errorf("%s: %v", envName, err)
+		}
+	}
+	return nil
+}
+
+func setConfigValue(field reflect.Value, value string) error {
+	switch field.Interface().(type) {
+	case string:
+		field.SetString(value)
+	case bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(n))
+	case int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	case time.Duration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+	case []string:
+		field.Set(reflect.ValueOf(strings.Split(value, CONFIG_DELIMITER)))
+	default:
+		return fmt.Errorf("unsupported setting type %s", field.Type())
+	}
+	return nil
+}
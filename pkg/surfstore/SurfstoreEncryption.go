@@ -0,0 +1,335 @@
+package surfstore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"google.golang.org/protobuf/proto"
+)
+
+// EncryptionMode selects how a client encrypts blocks before uploading them.
+type EncryptionMode int
+
+const (
+	// ENCRYPT_NONE uploads blocks as they are
+	ENCRYPT_NONE EncryptionMode = iota
+	// ENCRYPT_CONVERGENT derives each block's nonce from its content under a
+	// key derived from the passphrase, so equal blocks encrypt equally and are
+	// still deduplicated by the BlockStore
+	ENCRYPT_CONVERGENT
+	// ENCRYPT_RANDOM_KEY encrypts each file with its own random key, wrapped
+	// with the passphrase key and stored in the file's metadata
+	ENCRYPT_RANDOM_KEY
+)
+
+// The passphrase is stretched with a random salt per user, kept in a salt file
+// that is copied to every client of the user along with the passphrase
+const ENCRYPTION_SALT_SIZE int = 16
+
+const ENCRYPTION_KEY_SIZE int = 32
+
+var errDecryption = errors.New("cannot decrypt, is the passphrase correct?")
+
+// ParseEncryptionMode parses the -encrypt flag of the client.
+func ParseEncryptionMode(mode string) (EncryptionMode, error) {
+	switch mode {
+	case "", "none":
+		return ENCRYPT_NONE, nil
+	case "convergent":
+		return ENCRYPT_CONVERGENT, nil
+	case "random":
+		return ENCRYPT_RANDOM_KEY, nil
+	}
+	return ENCRYPT_NONE, fmt.Errorf("unknown encryption mode %q, expected convergent or random", mode)
+}
+
+// ClientEncryption encrypts blocks and, optionally, file names before they
+// leave the client. Servers only ever see ciphertext and its hashes.
+type ClientEncryption struct {
+	Mode EncryptionMode
+	// EncryptNames also encrypts file names and symlink targets
+	EncryptNames bool
+
+	masterKey []byte
+}
+
+// NewClientEncryption derives the encryption keys from passphrase and salt.
+func NewClientEncryption(passphrase string, salt []byte, mode EncryptionMode, encryptNames bool) (*ClientEncryption, error) {
+	if passphrase == "" {
+		return nil, errors.New("encryption needs a passphrase")
+	}
+	if len(salt) < ENCRYPTION_SALT_SIZE {
+		return nil, fmt.Errorf("encryption needs a salt of at least %d bytes", ENCRYPTION_SALT_SIZE)
+	}
+	masterKey := argon2.IDKey([]byte(passphrase), salt, 1, 64*1024, 4, uint32(ENCRYPTION_KEY_SIZE))
+	return &ClientEncryption{Mode: mode, EncryptNames: encryptNames, masterKey: masterKey}, nil
+}
+
+// LoadEncryptionSalt reads the hex encoded salt in saltFile, creating a new
+// random salt if the file does not exist yet.
+func LoadEncryptionSalt(saltFile string) ([]byte, error) {
+	data, err := ioutil.ReadFile(saltFile)
+	if err == nil {
+		salt, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", saltFile, err)
+		}
+		return salt, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	salt := make([]byte, ENCRYPTION_SALT_SIZE)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return salt, ioutil.WriteFile(saltFile, []byte(hex.EncodeToString(salt)+"\n"), 0600)
+}
+
+// KeyID identifies the keys block hashes are computed with, without revealing
+// them. It is empty when blocks are not encrypted.
+func (e *ClientEncryption) KeyID() string {
+	if e == nil || e.Mode == ENCRYPT_NONE {
+		return ""
+	}
+	return fmt.Sprintf("%d:%x", e.Mode, subKey(e.masterKey, "id")[:8])
+}
+
+// subKey derives an independent key for one purpose from key.
+func subKey(key []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// deterministicCipher encrypts with AES-GCM using a nonce derived from the
+// plaintext, so encrypting the same plaintext twice gives the same ciphertext.
+type deterministicCipher struct {
+	aead     cipher.AEAD
+	nonceKey []byte
+}
+
+func newDeterministicCipher(key []byte) (*deterministicCipher, error) {
+	block, err := aes.NewCipher(subKey(key, "encrypt"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &deterministicCipher{aead: aead, nonceKey: subKey(key, "nonce")}, nil
+}
+
+// seal returns the nonce followed by the ciphertext of data. A nil cipher
+// leaves data unencrypted.
+func (c *deterministicCipher) seal(data []byte) []byte {
+	if c == nil {
+		return data
+	}
+	mac := hmac.New(sha256.New, c.nonceKey)
+	mac.Write(data)
+	nonce := mac.Sum(nil)[:c.aead.NonceSize()]
+	return c.aead.Seal(nonce, nonce, data, nil)
+}
+
+// open is the inverse of seal.
+func (c *deterministicCipher) open(data []byte) ([]byte, error) {
+	if c == nil {
+		return data, nil
+	}
+	if len(data) < c.aead.NonceSize() {
+		return nil, errDecryption
+	}
+	nonceSize := c.aead.NonceSize()
+	plain, err := c.aead.Open(nil, data[:nonceSize], data[nonceSize:], nil)
+	if err != nil {
+		return nil, errDecryption
+	}
+	return plain, nil
+}
+
+// assignFileKey gives a regular file the key its blocks are encrypted with in
+// random key mode, reusing the key of its indexed version so unchanged blocks
+// keep their hashes.
+func (e *ClientEncryption) assignFileKey(fileMetaData, indexed *FileMetaData) error {
+	if e == nil || e.Mode != ENCRYPT_RANDOM_KEY {
+		return nil
+	}
+	if len(indexed.GetEncryptedKey()) > 0 {
+		fileMetaData.EncryptedKey = indexed.GetEncryptedKey()
+		return nil
+	}
+
+	fileKey := make([]byte, ENCRYPTION_KEY_SIZE)
+	if _, err := rand.Read(fileKey); err != nil {
+		return err
+	}
+	wrapper, err := e.keyWrapper()
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, wrapper.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	fileMetaData.EncryptedKey = wrapper.Seal(nonce, nonce, fileKey, nil)
+	return nil
+}
+
+func (e *ClientEncryption) keyWrapper() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(subKey(e.masterKey, "wrap"))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// blockCipher returns the cipher for the blocks of fileMetaData, or nil if
+// blocks are not encrypted.
+func (e *ClientEncryption) blockCipher(fileMetaData *FileMetaData) (*deterministicCipher, error) {
+	if e == nil {
+		return nil, nil
+	}
+	switch e.Mode {
+	case ENCRYPT_CONVERGENT:
+		return newDeterministicCipher(subKey(e.masterKey, "block"))
+	case ENCRYPT_RANDOM_KEY:
+		wrapper, err := e.keyWrapper()
+		if err != nil {
+			return nil, err
+		}
+		wrapped := fileMetaData.GetEncryptedKey()
+		if len(wrapped) < wrapper.NonceSize() {
+			return nil, fmt.Errorf("%s has no encryption key", fileMetaData.GetFilename())
+		}
+		fileKey, err := wrapper.Open(nil, wrapped[:wrapper.NonceSize()], wrapped[wrapper.NonceSize():], nil)
+		if err != nil {
+			return nil, errDecryption
+		}
+		return newDeterministicCipher(fileKey)
+	}
+	return nil, nil
+}
+
+// nameCipher returns the cipher for file names, or nil if names are not
+// encrypted.
+func (e *ClientEncryption) nameCipher() (*deterministicCipher, error) {
+	if e == nil || !e.EncryptNames {
+		return nil, nil
+	}
+	return newDeterministicCipher(subKey(e.masterKey, "name"))
+}
+
+// sharedPrefix splits off the @shared/<owner> part of a shared file's name,
+// which the MetaStore needs to read.
+func sharedPrefix(filename string) (prefix, rest string) {
+	segments := strings.SplitN(filename, "/", 3)
+	if segments[0] != SHARED_DIR || len(segments) < 2 {
+		return "", filename
+	}
+	if len(segments) == 2 {
+		return filename, ""
+	}
+	return segments[0] + "/" + segments[1] + "/", segments[2]
+}
+
+// EncryptName encrypts each segment of a slash separated path on its own,
+// so the MetaStore can still tell which directory a file is in.
+func (e *ClientEncryption) EncryptName(filename string) (string, error) {
+	c, err := e.nameCipher()
+	if err != nil || c == nil {
+		return filename, err
+	}
+	prefix, rest := sharedPrefix(filename)
+	if rest == "" {
+		return filename, nil
+	}
+	segments := strings.Split(rest, "/")
+	for i, segment := range segments {
+		segments[i] = base64.RawURLEncoding.EncodeToString(c.seal([]byte(segment)))
+	}
+	return prefix + strings.Join(segments, "/"), nil
+}
+
+// DecryptName is the inverse of EncryptName. Segments that were not
+// encrypted with this client's passphrase are returned unchanged.
+func (e *ClientEncryption) DecryptName(filename string) (string, error) {
+	c, err := e.nameCipher()
+	if err != nil || c == nil {
+		return filename, err
+	}
+	prefix, rest := sharedPrefix(filename)
+	if rest == "" {
+		return filename, nil
+	}
+	segments := strings.Split(rest, "/")
+	for i, segment := range segments {
+		data, err := base64.RawURLEncoding.DecodeString(segment)
+		if err != nil {
+			continue
+		}
+		if plain, err := c.open(data); err == nil {
+			segments[i] = string(plain)
+		}
+	}
+	return prefix + strings.Join(segments, "/"), nil
+}
+
+// encryptFileMetaData returns a copy of fileMetaData with its name and link
+// target encrypted.
+func (e *ClientEncryption) encryptFileMetaData(fileMetaData *FileMetaData) (*FileMetaData, error) {
+	if e == nil || !e.EncryptNames {
+		return fileMetaData, nil
+	}
+	encrypted := proto.Clone(fileMetaData).(*FileMetaData)
+	var err error
+	if encrypted.Filename, err = e.EncryptName(fileMetaData.GetFilename()); err != nil {
+		return nil, err
+	}
+	if fileMetaData.GetLinkTarget() != "" {
+		c, err := e.nameCipher()
+		if err != nil {
+			return nil, err
+		}
+		encrypted.LinkTarget = base64.RawURLEncoding.EncodeToString(c.seal([]byte(fileMetaData.GetLinkTarget())))
+	}
+	return encrypted, nil
+}
+
+// decryptFileMetaData decrypts the name and link target of fileMetaData in
+// place.
+func (e *ClientEncryption) decryptFileMetaData(fileMetaData *FileMetaData) error {
+	if e == nil || !e.EncryptNames {
+		return nil
+	}
+	var err error
+	if fileMetaData.Filename, err = e.DecryptName(fileMetaData.GetFilename()); err != nil {
+		return err
+	}
+	if fileMetaData.GetLinkTarget() != "" {
+		c, err := e.nameCipher()
+		if err != nil {
+			return err
+		}
+		data, err := base64.RawURLEncoding.DecodeString(fileMetaData.GetLinkTarget())
+		if err != nil {
+			return nil
+		}
+		if target, err := c.open(data); err == nil {
+			fileMetaData.LinkTarget = string(target)
+		}
+	}
+	return nil
+}
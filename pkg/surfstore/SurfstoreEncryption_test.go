@@ -0,0 +1,222 @@
+package surfstore
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+var testEncryptionSalt = []byte("0123456789abcdef")
+
+func newTestEncryption(t *testing.T, passphrase string, mode EncryptionMode, encryptNames bool) *ClientEncryption {
+	t.Helper()
+	e, err := NewClientEncryption(passphrase, testEncryptionSalt, mode, encryptNames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestNewClientEncryption(t *testing.T) {
+	tests := []struct {
+		name       string
+		passphrase string
+		salt       []byte
+		valid      bool
+	}{
+		{"valid", "secret", testEncryptionSalt, true},
+		{"no passphrase", "", testEncryptionSalt, false},
+		{"no salt", "secret", nil, false},
+		{"short salt", "secret", testEncryptionSalt[:ENCRYPTION_SALT_SIZE-1], false},
+	}
+	for _, test := range tests {
+		_, err := NewClientEncryption(test.passphrase, test.salt, ENCRYPT_CONVERGENT, false)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: NewClientEncryption error = %v, want valid %v", test.name, err, test.valid)
+		}
+	}
+}
+
+func TestBlockCipherRoundTrip(t *testing.T) {
+	data := []byte("block contents")
+	tests := []struct {
+		name string
+		mode EncryptionMode
+		// sealing the same block of two files gives the same ciphertext
+		sameAcrossFiles bool
+	}{
+		{"none", ENCRYPT_NONE, true},
+		{"convergent", ENCRYPT_CONVERGENT, true},
+		{"random key", ENCRYPT_RANDOM_KEY, false},
+	}
+	for _, test := range tests {
+		e := newTestEncryption(t, "secret", test.mode, false)
+		fileA, fileB := &FileMetaData{Filename: "a"}, &FileMetaData{Filename: "b"}
+		if err := e.assignFileKey(fileA, &FileMetaData{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := e.assignFileKey(fileB, &FileMetaData{}); err != nil {
+			t.Fatal(err)
+		}
+		cipherA, err := e.blockCipher(fileA)
+		if err != nil {
+			t.Fatalf("%s: blockCipher: %v", test.name, err)
+		}
+		cipherB, err := e.blockCipher(fileB)
+		if err != nil {
+			t.Fatalf("%s: blockCipher: %v", test.name, err)
+		}
+
+		sealed := cipherA.seal(data)
+		if test.mode != ENCRYPT_NONE && bytes.Contains(sealed, data) {
+			t.Errorf("%s: sealed block contains the plaintext", test.name)
+		}
+		if !bytes.Equal(cipherA.seal(data), sealed) {
+			t.Errorf("%s: sealing the same block twice differs", test.name)
+		}
+		if got := bytes.Equal(cipherB.seal(data), sealed); got != test.sameAcrossFiles {
+			t.Errorf("%s: same ciphertext across files = %v, want %v", test.name, got, test.sameAcrossFiles)
+		}
+		opened, err := cipherA.open(sealed)
+		if err != nil || !bytes.Equal(opened, data) {
+			t.Errorf("%s: open = %q, %v, want %q", test.name, opened, err, data)
+		}
+
+		// the indexed key is reused so unchanged blocks keep their hashes
+		fileC := &FileMetaData{Filename: "a"}
+		if err := e.assignFileKey(fileC, fileA); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(fileC.GetEncryptedKey(), fileA.GetEncryptedKey()) {
+			t.Errorf("%s: assignFileKey did not reuse the indexed key", test.name)
+		}
+	}
+}
+
+func TestBlockCipherWrongPassphrase(t *testing.T) {
+	for _, mode := range []EncryptionMode{ENCRYPT_CONVERGENT, ENCRYPT_RANDOM_KEY} {
+		e := newTestEncryption(t, "secret", mode, false)
+		other := newTestEncryption(t, "other", mode, false)
+		fileMetaData := &FileMetaData{Filename: "a"}
+		if err := e.assignFileKey(fileMetaData, &FileMetaData{}); err != nil {
+			t.Fatal(err)
+		}
+		c, err := e.blockCipher(fileMetaData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sealed := c.seal([]byte("block contents"))
+
+		otherCipher, err := other.blockCipher(fileMetaData)
+		if err != nil {
+			continue
+		}
+		if _, err := otherCipher.open(sealed); err == nil {
+			t.Errorf("mode %d: block opened with another passphrase", mode)
+		}
+	}
+}
+
+func TestNameRoundTrip(t *testing.T) {
+	e := newTestEncryption(t, "secret", ENCRYPT_NONE, true)
+	other := newTestEncryption(t, "other", ENCRYPT_NONE, true)
+	tests := []struct {
+		name string
+		// prefix is left in the clear for the MetaStore
+		prefix string
+	}{
+		{"a.txt", ""},
+		{"dir/sub/a.txt", ""},
+		{SHARED_DIR + "/bob/a.txt", SHARED_DIR + "/bob/"},
+		{SHARED_DIR + "/bob/dir/a.txt", SHARED_DIR + "/bob/"},
+		{SHARED_DIR + "/bob", SHARED_DIR + "/bob"},
+	}
+	for _, test := range tests {
+		encrypted, err := e.EncryptName(test.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if encrypted[:len(test.prefix)] != test.prefix {
+			t.Errorf("EncryptName(%q) = %q, want prefix %q", test.name, encrypted, test.prefix)
+		}
+		if test.prefix != test.name && encrypted == test.name {
+			t.Errorf("EncryptName(%q) left the name in the clear", test.name)
+		}
+		if again, _ := e.EncryptName(test.name); again != encrypted {
+			t.Errorf("EncryptName(%q) is not deterministic", test.name)
+		}
+		if decrypted, err := e.DecryptName(encrypted); err != nil || decrypted != test.name {
+			t.Errorf("DecryptName(%q) = %q, %v, want %q", encrypted, decrypted, err, test.name)
+		}
+		if test.prefix != test.name {
+			if decrypted, _ := other.DecryptName(encrypted); decrypted == test.name {
+				t.Errorf("DecryptName(%q) with another passphrase = %q", encrypted, decrypted)
+			}
+		}
+	}
+}
+
+func TestFileMetaDataNameRoundTrip(t *testing.T) {
+	e := newTestEncryption(t, "secret", ENCRYPT_NONE, true)
+	fileMetaData := &FileMetaData{Filename: "dir/link", Version: 2, FileType: FileType_SYMLINK, LinkTarget: "../target"}
+	encrypted, err := e.encryptFileMetaData(fileMetaData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encrypted.Filename == fileMetaData.Filename || encrypted.LinkTarget == fileMetaData.LinkTarget {
+		t.Errorf("encryptFileMetaData = %v, want the name and target encrypted", encrypted)
+	}
+	if fileMetaData.Filename != "dir/link" || fileMetaData.LinkTarget != "../target" {
+		t.Errorf("encryptFileMetaData changed its argument to %v", fileMetaData)
+	}
+	if err := e.decryptFileMetaData(encrypted); err != nil {
+		t.Fatal(err)
+	}
+	if encrypted.Filename != "dir/link" || encrypted.LinkTarget != "../target" || encrypted.Version != 2 {
+		t.Errorf("decryptFileMetaData = %v, want %v", encrypted, fileMetaData)
+	}
+}
+
+func TestEncryptionKeyID(t *testing.T) {
+	otherSalt := []byte("fedcba9876543210")
+	base := newTestEncryption(t, "secret", ENCRYPT_CONVERGENT, false)
+	salted, err := NewClientEncryption("secret", otherSalt, ENCRYPT_CONVERGENT, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		e    *ClientEncryption
+		same bool
+	}{
+		{"same keys", newTestEncryption(t, "secret", ENCRYPT_CONVERGENT, true), true},
+		{"other passphrase", newTestEncryption(t, "other", ENCRYPT_CONVERGENT, false), false},
+		{"other salt", salted, false},
+		{"other mode", newTestEncryption(t, "secret", ENCRYPT_RANDOM_KEY, false), false},
+		{"names only", newTestEncryption(t, "secret", ENCRYPT_NONE, true), false},
+		{"no encryption", nil, false},
+	}
+	for _, test := range tests {
+		if got := test.e.KeyID() == base.KeyID(); got != test.same {
+			t.Errorf("%s: KeyID %q, same as %q = %v, want %v", test.name, test.e.KeyID(), base.KeyID(), got, test.same)
+		}
+	}
+	if id := newTestEncryption(t, "secret", ENCRYPT_NONE, true).KeyID(); id != "" {
+		t.Errorf("KeyID without block encryption = %q, want empty", id)
+	}
+}
+
+func TestLoadEncryptionSalt(t *testing.T) {
+	saltFile := filepath.Join(t.TempDir(), DEFAULT_ENCRYPTION_SALT_FILENAME)
+	salt, err := LoadEncryptionSalt(saltFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(salt) != ENCRYPTION_SALT_SIZE {
+		t.Errorf("new salt has %d bytes, want %d", len(salt), ENCRYPTION_SALT_SIZE)
+	}
+	again, err := LoadEncryptionSalt(saltFile)
+	if err != nil || !bytes.Equal(again, salt) {
+		t.Errorf("LoadEncryptionSalt = %x, %v, want the saved salt %x", again, err, salt)
+	}
+}
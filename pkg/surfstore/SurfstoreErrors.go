@@ -0,0 +1,104 @@
+package surfstore
+
+import (
+	"errors"
+	"path"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Errors returned by RPCClient, to be checked with errors.Is
+var (
+	ErrBlockNotFound    = errors.New("block not found")
+	ErrFileNotFound     = errors.New("file not found")
+	ErrFileExists       = errors.New("file exists")
+	ErrVersionConflict  = errors.New("version conflict")
+	ErrInvalidArgument  = errors.New("invalid argument")
+	ErrPermissionDenied = errors.New("permission denied")
+	ErrUnauthenticated  = errors.New("unauthenticated")
+	ErrQuotaExceeded    = errors.New("quota exceeded")
+	ErrRateLimited      = errors.New("rate limited")
+)
+
+// RPCError is a gRPC status error that matches one of the errors above with
+// errors.Is. status.Code still works on it.
+type RPCError struct {
+	Status *status.Status
+	// Version is the server's version of the file for ErrVersionConflict
+	Version int32
+
+	sentinel error
+}
+
+func (e *RPCError) Error() string {
+	return e.Status.Err().Error()
+}
+
+func (e *RPCError) Is(target error) bool {
+	return target == e.sentinel
+}
+
+func (e *RPCError) GRPCStatus() *status.Status {
+	return e.Status
+}
+
+// translateError turns a gRPC status error into an RPCError. notFound is the
+// error NotFound stands for in the RPC that returned err, nil for RPCs that
+// never return NotFound.
+func translateError(err error, notFound error) error {
+	st, ok := status.FromError(err)
+	if err == nil || !ok {
+		return err
+	}
+
+	rpcErr := &RPCError{Status: st}
+	switch st.Code() {
+	case codes.NotFound:
+		rpcErr.sentinel = notFound
+	case codes.AlreadyExists:
+		rpcErr.sentinel = ErrFileExists
+	case codes.FailedPrecondition:
+		for _, detail := range st.Details() {
+			if version, ok := detail.(*Version); ok {
+				rpcErr.sentinel = ErrVersionConflict
+				rpcErr.Version = version.Version
+			}
+		}
+	case codes.InvalidArgument:
+		rpcErr.sentinel = ErrInvalidArgument
+	case codes.PermissionDenied:
+		rpcErr.sentinel = ErrPermissionDenied
+	case codes.Unauthenticated:
+		rpcErr.sentinel = ErrUnauthenticated
+	case codes.ResourceExhausted:
+		rpcErr.sentinel = ErrQuotaExceeded
+		if isRateLimited(err) {
+			rpcErr.sentinel = ErrRateLimited
+		}
+	}
+	if rpcErr.sentinel == nil {
+		return err
+	}
+	return rpcErr
+}
+
+// versionConflictError is returned when an update or rename of filename was
+// based on an older version than the server's version.
+func versionConflictError(filename string, version int32) error {
+	st := status.Newf(codes.FailedPrecondition, "%s is already at version %d", filename, version)
+	if detailed, err := st.WithDetails(&Version{Version: version}); err == nil {
+		st = detailed
+	}
+	return st.Err()
+}
+
+// validFilename reports whether filename is a clean relative slash separated
+// path, which clients can safely create below their base dir.
+func validFilename(filename string) bool {
+	if filename == "" || strings.HasPrefix(filename, "/") || path.Clean(filename) != filename {
+		return false
+	}
+	return filename != "." && filename != ".." && !strings.HasPrefix(filename, "../")
+}
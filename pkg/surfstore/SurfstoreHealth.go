@@ -0,0 +1,65 @@
+package surfstore
+
+import (
+	"log/slog"
+	"time"
+
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+const DEFAULT_HEALTH_CHECK_INTERVAL time.Duration = 10 * time.Second
+
+// HEALTH_SERVICE_PREFIX starts the methods of the standard health service,
+// which load balancers call without credentials
+const HEALTH_SERVICE_PREFIX string = "/grpc.health.v1.Health/"
+
+// HealthChecker reports the health of the served stores through the standard
+// gRPC health service: per service under its full name, e.g.
+// surfstore.BlockStore, and for the server as a whole under "".
+type HealthChecker struct {
+	Server *health.Server
+	// BlockStore and MetaStore are the served stores, nil if not served
+	BlockStore *BlockStore
+	MetaStore  *MetaStore
+}
+
+// NewHealthChecker creates the health service for the given stores and
+// checks them once.
+func NewHealthChecker(blockStore *BlockStore, metaStore *MetaStore) *HealthChecker {
+	h := &HealthChecker{Server: health.NewServer(), BlockStore: blockStore, MetaStore: metaStore}
+	h.Check()
+	return h
+}
+
+// Check updates the status of every served store. The BlockStore is not
+// serving while its storage is failing, the MetaStore while its audit log
+// is, and the server is only serving if all its stores are.
+func (h *HealthChecker) Check() {
+	overall := healthpb.HealthCheckResponse_SERVING
+	if h.BlockStore != nil {
+		servingStatus := healthpb.HealthCheckResponse_SERVING
+		if err := h.BlockStore.CheckHealth(); err != nil {
+			slog.Error("BlockStore storage is unhealthy", "error", err)
+			servingStatus, overall = healthpb.HealthCheckResponse_NOT_SERVING, healthpb.HealthCheckResponse_NOT_SERVING
+		}
+		h.Server.SetServingStatus(BlockStore_ServiceDesc.ServiceName, servingStatus)
+	}
+	if h.MetaStore != nil {
+		servingStatus := healthpb.HealthCheckResponse_SERVING
+		if err := h.MetaStore.CheckHealth(); err != nil {
+			slog.Error("MetaStore audit log is unhealthy", "error", err)
+			servingStatus, overall = healthpb.HealthCheckResponse_NOT_SERVING, healthpb.HealthCheckResponse_NOT_SERVING
+		}
+		h.Server.SetServingStatus(MetaStore_ServiceDesc.ServiceName, servingStatus)
+	}
+	h.Server.SetServingStatus("", overall)
+}
+
+// Run checks the stores every interval. Once Server is shut down, every
+// status stays NOT_SERVING.
+func (h *HealthChecker) Run(interval time.Duration) {
+	for range time.Tick(interval) {
+		h.Check()
+	}
+}
@@ -3,10 +3,11 @@ package surfstore
 import (
 	"bufio"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
 	"fmt"
 	"io"
-	"log"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -30,41 +31,119 @@ func ConcatPath(baseDir, fileDir string) string {
 	return baseDir + "/" + fileDir
 }
 
+/* File Attribute Related */
+
+// PosixMode converts a FileMode to the POSIX permission bits stored in
+// FileMetaData, including the setuid, setgid and sticky bits.
+func PosixMode(fileMode os.FileMode) uint32 {
+	mode := uint32(fileMode.Perm())
+	if fileMode&os.ModeSetuid != 0 {
+		mode |= 04000
+	}
+	if fileMode&os.ModeSetgid != 0 {
+		mode |= 02000
+	}
+	if fileMode&os.ModeSticky != 0 {
+		mode |= 01000
+	}
+	return mode
+}
+
+// FileModeFromPosix is the inverse of PosixMode.
+func FileModeFromPosix(mode uint32) os.FileMode {
+	fileMode := os.FileMode(mode & 0777)
+	if mode&04000 != 0 {
+		fileMode |= os.ModeSetuid
+	}
+	if mode&02000 != 0 {
+		fileMode |= os.ModeSetgid
+	}
+	if mode&01000 != 0 {
+		fileMode |= os.ModeSticky
+	}
+	return fileMode
+}
+
 /*
 	Reading and Writing Local Metadata File Related
 */
 
+// File names and symlink targets are free-form, so the delimiters they
+// contain are escaped in the local metadata file
+var indexFieldEscaper = strings.NewReplacer("%", "%25", CONFIG_DELIMITER, "%2C", "\n", "%0A", "\r", "%0D")
+var indexFieldUnescaper = strings.NewReplacer("%25", "%", "%2C", CONFIG_DELIMITER, "%0A", "\n", "%0D", "\r")
+
 // NewFileMetaDataFromConfig returns a FileMetaData struct
 // associated with one line in the local metadata file.
+// Lines written before file attributes were tracked only have the first
+// three fields; their attributes are left zero. Lines written before fields
+// were escaped have no inode field and are read as they are.
 func NewFileMetaDataFromConfig(configString string) *FileMetaData {
 	configItems := strings.Split(configString, CONFIG_DELIMITER)
+	unescape := func(field string) string { return field }
+	if len(configItems) > INODE_INDEX {
+		unescape = indexFieldUnescaper.Replace
+	}
 
-	filename := configItems[FILENAME_INDEX]
+	filename := unescape(configItems[FILENAME_INDEX])
 	version, _ := strconv.Atoi(configItems[VERSION_INDEX])
 	blockHashList := strings.Split(configItems[HASH_LIST_INDEX], HASH_DELIMITER)
 
-	return &FileMetaData{
+	fileMetaData := &FileMetaData{
 		Filename:      filename,
 		Version:       int32(version),
 		BlockHashList: blockHashList[:len(blockHashList)-1],
 	}
+
+	if len(configItems) > LINK_TARGET_INDEX {
+		mode, _ := strconv.ParseUint(configItems[MODE_INDEX], 8, 32)
+		mtime, _ := strconv.ParseInt(configItems[MTIME_INDEX], 10, 64)
+		size, _ := strconv.ParseInt(configItems[SIZE_INDEX], 10, 64)
+		fileType, _ := strconv.Atoi(configItems[FILE_TYPE_INDEX])
+
+		fileMetaData.Mode = uint32(mode)
+		fileMetaData.Mtime = mtime
+		fileMetaData.Size = size
+		fileMetaData.FileType = FileType(fileType)
+		fileMetaData.LinkTarget = unescape(configItems[LINK_TARGET_INDEX])
+	}
+	if len(configItems) > ENCRYPTED_KEY_INDEX && configItems[ENCRYPTED_KEY_INDEX] != "" {
+		fileMetaData.EncryptedKey, _ = base64.StdEncoding.DecodeString(configItems[ENCRYPTED_KEY_INDEX])
+	}
+	if len(configItems) > REVISION_INDEX {
+		fileMetaData.Revision, _ = strconv.ParseInt(configItems[REVISION_INDEX], 10, 64)
+	}
+	// the index marks deleted files by the hash list [TOMBSTONE_HASH] only
+	fileMetaData.Deleted = isDeleted(fileMetaData)
+
+	return fileMetaData
 }
 
 // LoadMetaFromMetaFiles loads the local metadata file into a file meta map.
 // The key is the file's name and the value is the file's metadata.
 // You can use this function to load the index.txt file in this project.
 func LoadMetaFromMetaFile(baseDir string) (fileMetaMap map[string]*FileMetaData, e error) {
+	fileMetaMap, _, _, e = LoadLocalIndex(baseDir)
+	return fileMetaMap, e
+}
+
+// LoadLocalIndex loads the local metadata file like LoadMetaFromMetaFile,
+// and also returns the inode each file had when it was last hashed and the
+// versions of local changes the server rejected for good.
+func LoadLocalIndex(baseDir string) (fileMetaMap map[string]*FileMetaData, inodes map[string]uint64, rejected map[string]int32, e error) {
 	metaFilePath, _ := filepath.Abs(ConcatPath(baseDir, DEFAULT_META_FILENAME))
 
 	fileMetaMap = make(map[string]*FileMetaData)
+	inodes = make(map[string]uint64)
+	rejected = make(map[string]int32)
 
 	metaFileStats, e := os.Stat(metaFilePath)
 	if e != nil || metaFileStats.IsDir() {
-		return fileMetaMap, nil
+		return fileMetaMap, inodes, rejected, nil
 	}
 	metaFD, e := os.Open(metaFilePath)
 	if e != nil {
-		log.Fatal("Error When Opening Meta")
+		return nil, nil, nil, e
 	}
 	defer metaFD.Close()
 
@@ -73,7 +152,7 @@ func LoadMetaFromMetaFile(baseDir string) (fileMetaMap map[string]*FileMetaData,
 	for {
 		lineContent, isPrefix, e := metaReader.ReadLine()
 		if e != nil && e != io.EOF {
-			log.Fatal("Error During Reading Meta")
+			return nil, nil, nil, fmt.Errorf("reading %s: %w", metaFilePath, e)
 		}
 
 		leftOverContent += string(lineContent)
@@ -86,45 +165,120 @@ func LoadMetaFromMetaFile(baseDir string) (fileMetaMap map[string]*FileMetaData,
 		}
 
 		currFileMeta := NewFileMetaDataFromConfig(leftOverContent)
+		configItems := strings.Split(leftOverContent, CONFIG_DELIMITER)
+		if len(configItems) > INODE_INDEX {
+			inode, _ := strconv.ParseUint(configItems[INODE_INDEX], 10, 64)
+			inodes[currFileMeta.Filename] = inode
+		}
+		if len(configItems) > REJECTED_INDEX {
+			if version, _ := strconv.Atoi(configItems[REJECTED_INDEX]); version > 0 {
+				rejected[currFileMeta.Filename] = int32(version)
+			}
+		}
 
 		leftOverContent = ""
 		fileMetaMap[currFileMeta.Filename] = currFileMeta
 	}
 
-	return fileMetaMap, nil
+	return fileMetaMap, inodes, rejected, nil
 }
 
 // FileMetaDataToString converts a FileMetaData struct
-// to a string for writing back to local metadata file
+// to a string for writing back to local metadata file. The caller appends
+// the inode field, which marks the line as escaped.
 func FileMetaDataToString(fm *FileMetaData) (result string) {
-	result += fm.Filename + ","
+	result += indexFieldEscaper.Replace(fm.Filename) + ","
 	result += strconv.Itoa(int(fm.Version)) + ","
 
 	for _, blockHash := range fm.BlockHashList {
 		result += blockHash + " "
 	}
 
+	result += "," + strconv.FormatUint(uint64(fm.Mode), 8)
+	result += "," + strconv.FormatInt(fm.Mtime, 10)
+	result += "," + strconv.FormatInt(fm.Size, 10)
+	result += "," + strconv.Itoa(int(fm.FileType))
+	result += "," + indexFieldEscaper.Replace(fm.LinkTarget)
+
 	result += "\n"
 	return
 }
 
 // WriteMetaFile writes the file meta map back to local metadata file
 func WriteMetaFile(fileMetas map[string]*FileMetaData, baseDir string) error {
+	return WriteLocalIndex(fileMetas, nil, nil, baseDir)
+}
+
+// WriteLocalIndex writes the file meta map back to local metadata file along
+// with the inode each file had when it was last hashed. Files without an
+// inode are rehashed on the next sync. The version the server rejected for
+// good, if it is still the entry's version, follows the inode, the wrapped
+// key of files encrypted in random key mode follows the version, and the
+// server revision the entry was synced at comes last.
+func WriteLocalIndex(fileMetas map[string]*FileMetaData, inodes map[string]uint64, rejected map[string]int32, baseDir string) error {
 	outputMetaPath := ConcatPath(baseDir, DEFAULT_META_FILENAME)
 
 	outFD, err := os.Create(outputMetaPath)
 	if err != nil {
-		log.Fatal("Error During Meta Write Back")
+		return err
 	}
 
-	for _, fileMeta := range fileMetas {
-		_, err := outFD.WriteString(FileMetaDataToString(fileMeta))
+	for filename, fileMeta := range fileMetas {
+		line := strings.TrimSuffix(FileMetaDataToString(fileMeta), "\n")
+		line += CONFIG_DELIMITER + strconv.FormatUint(inodes[filename], 10)
+		rejectedVersion := rejected[filename]
+		if rejectedVersion != fileMeta.GetVersion() {
+			rejectedVersion = 0
+		}
+		line += CONFIG_DELIMITER + strconv.Itoa(int(rejectedVersion))
+		line += CONFIG_DELIMITER + base64.StdEncoding.EncodeToString(fileMeta.GetEncryptedKey())
+		line += CONFIG_DELIMITER + strconv.FormatInt(fileMeta.GetRevision(), 10) + "\n"
+		_, err := outFD.WriteString(line)
 		if err != nil {
-			log.Fatal("Error During Meta Write Back")
+			outFD.Close()
+			return fmt.Errorf("writing %s: %w", outputMetaPath, err)
 		}
 	}
 
-	return nil
+	return outFD.Close()
+}
+
+// LoadClientID returns the id the client syncing baseDir acknowledges
+// revisions under, creating it on first use.
+func LoadClientID(baseDir string) (string, error) {
+	idPath := ConcatPath(baseDir, DEFAULT_CLIENT_ID_FILENAME)
+	data, err := ioutil.ReadFile(idPath)
+	if err == nil && len(strings.TrimSpace(string(data))) > 0 {
+		return strings.TrimSpace(string(data)), nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	clientID := newRequestID() + newRequestID()
+	return clientID, ioutil.WriteFile(idPath, []byte(clientID+"\n"), 0644)
+}
+
+// LoadIndexKeyID reads the KeyID of the encryption the local index was
+// written with, empty if it was not encrypted.
+func LoadIndexKeyID(baseDir string) (string, error) {
+	data, err := ioutil.ReadFile(ConcatPath(baseDir, DEFAULT_KEY_ID_FILENAME))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return strings.TrimSpace(string(data)), err
+}
+
+// WriteIndexKeyID records the KeyID of the encryption the local index was
+// written with.
+func WriteIndexKeyID(baseDir string, keyID string) error {
+	keyIDPath := ConcatPath(baseDir, DEFAULT_KEY_ID_FILENAME)
+	if keyID == "" {
+		if err := os.Remove(keyIDPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return ioutil.WriteFile(keyIDPath, []byte(keyID+"\n"), 0644)
 }
 
 /*
@@ -0,0 +1,102 @@
+package surfstore
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+)
+
+func TestLocalIndexRoundTrip(t *testing.T) {
+	tests := []*FileMetaData{
+		{Filename: "plain.txt", Version: 1, BlockHashList: []string{"h1", "h2"}, Mode: 0644, Mtime: 1000, Size: 5},
+		{Filename: "a,b.txt", Version: 2, BlockHashList: []string{"h"}, Mode: 0600},
+		{Filename: "100%.txt", Version: 3, BlockHashList: []string{"h"}},
+		{Filename: "%2C.txt", Version: 1, BlockHashList: []string{"h"}},
+		{Filename: "line\nbreak\r.txt", Version: 1, BlockHashList: []string{"h"}},
+		{Filename: "dir", Version: 1, BlockHashList: []string{}, Mode: 0755, FileType: FileType_DIRECTORY},
+		{Filename: "link", Version: 1, BlockHashList: []string{}, FileType: FileType_SYMLINK, LinkTarget: "to,50%\nthere"},
+		{Filename: "deleted", Version: 4, BlockHashList: []string{TOMBSTONE_HASH}, Deleted: true},
+	}
+	fileMetaMap := make(map[string]*FileMetaData)
+	inodes := make(map[string]uint64)
+	for i, fileMetaData := range tests {
+		fileMetaMap[fileMetaData.Filename] = fileMetaData
+		inodes[fileMetaData.Filename] = uint64(i + 1)
+	}
+
+	baseDir := t.TempDir()
+	if err := WriteLocalIndex(fileMetaMap, inodes, nil, baseDir); err != nil {
+		t.Fatal(err)
+	}
+	gotFileMetaMap, gotInodes, _, err := LoadLocalIndex(baseDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gotFileMetaMap) != len(tests) {
+		t.Errorf("loaded %d entries, want %d", len(gotFileMetaMap), len(tests))
+	}
+	for _, want := range tests {
+		got := gotFileMetaMap[want.Filename]
+		if !proto.Equal(got, want) {
+			t.Errorf("loaded %v, want %v", got, want)
+		}
+		if gotInodes[want.Filename] != inodes[want.Filename] {
+			t.Errorf("%q has inode %d, want %d", want.Filename, gotInodes[want.Filename], inodes[want.Filename])
+		}
+	}
+}
+
+func TestLoadUnescapedLocalIndex(t *testing.T) {
+	// index.txt as written before fields were escaped, with and without the
+	// file attributes
+	index := "100%.txt,2,h1 h2 \n" +
+		"a%2Cb,1,h ,644,1000,5,0,\n" +
+		"link,1,,777,1000,0,1,50%25\n"
+	baseDir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(baseDir, DEFAULT_META_FILENAME), []byte(index), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fileMetaMap, err := LoadMetaFromMetaFile(baseDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []*FileMetaData{
+		{Filename: "100%.txt", Version: 2, BlockHashList: []string{"h1", "h2"}},
+		{Filename: "a%2Cb", Version: 1, BlockHashList: []string{"h"}, Mode: 0644, Mtime: 1000, Size: 5},
+		{Filename: "link", Version: 1, BlockHashList: []string{}, Mode: 0777, Mtime: 1000, FileType: FileType_SYMLINK, LinkTarget: "50%25"},
+	}
+	if len(fileMetaMap) != len(tests) {
+		t.Errorf("loaded %d entries, want %d", len(fileMetaMap), len(tests))
+	}
+	for _, want := range tests {
+		if got := fileMetaMap[want.Filename]; !proto.Equal(got, want) {
+			t.Errorf("loaded %v, want %v", got, want)
+		}
+	}
+}
+
+func TestLocalIndexRejectedVersions(t *testing.T) {
+	fileMetaMap := map[string]*FileMetaData{
+		"rejected": {Filename: "rejected", Version: 3, BlockHashList: []string{"h"}},
+		"changed":  {Filename: "changed", Version: 5, BlockHashList: []string{"h"}},
+		"synced":   {Filename: "synced", Version: 1, BlockHashList: []string{"h"}},
+	}
+	// a rejection only sticks while the entry still has the rejected version
+	rejected := map[string]int32{"rejected": 3, "changed": 4}
+
+	baseDir := t.TempDir()
+	if err := WriteLocalIndex(fileMetaMap, nil, rejected, baseDir); err != nil {
+		t.Fatal(err)
+	}
+	_, _, gotRejected, err := LoadLocalIndex(baseDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int32{"rejected": 3}; !reflect.DeepEqual(gotRejected, want) {
+		t.Errorf("loaded rejected versions %v, want %v", gotRejected, want)
+	}
+}
@@ -0,0 +1,168 @@
+package surfstore
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"strings"
+)
+
+// DEFAULT_IGNORE_PATTERNS are applied to every base directory before any
+// .surfignore file, so a .surfignore can still re-include them with "!".
+var DEFAULT_IGNORE_PATTERNS = []string{
+	".DS_Store",
+	"._*",
+	"Thumbs.db",
+	"desktop.ini",
+	"*.swp",
+	"*.swo",
+	"*~",
+	".#*",
+	"#*#",
+}
+
+// ignoreRule is a single parsed line of a .surfignore file.
+type ignoreRule struct {
+	base     string   // directory (relative to the base dir) holding the .surfignore
+	segments []string // pattern split on "/"
+	negate   bool     // pattern started with "!"
+	dirOnly  bool     // pattern ended with "/"
+}
+
+// IgnoreMatcher decides whether a path relative to the base directory should
+// be left out of syncing. Rules follow gitignore semantics: the last matching
+// rule wins, "!" re-includes, a trailing "/" only matches directories and a
+// pattern without a "/" matches at any depth below its .surfignore.
+type IgnoreMatcher struct {
+	rules []ignoreRule
+}
+
+func NewIgnoreMatcher() *IgnoreMatcher {
+	m := &IgnoreMatcher{}
+	for _, pattern := range DEFAULT_IGNORE_PATTERNS {
+		m.AddPattern("", pattern)
+	}
+	return m
+}
+
+// AddPattern parses one gitignore-style line relative to dir.
+func (m *IgnoreMatcher) AddPattern(dir, line string) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return
+	}
+
+	var rule ignoreRule
+	rule.base = dir
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, "\\") {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return
+	}
+
+	// A pattern with a slash anywhere but the end is anchored to its
+	// directory, otherwise it may match at any depth.
+	if strings.Contains(line, "/") {
+		line = strings.TrimPrefix(line, "/")
+	} else {
+		line = "**/" + line
+	}
+	rule.segments = strings.Split(line, "/")
+
+	m.rules = append(m.rules, rule)
+}
+
+// LoadIgnoreFile adds the rules of the .surfignore in dir (relative to
+// baseDir), if there is one.
+func (m *IgnoreMatcher) LoadIgnoreFile(baseDir, dir string) error {
+	ignorePath := ConcatPath(baseDir, DEFAULT_IGNORE_FILENAME)
+	if dir != "" {
+		ignorePath = ConcatPath(baseDir, ConcatPath(dir, DEFAULT_IGNORE_FILENAME))
+	}
+
+	f, err := os.Open(ignorePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		m.AddPattern(dir, scanner.Text())
+	}
+	return scanner.Err()
+}
+
+// Ignored reports whether relPath (slash separated, relative to the base
+// directory) is excluded by the loaded rules.
+func (m *IgnoreMatcher) Ignored(relPath string, isDir bool) bool {
+	if m == nil {
+		return false
+	}
+
+	ignored := false
+	for _, rule := range m.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		rest := relPath
+		if rule.base != "" {
+			if !strings.HasPrefix(relPath, rule.base+"/") {
+				continue
+			}
+			rest = relPath[len(rule.base)+1:]
+		}
+		if matchSegments(rule.segments, strings.Split(rest, "/")) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+// IgnoredPath is like Ignored but also reports a path as ignored when any of
+// its parent directories is, since their contents are never walked.
+func (m *IgnoreMatcher) IgnoredPath(relPath string) bool {
+	dirs := strings.Split(relPath, "/")
+	for i := 1; i < len(dirs); i++ {
+		if m.Ignored(strings.Join(dirs[:i], "/"), true) {
+			return true
+		}
+	}
+	return m.Ignored(relPath, false)
+}
+
+// matchSegments matches path segments against pattern segments where "**"
+// stands for zero or more whole segments.
+func matchSegments(pattern, segments []string) bool {
+	if len(pattern) == 0 {
+		return len(segments) == 0
+	}
+
+	if pattern[0] == "**" {
+		for i := 0; i <= len(segments); i++ {
+			if matchSegments(pattern[1:], segments[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(segments) == 0 {
+		return false
+	}
+	if matched, err := path.Match(pattern[0], segments[0]); err != nil || !matched {
+		return false
+	}
+	return matchSegments(pattern[1:], segments[1:])
+}
@@ -0,0 +1,69 @@
+package surfstore
+
+import "testing"
+
+func TestIgnoreMatcher(t *testing.T) {
+	tests := []struct {
+		name     string
+		dir      string
+		patterns []string
+		path     string
+		isDir    bool
+		ignored  bool
+	}{
+		{"default pattern", "", nil, "notes.txt.swp", false, true},
+		{"default pattern in subdir", "", nil, "a/b/.DS_Store", false, true},
+		{"plain file", "", nil, "notes.txt", false, false},
+		{"basename at any depth", "", []string{"*.log"}, "a/b/c.log", false, true},
+		{"anchored pattern", "", []string{"/build"}, "build", true, true},
+		{"anchored pattern below root", "", []string{"/build"}, "src/build", true, false},
+		{"leading **", "", []string{"**/cache"}, "a/b/cache", true, true},
+		{"middle **", "", []string{"a/**/z.txt"}, "a/z.txt", false, true},
+		{"middle ** several dirs", "", []string{"a/**/z.txt"}, "a/b/c/z.txt", false, true},
+		{"middle ** other dir", "", []string{"a/**/z.txt"}, "b/c/z.txt", false, false},
+		{"trailing **", "", []string{"tmp/**"}, "tmp/x/y", false, true},
+		{"dir only pattern on dir", "", []string{"out/"}, "out", true, true},
+		{"dir only pattern on file", "", []string{"out/"}, "out", false, false},
+		{"negation", "", []string{"*.log", "!keep.log"}, "keep.log", false, false},
+		{"negation of other file", "", []string{"*.log", "!keep.log"}, "drop.log", false, true},
+		{"last rule wins", "", []string{"!keep.log", "*.log"}, "keep.log", false, true},
+		{"negated default", "", []string{"!*.swp"}, "a.swp", false, false},
+		{"escaped !", "", []string{"\\!bang"}, "!bang", false, true},
+		{"comment", "", []string{"# *.txt"}, "a.txt", false, false},
+		{"nested .surfignore", "sub", []string{"*.txt"}, "sub/a.txt", false, true},
+		{"nested .surfignore outside its dir", "sub", []string{"*.txt"}, "a.txt", false, false},
+		{"nested anchored pattern", "sub", []string{"/x"}, "sub/x", false, true},
+		{"nested anchored pattern deeper", "sub", []string{"/x"}, "sub/y/x", false, false},
+	}
+	for _, test := range tests {
+		m := NewIgnoreMatcher()
+		for _, pattern := range test.patterns {
+			m.AddPattern(test.dir, pattern)
+		}
+		if got := m.Ignored(test.path, test.isDir); got != test.ignored {
+			t.Errorf("%s: Ignored(%q, %v) = %v, want %v", test.name, test.path, test.isDir, got, test.ignored)
+		}
+	}
+}
+
+func TestIgnoredPath(t *testing.T) {
+	m := NewIgnoreMatcher()
+	m.AddPattern("", "build/")
+	m.AddPattern("", "!build/keep")
+
+	tests := []struct {
+		path    string
+		ignored bool
+	}{
+		{"build/out.o", true},
+		// a file in an ignored directory is never seen, whatever its rules say
+		{"build/keep", true},
+		{"src/build.go", false},
+		{"src/main.go", false},
+	}
+	for _, test := range tests {
+		if got := m.IgnoredPath(test.path); got != test.ignored {
+			t.Errorf("IgnoredPath(%q) = %v, want %v", test.path, got, test.ignored)
+		}
+	}
+}
@@ -13,8 +13,35 @@ type MetaStoreInterface interface {
 	// Update a file's fileinfo entry
 	UpdateFile(ctx context.Context, fileMetaData *FileMetaData) (*Version, error)
 
+	// Atomically move a file's entry, with its version history, to a new name
+	RenameFile(ctx context.Context, renameRequest *RenameRequest) (*Version, error)
+
 	// Get the the BlockStore address
 	GetBlockStoreAddr(ctx context.Context, _ *emptypb.Empty) (*BlockStoreAddr, error)
+
+	// Give another user access to a folder
+	ShareFolder(ctx context.Context, share *Share) (*Success, error)
+
+	// Take back another user's access to a folder
+	RevokeShare(ctx context.Context, share *Share) (*Success, error)
+
+	// List the shares made by and with the caller
+	ListShares(ctx context.Context, _ *emptypb.Empty) (*Shares, error)
+
+	// Get a token allowing access to the given blocks on the BlockStore
+	GetBlockToken(ctx context.Context, blockTokenRequest *BlockTokenRequest) (*BlockToken, error)
+
+	// Record the block sizes confirmed by the BlockStore's receipts
+	ConfirmBlocks(ctx context.Context, blockReceipts *BlockReceipts) (*Success, error)
+
+	// Get the storage used by the caller and their quota
+	GetUsage(ctx context.Context, _ *emptypb.Empty) (*Usage, error)
+
+	// Get the audit log entries matching a query, for admins
+	QueryAuditLog(ctx context.Context, query *AuditQuery) (*AuditEntries, error)
+
+	// Acknowledge that a client synced every change up to a revision
+	AcknowledgeRevision(ctx context.Context, ack *Acknowledgement) (*Success, error)
 }
 
 type BlockStoreInterface interface {
@@ -30,14 +57,35 @@ type BlockStoreInterface interface {
 	HasBlocks(ctx context.Context, blockHashesIn *BlockHashes) (*BlockHashes, error)
 }
 
+type BlockStoreAdminInterface interface {
+	// Start rewrapping the stored blocks with the current master key
+	RotateBlockKeys(ctx context.Context, _ *emptypb.Empty) (*RotationStatus, error)
+
+	// Get the progress of the running or last rotation
+	GetRotationStatus(ctx context.Context, _ *emptypb.Empty) (*RotationStatus, error)
+}
+
 type ClientInterface interface {
 	// MetaStore
 	GetFileInfoMap(serverFileInfoMap *map[string]*FileMetaData) error
 	UpdateFile(fileMetaData *FileMetaData, latestVersion *int32) error
+	RenameFile(oldFilename string, newFileMetaData *FileMetaData, version int32, latestVersion *int32) error
 	GetBlockStoreAddr(blockStoreAddr *string) error
+	ShareFolder(share *Share, succ *bool) error
+	RevokeShare(share *Share, succ *bool) error
+	ListShares(shares *[]*Share) error
+	GetBlockToken(readHashes, writeHashes []string, file *FileMetaData, blockSizes []int32, blockToken *string) error
+	ConfirmBlocks(receipts []string) error
+	GetUsage(usage *Usage) error
+	QueryAuditLog(query *AuditQuery, entries *[]*AuditEntry) error
+	AcknowledgeRevision(clientID string, revision int64) error
 
 	// BlockStore
 	GetBlock(blockHash string, blockStoreAddr string, block *Block) error
 	PutBlock(block *Block, blockStoreAddr string, succ *bool) error
 	HasBlocks(blockHashesIn []string, blockStoreAddr string, blockHashesOut *[]string) error
+
+	// BlockStoreAdmin
+	RotateBlockKeys(blockStoreAddr string, rotationStatus *RotationStatus) error
+	GetRotationStatus(blockStoreAddr string, rotationStatus *RotationStatus) error
 }
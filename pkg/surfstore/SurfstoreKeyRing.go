@@ -0,0 +1,123 @@
+package surfstore
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+var errUnknownKeyID = errors.New("unknown key id")
+
+// KeyRing holds the master keys that encrypt blocks at rest, by key id. New
+// blocks use the current key; older keys are kept to read blocks written
+// before a rotation.
+type KeyRing struct {
+	mu        sync.RWMutex
+	keys      map[string][]byte
+	currentID string
+}
+
+// LoadKeyRing reads a key file of id,hexkey lines. The last key in the file
+// is the current one.
+func LoadKeyRing(keyFile string) (*KeyRing, error) {
+	keyRing := &KeyRing{}
+	if err := keyRing.Reload(keyFile); err != nil {
+		return nil, err
+	}
+	return keyRing, nil
+}
+
+// Reload replaces the keys with those in keyFile, e.g. after a new current
+// key was appended to it.
+func (k *KeyRing) Reload(keyFile string) error {
+	f, err := os.Open(keyFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	keys := make(map[string][]byte)
+	currentID := ""
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		items := strings.SplitN(line, CONFIG_DELIMITER, 2)
+		if len(items) != 2 || items[0] == "" || len(items[0]) > 255 {
+			return fmt.Errorf("%s:%d: expected id,hexkey", keyFile, lineNum)
+		}
+		key, err := hex.DecodeString(items[1])
+		if err != nil || len(key) != 32 {
+			return fmt.Errorf("%s:%d: key must be 32 hex encoded bytes", keyFile, lineNum)
+		}
+		keys[items[0]] = key
+		currentID = items[0]
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if currentID == "" {
+		return fmt.Errorf("%s: no keys", keyFile)
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys, k.currentID = keys, currentID
+	return nil
+}
+
+// CurrentID returns the id of the key new blocks are encrypted with.
+func (k *KeyRing) CurrentID() string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.currentID
+}
+
+func (k *KeyRing) aead(keyID string) (cipher.AEAD, error) {
+	k.mu.RLock()
+	key, ok := k.keys[keyID]
+	k.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w %q", errUnknownKeyID, keyID)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// wrapKey encrypts a data key with the master key keyID. The result is the
+// nonce followed by the ciphertext.
+func (k *KeyRing) wrapKey(keyID string, dataKey, additionalData []byte) ([]byte, error) {
+	aead, err := k.aead(keyID)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, dataKey, additionalData), nil
+}
+
+// unwrapKey is the inverse of wrapKey.
+func (k *KeyRing) unwrapKey(keyID string, wrapped, additionalData []byte) ([]byte, error) {
+	aead, err := k.aead(keyID)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, errors.New("wrapped key too short")
+	}
+	return aead.Open(nil, wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():], additionalData)
+}
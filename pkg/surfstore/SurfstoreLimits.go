@@ -0,0 +1,152 @@
+package surfstore
+
+import (
+	context "context"
+	"crypto/sha256"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Default limits of servers. Blocks above 4 MiB also need a larger gRPC
+// message size, see MaxMessageSize.
+const DEFAULT_RATE_LIMIT_BURST int = 100
+const DEFAULT_MAX_BLOCK_SIZE int = 4 << 20
+const DEFAULT_MAX_HASHES int = 50000
+const DEFAULT_MAX_FILENAME_LENGTH int = 4096
+
+// MESSAGE_OVERHEAD is room for the fields of a message besides its block
+// data or hash list
+const MESSAGE_OVERHEAD int = 64 << 10
+
+// MaxMessageSize returns the largest message a server must accept to take
+// blocks of up to maxBlockSize bytes and files of up to maxHashes blocks,
+// at least the gRPC default of 4 MiB.
+func MaxMessageSize(maxBlockSize, maxHashes int) int {
+	size := 4 << 20
+	if maxBlockSize+MESSAGE_OVERHEAD > size {
+		size = maxBlockSize + MESSAGE_OVERHEAD
+	}
+	// each hash takes its 64 hex digits plus a tag and length byte
+	if maxHashes*(2*sha256.Size+2)+MESSAGE_OVERHEAD > size {
+		size = maxHashes*(2*sha256.Size+2) + MESSAGE_OVERHEAD
+	}
+	return size
+}
+
+// RATE_LIMIT_PRUNE_INTERVAL is how often the buckets of clients that stopped
+// sending RPCs are dropped
+const RATE_LIMIT_PRUNE_INTERVAL time.Duration = time.Minute
+
+// RATE_LIMIT_RETRIES is how often clients retry a rate limited RPC, waiting
+// twice as long each time starting at RATE_LIMIT_BACKOFF
+const RATE_LIMIT_RETRIES int = 5
+const RATE_LIMIT_BACKOFF time.Duration = 100 * time.Millisecond
+
+// RateLimiter limits the RPCs of each client with a token bucket. Clients
+// are told apart by their user if the server authenticates them, and by
+// their IP address otherwise.
+type RateLimiter struct {
+	// Rate is the RPCs per second each client can sustain
+	Rate float64
+	// Burst is the RPCs a client can send at once after being idle
+	Burst int
+
+	mu        sync.Mutex
+	buckets   map[string]*rate.Limiter
+	lastPrune time.Time
+}
+
+// NewRateLimiter creates a RateLimiter allowing each client rps RPCs per
+// second with bursts of up to burst RPCs.
+func NewRateLimiter(rps float64, burst int) *RateLimiter {
+	return &RateLimiter{Rate: rps, Burst: burst, buckets: make(map[string]*rate.Limiter), lastPrune: time.Now()}
+}
+
+// Allow takes a token from the bucket of client, reporting false if there is
+// none left.
+func (r *RateLimiter) Allow(client string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(r.lastPrune) > RATE_LIMIT_PRUNE_INTERVAL {
+		// a full bucket is no different from a new one
+		for key, bucket := range r.buckets {
+			if bucket.TokensAt(now) >= float64(r.Burst) {
+				delete(r.buckets, key)
+			}
+		}
+		r.lastPrune = now
+	}
+
+	bucket, exists := r.buckets[client]
+	if !exists {
+		bucket = rate.NewLimiter(rate.Limit(r.Rate), r.Burst)
+		r.buckets[client] = bucket
+	}
+	return bucket.AllowN(now, 1)
+}
+
+// UnaryInterceptor rejects RPCs of clients over their rate with
+// ResourceExhausted. It must come after the authentication interceptor to
+// tell users apart. Health checks are not limited.
+func (r *RateLimiter) UnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if strings.HasPrefix(info.FullMethod, HEALTH_SERVICE_PREFIX) {
+		return handler(ctx, req)
+	}
+	client := UserFromContext(ctx)
+	if client == "" {
+		if p, ok := peer.FromContext(ctx); ok {
+			client = p.Addr.String()
+			if host, _, err := net.SplitHostPort(client); err == nil {
+				client = host
+			}
+		}
+	}
+	if !r.Allow(client) {
+		loggerFromContext(ctx).Warn("Rate limited RPC", "client", client)
+		return nil, status.Error(codes.ResourceExhausted, "rate limit exceeded")
+	}
+	return handler(ctx, req)
+}
+
+// retryRateLimitedUnaryClientInterceptor retries RPCs rejected by the
+// server's rate limit, backing off exponentially.
+func retryRateLimitedUnaryClientInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	backoff := RATE_LIMIT_BACKOFF
+	for retry := 0; ; retry++ {
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		if retry == RATE_LIMIT_RETRIES || !isRateLimited(err) {
+			return err
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+		backoff *= 2
+	}
+}
+
+// isRateLimited reports whether err is the server's rate limit, not a quota,
+// which also fails with ResourceExhausted but details the usage.
+func isRateLimited(err error) bool {
+	st, ok := status.FromError(err)
+	if err == nil || !ok || st.Code() != codes.ResourceExhausted {
+		return false
+	}
+	for _, detail := range st.Details() {
+		if _, ok := detail.(*Usage); ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,163 @@
+package surfstore
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	tests := []struct {
+		name    string
+		rate    float64
+		burst   int
+		clients []string
+		// allowed holds the result of each call, in order
+		allowed []bool
+	}{
+		{"within burst", 0.001, 3, []string{"a", "a", "a"}, []bool{true, true, true}},
+		{"over burst", 0.001, 2, []string{"a", "a", "a", "a"}, []bool{true, true, false, false}},
+		{"clients apart", 0.001, 1, []string{"a", "b", "a", "b"}, []bool{true, true, false, false}},
+		{"fast rate refills", 1e9, 1, []string{"a", "a", "a"}, []bool{true, true, true}},
+	}
+	for _, test := range tests {
+		r := NewRateLimiter(test.rate, test.burst)
+		for i, client := range test.clients {
+			if got := r.Allow(client); got != test.allowed[i] {
+				t.Errorf("%s: call %d by %s allowed = %v, want %v", test.name, i, client, got, test.allowed[i])
+			}
+		}
+	}
+}
+
+func TestRateLimiterInterceptor(t *testing.T) {
+	peerContext := func(addr string) context.Context {
+		tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return peer.NewContext(context.Background(), &peer.Peer{Addr: tcpAddr})
+	}
+	tests := []struct {
+		name   string
+		ctx    context.Context
+		method string
+		code   codes.Code
+	}{
+		{"first rpc of a user", userContext("alice"), "/surfstore.MetaStore/GetFileInfoMap", codes.OK},
+		{"second rpc of a user", userContext("alice"), "/surfstore.MetaStore/GetFileInfoMap", codes.ResourceExhausted},
+		{"other user", userContext("bob"), "/surfstore.BlockStore/PutBlock", codes.OK},
+		{"health checks", userContext("alice"), HEALTH_SERVICE_PREFIX + "Check", codes.OK},
+		{"first rpc of an address", peerContext("10.0.0.1:1234"), "/surfstore.MetaStore/GetFileInfoMap", codes.OK},
+		{"same address, other port", peerContext("10.0.0.1:5678"), "/surfstore.MetaStore/GetFileInfoMap", codes.ResourceExhausted},
+		{"other address", peerContext("10.0.0.2:1234"), "/surfstore.MetaStore/GetFileInfoMap", codes.OK},
+	}
+	r := NewRateLimiter(0.001, 1)
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) { return &Success{Flag: true}, nil }
+	for _, test := range tests {
+		info := &grpc.UnaryServerInfo{FullMethod: test.method}
+		_, err := r.UnaryInterceptor(test.ctx, nil, info, handler)
+		if status.Code(err) != test.code {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.code)
+		}
+		if test.code == codes.ResourceExhausted && !isRateLimited(err) {
+			t.Errorf("%s: isRateLimited(%v) = false", test.name, err)
+		}
+	}
+}
+
+func TestRateLimitedErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		err         error
+		rateLimited bool
+		sentinel    error
+	}{
+		{"rate limit", status.Error(codes.ResourceExhausted, "rate limit exceeded"), true, ErrRateLimited},
+		{"quota", quotaExceededError("alice", &Usage{LogicalBytes: 11, QuotaBytes: 10}, 11, 10), false, ErrQuotaExceeded},
+		{"other code", status.Error(codes.Unavailable, "down"), false, nil},
+		{"no status", errors.New("plain"), false, nil},
+		{"no error", nil, false, nil},
+	}
+	for _, test := range tests {
+		if got := isRateLimited(test.err); got != test.rateLimited {
+			t.Errorf("%s: isRateLimited = %v, want %v", test.name, got, test.rateLimited)
+		}
+		if test.sentinel != nil && !errors.Is(translateError(test.err, nil), test.sentinel) {
+			t.Errorf("%s: translateError = %v, want %v", test.name, translateError(test.err, nil), test.sentinel)
+		}
+	}
+}
+
+func TestRetryRateLimited(t *testing.T) {
+	tests := []struct {
+		name string
+		// failures is how often the server refuses the RPC before it succeeds
+		failures int
+		err      error
+		calls    int
+	}{
+		{"success", 0, nil, 1},
+		{"rate limited once", 1, status.Error(codes.ResourceExhausted, "rate limit exceeded"), 2},
+		{"over quota", 100, quotaExceededError("alice", &Usage{}, 11, 10), 1},
+		{"other error", 100, status.Error(codes.NotFound, "missing"), 1},
+	}
+	for _, test := range tests {
+		calls := 0
+		invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+			calls++
+			if calls <= test.failures {
+				return test.err
+			}
+			return nil
+		}
+		err := retryRateLimitedUnaryClientInterceptor(context.Background(), "/surfstore.MetaStore/GetFileInfoMap", nil, nil, nil, invoker)
+		wantErr := test.err
+		if test.failures < test.calls {
+			wantErr = nil
+		}
+		if status.Code(err) != status.Code(wantErr) || calls != test.calls {
+			t.Errorf("%s: got %v after %d calls, want %v after %d", test.name, err, calls, wantErr, test.calls)
+		}
+	}
+}
+
+func TestMetaStoreLimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		filename string
+		hashes   int
+		code     codes.Code
+	}{
+		{"within limits", "a", 3, codes.OK},
+		{"longest filename", strings.Repeat("a", 8), 1, codes.OK},
+		{"filename too long", strings.Repeat("a", 9), 1, codes.InvalidArgument},
+		{"too many blocks", "a", 4, codes.InvalidArgument},
+	}
+	for _, test := range tests {
+		m := NewMetaStore("")
+		m.MaxFilenameLength = 8
+		m.MaxHashes = 3
+		file := &FileMetaData{Filename: test.filename, Version: 1}
+		var sizes []int32
+		for i := 0; i < test.hashes; i++ {
+			file.BlockHashList = append(file.BlockHashList, "h")
+			sizes = append(sizes, 1)
+		}
+		// GetBlockToken refuses updates over the limits before their blocks
+		// are uploaded
+		if _, err := m.GetBlockToken(userContext("alice"), &BlockTokenRequest{File: file, BlockSizes: sizes}); status.Code(err) != test.code {
+			t.Errorf("%s: GetBlockToken got %v, want %v", test.name, err, test.code)
+		}
+		if _, err := m.UpdateFile(userContext("alice"), file); status.Code(err) != test.code {
+			t.Errorf("%s: UpdateFile got %v, want %v", test.name, err, test.code)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package surfstore
+
+import (
+	context "context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// REQUEST_ID_METADATA_KEY carries the id that ties the log lines of a client
+// RPC to those of the server handling it
+const REQUEST_ID_METADATA_KEY string = "x-request-id"
+
+// Log formats
+const (
+	LOG_FORMAT_TEXT string = "text"
+	LOG_FORMAT_JSON string = "json"
+)
+
+type loggerKey struct{}
+
+// NewLogger creates a logger writing lines of at least level to w in the
+// given format, text or json.
+func NewLogger(w io.Writer, level, format string) (*slog.Logger, error) {
+	var logLevel slog.Level
+	if err := logLevel.UnmarshalText([]byte(level)); err != nil {
+		return nil, err
+	}
+	opts := &slog.HandlerOptions{Level: logLevel}
+	switch format {
+	case "", LOG_FORMAT_TEXT:
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case LOG_FORMAT_JSON:
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q, expected text or json", format)
+}
+
+// loggerFromContext returns the logger of the RPC handled in ctx, which
+// records its request id, or the default logger.
+func loggerFromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+func newRequestID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// requestIDFromContext returns the request id a client sent with an RPC.
+func requestIDFromContext(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if ids := md.Get(REQUEST_ID_METADATA_KEY); len(ids) > 0 && len(ids[0]) <= 64 {
+			return ids[0]
+		}
+	}
+	return ""
+}
+
+// LoggingUnaryInterceptor gives every RPC a logger recording its request id,
+// taken from the client or generated, and logs the outcome of the RPC.
+// Failures caused by the server are logged as errors, all others at debug
+// level.
+func LoggingUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	requestID := requestIDFromContext(ctx)
+	if requestID == "" {
+		requestID = newRequestID()
+	}
+	grpc.SetHeader(ctx, metadata.Pairs(REQUEST_ID_METADATA_KEY, requestID))
+	logger := slog.Default().With("request_id", requestID, "method", info.FullMethod)
+	ctx = context.WithValue(ctx, loggerKey{}, logger)
+
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	code := status.Code(err)
+	attrs := []any{"code", code.String(), "duration", time.Since(start)}
+	switch code {
+	case codes.Internal, codes.Unknown, codes.DataLoss:
+		logger.Error("RPC failed", append(attrs, "error", err)...)
+	default:
+		if err != nil {
+			attrs = append(attrs, "error", err)
+		}
+		logger.Debug("RPC handled", attrs...)
+	}
+	return resp, err
+}
+
+// requestIDUnaryClientInterceptor sends a new request id with every RPC and
+// logs the RPC with it.
+func requestIDUnaryClientInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	requestID := newRequestID()
+	ctx = metadata.AppendToOutgoingContext(ctx, REQUEST_ID_METADATA_KEY, requestID)
+
+	start := time.Now()
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	attrs := []any{"request_id", requestID, "method", method, "duration", time.Since(start)}
+	if err != nil {
+		attrs = append(attrs, "error", err)
+	}
+	slog.Debug("RPC sent", attrs...)
+	return err
+}
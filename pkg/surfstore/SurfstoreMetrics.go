@@ -0,0 +1,146 @@
+package surfstore
+
+import (
+	context "context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+const METRICS_NAMESPACE string = "surfstore"
+
+// Metrics collects the Prometheus metrics of a server: the RPCs it handled
+// and the state of the stores it serves.
+type Metrics struct {
+	Registry    *prometheus.Registry
+	rpcs        *prometheus.CounterVec
+	rpcDuration *prometheus.HistogramVec
+}
+
+// NewMetrics creates a registry with the RPC metrics and the Go runtime and
+// process metrics.
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		Registry: prometheus.NewRegistry(),
+		rpcs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "rpcs_total",
+			Help:      "RPCs handled, by method and status code.",
+		}, []string{"method", "code"}),
+		rpcDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "rpc_duration_seconds",
+			Help:      "Time taken to handle RPCs, by method.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method"}),
+	}
+	m.Registry.MustRegister(m.rpcs, m.rpcDuration,
+		prometheus.NewGoCollector(), prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+	return m
+}
+
+// UnaryInterceptor counts and times every RPC. It should come first so
+// rejected RPCs are counted too.
+func (m *Metrics) UnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	m.rpcDuration.WithLabelValues(info.FullMethod).Observe(time.Since(start).Seconds())
+	m.rpcs.WithLabelValues(info.FullMethod, status.Code(err).String()).Inc()
+	return resp, err
+}
+
+// RegisterBlockStore exports the block count, stored bytes and deduplication
+// of blockStore, read on every scrape.
+func (m *Metrics) RegisterBlockStore(blockStore *BlockStore) {
+	m.Registry.MustRegister(&blockStoreCollector{blockStore})
+}
+
+// RegisterMetaStore exports the file and tombstone counts and the version
+// conflicts of metaStore, read on every scrape.
+func (m *Metrics) RegisterMetaStore(metaStore *MetaStore) {
+	m.Registry.MustRegister(&metaStoreCollector{metaStore})
+}
+
+// Serve serves the metrics at /metrics on addr.
+func (m *Metrics) Serve(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(m.Registry, promhttp.HandlerOpts{}))
+	return http.ListenAndServe(addr, mux)
+}
+
+var (
+	blocksDesc = prometheus.NewDesc(METRICS_NAMESPACE+"_blocks",
+		"Blocks stored in the BlockStore.", nil, nil)
+	blockBytesDesc = prometheus.NewDesc(METRICS_NAMESPACE+"_block_bytes",
+		"Bytes stored in the BlockStore, after compression.", nil, nil)
+	blockPutsDesc = prometheus.NewDesc(METRICS_NAMESPACE+"_block_puts_total",
+		"Blocks put into the BlockStore.", nil, nil)
+	blockDuplicatePutsDesc = prometheus.NewDesc(METRICS_NAMESPACE+"_block_duplicate_puts_total",
+		"Blocks put into the BlockStore that were already stored.", nil, nil)
+	blockDedupRatioDesc = prometheus.NewDesc(METRICS_NAMESPACE+"_block_dedup_ratio",
+		"Fraction of the blocks put into the BlockStore that were already stored.", nil, nil)
+	filesDesc = prometheus.NewDesc(METRICS_NAMESPACE+"_files",
+		"Files in the MetaStore that are not deleted, of all users.", nil, nil)
+	tombstonesDesc = prometheus.NewDesc(METRICS_NAMESPACE+"_tombstones",
+		"Deleted files kept in the MetaStore until every client saw the deletion, of all users.", nil, nil)
+	tombstonesPurgedDesc = prometheus.NewDesc(METRICS_NAMESPACE+"_tombstones_purged_total",
+		"Tombstones purged from the MetaStore.", nil, nil)
+	conflictsDesc = prometheus.NewDesc(METRICS_NAMESPACE+"_update_conflicts_total",
+		"Updates and renames rejected by the MetaStore for being based on an old version.", nil, nil)
+)
+
+type blockStoreCollector struct {
+	blockStore *BlockStore
+}
+
+func (c *blockStoreCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- blocksDesc
+	ch <- blockBytesDesc
+	ch <- blockPutsDesc
+	ch <- blockDuplicatePutsDesc
+	ch <- blockDedupRatioDesc
+}
+
+func (c *blockStoreCollector) Collect(ch chan<- prometheus.Metric) {
+	stats, err := c.blockStore.Stats()
+	if err != nil {
+		slog.Error("Counting blocks failed", "error", err)
+		ch <- prometheus.NewInvalidMetric(blocksDesc, err)
+		ch <- prometheus.NewInvalidMetric(blockBytesDesc, err)
+	} else {
+		ch <- prometheus.MustNewConstMetric(blocksDesc, prometheus.GaugeValue, float64(stats.Blocks))
+		ch <- prometheus.MustNewConstMetric(blockBytesDesc, prometheus.GaugeValue, float64(stats.Bytes))
+	}
+	ch <- prometheus.MustNewConstMetric(blockPutsDesc, prometheus.CounterValue, float64(stats.Puts))
+	ch <- prometheus.MustNewConstMetric(blockDuplicatePutsDesc, prometheus.CounterValue, float64(stats.DuplicatePuts))
+
+	ratio := 0.0
+	if stats.Puts > 0 {
+		ratio = float64(stats.DuplicatePuts) / float64(stats.Puts)
+	}
+	ch <- prometheus.MustNewConstMetric(blockDedupRatioDesc, prometheus.GaugeValue, ratio)
+}
+
+type metaStoreCollector struct {
+	metaStore *MetaStore
+}
+
+func (c *metaStoreCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- filesDesc
+	ch <- tombstonesDesc
+	ch <- tombstonesPurgedDesc
+	ch <- conflictsDesc
+}
+
+func (c *metaStoreCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.metaStore.Stats()
+	ch <- prometheus.MustNewConstMetric(filesDesc, prometheus.GaugeValue, float64(stats.Files))
+	ch <- prometheus.MustNewConstMetric(tombstonesDesc, prometheus.GaugeValue, float64(stats.Tombstones))
+	ch <- prometheus.MustNewConstMetric(tombstonesPurgedDesc, prometheus.CounterValue, float64(stats.Purged))
+	ch <- prometheus.MustNewConstMetric(conflictsDesc, prometheus.CounterValue, float64(stats.Conflicts))
+}
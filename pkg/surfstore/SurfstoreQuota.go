@@ -0,0 +1,219 @@
+package surfstore
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Quotas limits the bytes each user can store, counted over the files they
+// own, including those in folders they share. Blocks count with the size the
+// BlockStore confirmed storing them with, see MetaStore.ConfirmBlocks.
+type Quotas struct {
+	// DefaultBytes applies to users without a limit of their own, 0 for no
+	// limit
+	DefaultBytes int64
+	// UserBytes holds the limits of single users
+	UserBytes map[string]int64
+	// UniqueBlocks counts each distinct block of a user once, so content
+	// stored under several names is only counted once, instead of the
+	// logical size of the files
+	UniqueBlocks bool
+}
+
+// LoadQuotaFile reads "user,bytes" lines into a user -> bytes map. Blank
+// lines and lines starting with "#" are skipped.
+func LoadQuotaFile(quotaFile string) (map[string]int64, error) {
+	f, err := os.Open(quotaFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	quotas := make(map[string]int64)
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		items := strings.SplitN(line, CONFIG_DELIMITER, 2)
+		if len(items) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected user,bytes", quotaFile, lineNum)
+		}
+		quota, err := strconv.ParseInt(items[1], 10, 64)
+		if err != nil || quota < 0 {
+			return nil, fmt.Errorf("%s:%d: bytes must be a non-negative integer", quotaFile, lineNum)
+		}
+		quotas[items[0]] = quota
+	}
+	return quotas, scanner.Err()
+}
+
+// Limit returns the quota of user in bytes, 0 for no limit.
+func (q *Quotas) Limit(user string) int64 {
+	if q == nil {
+		return 0
+	}
+	if quota, ok := q.UserBytes[user]; ok {
+		return quota
+	}
+	return q.DefaultBytes
+}
+
+// used returns the usage counted against the quota.
+func (q *Quotas) used(usage *Usage) int64 {
+	if q != nil && q.UniqueBlocks {
+		return usage.UniqueBlockBytes
+	}
+	return usage.LogicalBytes
+}
+
+var errUnknownBlockSize = errors.New("unknown block size")
+
+// ownerUsage is the running usage of one owner, kept up to date with every
+// change of their files.
+type ownerUsage struct {
+	files, logicalBytes, uniqueBlockBytes int64
+	// sizes holds the confirmed size of every block stored for a file of the
+	// owner
+	sizes map[string]int32
+	// refs counts how often the owner's files reference each block
+	refs map[string]int
+}
+
+// ownerUsage returns the running usage of owner. The caller must hold m.mu.
+func (m *MetaStore) ownerUsage(owner string) *ownerUsage {
+	usage, exists := m.usage[owner]
+	if !exists {
+		usage = &ownerUsage{sizes: make(map[string]int32), refs: make(map[string]int)}
+		m.usage[owner] = usage
+	}
+	return usage
+}
+
+// usage returns the usage as reported to clients, without a quota.
+func (u *ownerUsage) usage() *Usage {
+	return &Usage{Files: u.files, LogicalBytes: u.logicalBytes, UniqueBlockBytes: u.uniqueBlockBytes}
+}
+
+// setSize records the confirmed size of a block, counting it for the files
+// that already used it while its size was unknown. Known sizes are kept.
+func (u *ownerUsage) setSize(hash string, size int32) {
+	if _, known := u.sizes[hash]; known {
+		return
+	}
+	u.sizes[hash] = size
+	if refs := u.refs[hash]; refs > 0 {
+		u.logicalBytes += int64(refs) * int64(size)
+		u.uniqueBlockBytes += int64(size)
+	}
+}
+
+// change returns the usage after oldFile is replaced by newFile, either of
+// which may be nil, and records it if commit is set. Blocks of unknown size
+// take theirs from claimed, failing with errUnknownBlockSize if it does not
+// have it either, unless commit is set, which counts them as empty.
+func (u *ownerUsage) change(oldFile, newFile *FileMetaData, claimed map[string]int32, commit bool) (*Usage, error) {
+	files, logicalBytes, uniqueBlockBytes := u.files, u.logicalBytes, u.uniqueBlockBytes
+	sizeOf := func(hash string) (int32, bool) {
+		if size, known := u.sizes[hash]; known {
+			return size, true
+		}
+		size, known := claimed[hash]
+		return size, known
+	}
+	refs := make(map[string]int)
+	count := func(fileMetaData *FileMetaData, sign int) error {
+		if fileMetaData == nil || isDeleted(fileMetaData) {
+			return nil
+		}
+		files += int64(sign)
+		if fileMetaData.GetFileType() != FileType_REGULAR {
+			return nil
+		}
+		for _, hash := range fileMetaData.GetBlockHashList() {
+			size, known := sizeOf(hash)
+			if !known && !commit {
+				return fmt.Errorf("%w: %s", errUnknownBlockSize, hash)
+			}
+			logicalBytes += int64(sign) * int64(size)
+			refs[hash] += sign
+		}
+		return nil
+	}
+	if err := count(oldFile, -1); err != nil {
+		return nil, err
+	}
+	if err := count(newFile, 1); err != nil {
+		return nil, err
+	}
+
+	for hash, delta := range refs {
+		before := u.refs[hash]
+		after := before + delta
+		size, _ := sizeOf(hash)
+		if before == 0 && after > 0 {
+			uniqueBlockBytes += int64(size)
+		} else if before > 0 && after == 0 {
+			uniqueBlockBytes -= int64(size)
+		}
+		if !commit {
+			continue
+		}
+		if after == 0 {
+			delete(u.refs, hash)
+		} else {
+			u.refs[hash] = after
+		}
+	}
+	if commit {
+		u.files, u.logicalBytes, u.uniqueBlockBytes = files, logicalBytes, uniqueBlockBytes
+	}
+	return &Usage{Files: files, LogicalBytes: logicalBytes, UniqueBlockBytes: uniqueBlockBytes}, nil
+}
+
+// storeFile stores fileMetaData as the file of owner in fileMetaMap, keeping
+// the usage of owner up to date. The caller must hold m.mu.
+func (m *MetaStore) storeFile(owner string, fileMetaMap map[string]*FileMetaData, fileMetaData *FileMetaData) {
+	filename := fileMetaData.GetFilename()
+	m.ownerUsage(owner).change(fileMetaMap[filename], fileMetaData, nil, true)
+	fileMetaMap[filename] = fileMetaData
+}
+
+// blockClaim holds the sizes claimed for the blocks a block token lets user
+// write to a file of owner. They only count once the BlockStore confirms
+// storing blocks of those sizes, so claims it refused never do, and are
+// dropped when the token expires.
+type blockClaim struct {
+	user, owner string
+	sizes       map[string]int32
+	expiry      time.Time
+}
+
+// dropExpiredClaims forgets the claims of expired block tokens. The caller
+// must hold m.mu.
+func (m *MetaStore) dropExpiredClaims(now time.Time) {
+	for tokenID, claim := range m.claims {
+		if now.After(claim.expiry) {
+			delete(m.claims, tokenID)
+		}
+	}
+}
+
+// quotaExceededError is returned when a change would take owner over quota.
+// The details carry the usage, which sets it apart from the rate limit.
+func quotaExceededError(owner string, usage *Usage, used, quota int64) error {
+	st := status.Newf(codes.ResourceExhausted, "%q would use %d bytes, over the quota of %d bytes", owner, used, quota)
+	if detailed, err := st.WithDetails(usage); err == nil {
+		st = detailed
+	}
+	return st.Err()
+}
@@ -0,0 +1,270 @@
+package surfstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+)
+
+func TestOwnerUsageChange(t *testing.T) {
+	regular := func(hashes ...string) *FileMetaData {
+		return &FileMetaData{Filename: "f", Version: 1, BlockHashList: hashes}
+	}
+	tests := []struct {
+		name             string
+		oldFile, newFile *FileMetaData
+		claimed          map[string]int32
+		// want is the usage after the change, nil if it must fail
+		want *Usage
+	}{
+		{"new file", nil, regular("b"), nil, &Usage{Files: 2, LogicalBytes: 7, UniqueBlockBytes: 7}},
+		{"same blocks", nil, regular("a", "a"), nil, &Usage{Files: 2, LogicalBytes: 9, UniqueBlockBytes: 3}},
+		{"replace block", regular("a"), regular("b"), nil, &Usage{Files: 1, LogicalBytes: 4, UniqueBlockBytes: 4}},
+		{"delete", regular("a"), &FileMetaData{Filename: "f", Version: 2, BlockHashList: []string{"0"}}, nil, &Usage{}},
+		{"symlink", nil, &FileMetaData{Filename: "l", Version: 1, FileType: FileType_SYMLINK, LinkTarget: "f"}, nil, &Usage{Files: 2, LogicalBytes: 3, UniqueBlockBytes: 3}},
+		{"claimed size", nil, regular("c"), map[string]int32{"c": 5}, &Usage{Files: 2, LogicalBytes: 8, UniqueBlockBytes: 8}},
+		{"confirmed size wins", nil, regular("b"), map[string]int32{"b": 1}, &Usage{Files: 2, LogicalBytes: 7, UniqueBlockBytes: 7}},
+		{"unknown size", nil, regular("c"), nil, nil},
+	}
+	for _, test := range tests {
+		u := &ownerUsage{sizes: map[string]int32{"a": 3, "b": 4}, refs: make(map[string]int)}
+		u.change(nil, regular("a"), nil, true)
+
+		got, err := u.change(test.oldFile, test.newFile, test.claimed, false)
+		if test.want == nil {
+			if !errors.Is(err, errUnknownBlockSize) {
+				t.Errorf("%s: change error = %v, want %v", test.name, err, errUnknownBlockSize)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: change: %v", test.name, err)
+			continue
+		}
+		if got.Files != test.want.Files || got.LogicalBytes != test.want.LogicalBytes || got.UniqueBlockBytes != test.want.UniqueBlockBytes {
+			t.Errorf("%s: change = %v, want %v", test.name, got, test.want)
+		}
+		if current := u.usage(); current.Files != 1 || current.LogicalBytes != 3 {
+			t.Errorf("%s: checking a change recorded it, usage is %v", test.name, current)
+		}
+	}
+}
+
+func TestOwnerUsageSetSize(t *testing.T) {
+	u := &ownerUsage{sizes: make(map[string]int32), refs: make(map[string]int)}
+	// blocks of unknown size count once the BlockStore confirms them
+	u.change(nil, &FileMetaData{Filename: "a", Version: 1, BlockHashList: []string{"h", "h"}}, nil, true)
+	if usage := u.usage(); usage.LogicalBytes != 0 {
+		t.Errorf("usage before confirmation = %v, want 0 bytes", usage)
+	}
+	u.setSize("h", 5)
+	if usage := u.usage(); usage.LogicalBytes != 10 || usage.UniqueBlockBytes != 5 {
+		t.Errorf("usage after confirmation = %v, want 10 logical and 5 unique bytes", usage)
+	}
+	u.setSize("h", 1)
+	if usage := u.usage(); usage.LogicalBytes != 10 || u.sizes["h"] != 5 {
+		t.Errorf("second confirmation changed the size to %d", u.sizes["h"])
+	}
+}
+
+func TestUpdateFileQuota(t *testing.T) {
+	tests := []struct {
+		name   string
+		quotas *Quotas
+		blocks []string
+		sizes  []int32
+		// unsized updates skip GetBlockToken, so their sizes are unknown
+		unsized bool
+		code    codes.Code
+	}{
+		{"no quota", nil, []string{"h"}, []int32{100}, false, codes.OK},
+		{"within quota", &Quotas{DefaultBytes: 10}, []string{"h"}, []int32{10}, false, codes.OK},
+		{"over quota", &Quotas{DefaultBytes: 10}, []string{"h"}, []int32{11}, false, codes.ResourceExhausted},
+		{"user quota", &Quotas{DefaultBytes: 10, UserBytes: map[string]int64{"alice": 20}}, []string{"h"}, []int32{11}, false, codes.OK},
+		{"logical bytes", &Quotas{DefaultBytes: 10}, []string{"h", "h"}, []int32{6, 6}, false, codes.ResourceExhausted},
+		{"unique blocks", &Quotas{DefaultBytes: 10, UniqueBlocks: true}, []string{"h", "h"}, []int32{6, 6}, false, codes.OK},
+		{"missing sizes", &Quotas{DefaultBytes: 10}, []string{"h", "g"}, []int32{1}, false, codes.InvalidArgument},
+		{"negative size", &Quotas{DefaultBytes: 10}, []string{"h"}, []int32{-1}, false, codes.InvalidArgument},
+		{"unknown size", &Quotas{DefaultBytes: 10}, []string{"h"}, nil, true, codes.InvalidArgument},
+	}
+	for _, test := range tests {
+		m := NewMetaStore("")
+		m.Quotas = test.quotas
+		ctx := userContext("alice")
+		file := &FileMetaData{Filename: "a", Version: 1, BlockHashList: test.blocks}
+
+		var err error
+		if !test.unsized {
+			_, err = m.GetBlockToken(ctx, &BlockTokenRequest{WriteHashes: test.blocks[:1], File: file, BlockSizes: test.sizes})
+		}
+		if err == nil {
+			_, err = m.UpdateFile(ctx, file)
+		}
+		if status.Code(err) != test.code {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.code)
+		}
+	}
+}
+
+func TestUpdateFileOverQuotaFreesSpace(t *testing.T) {
+	m := NewMetaStore("")
+	ctx := userContext("alice")
+	store := func(version int32, size int32) error {
+		file := &FileMetaData{Filename: "a", Version: version, BlockHashList: []string{string(rune('a' + version))}}
+		if _, err := m.GetBlockToken(ctx, &BlockTokenRequest{WriteHashes: file.BlockHashList, File: file, BlockSizes: []int32{size}}); err != nil {
+			return err
+		}
+		_, err := m.UpdateFile(ctx, file)
+		return err
+	}
+	if err := store(1, 8); err != nil {
+		t.Fatal(err)
+	}
+
+	// after the quota is lowered, changes that do not add to the usage still
+	// go through
+	m.Quotas = &Quotas{DefaultBytes: 5}
+	if err := store(2, 9); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("growing a file over quota: got %v, want %v", err, codes.ResourceExhausted)
+	}
+	if err := store(2, 6); err != nil {
+		t.Errorf("shrinking a file over quota: %v", err)
+	}
+	if usage, _ := m.GetUsage(ctx, &emptypb.Empty{}); usage.LogicalBytes != 6 || usage.QuotaBytes != 5 {
+		t.Errorf("GetUsage = %v, want 6 bytes of a 5 byte quota", usage)
+	}
+}
+
+// headerStream records the headers a handler sets.
+type headerStream struct {
+	header metadata.MD
+}
+
+func (s *headerStream) Method() string { return "/surfstore.BlockStore/PutBlock" }
+
+func (s *headerStream) SetHeader(md metadata.MD) error {
+	s.header = metadata.Join(s.header, md)
+	return nil
+}
+
+func (s *headerStream) SendHeader(md metadata.MD) error { return s.SetHeader(md) }
+
+func (s *headerStream) SetTrailer(md metadata.MD) error { return nil }
+
+func TestFalseBlockSizeClaim(t *testing.T) {
+	m := NewMetaStore("")
+	m.BlockTokenKey = testBlockTokenKey
+	m.Quotas = &Quotas{DefaultBytes: 1000}
+	ctx := userContext("alice")
+
+	data := bytes.Repeat([]byte("x"), 100)
+	block := &Block{BlockData: data, BlockSize: int32(len(data))}
+	hash := GetBlockHashString(data)
+	file := &FileMetaData{Filename: "a", Version: 1, BlockHashList: []string{hash}}
+
+	bs := NewBlockStore()
+	verifier := &BlockTokenVerifier{Key: testBlockTokenKey}
+	putBlock := func(token string) ([]string, error) {
+		stream := &headerStream{}
+		ctx := grpc.NewContextWithServerTransportStream(
+			metadata.NewIncomingContext(context.Background(), metadata.Pairs(BLOCK_TOKEN_METADATA_KEY, token)), stream)
+		info := &grpc.UnaryServerInfo{FullMethod: "/surfstore.BlockStore/PutBlock"}
+		handler := func(ctx context.Context, req interface{}) (interface{}, error) { return bs.PutBlock(ctx, req.(*Block)) }
+		_, err := verifier.UnaryInterceptor(ctx, block, info, handler)
+		return stream.header.Get(BLOCK_RECEIPT_METADATA_KEY), err
+	}
+	usedBytes := func() int64 {
+		usage, err := m.GetUsage(ctx, &emptypb.Empty{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return usage.LogicalBytes
+	}
+
+	// a claim of 1 byte for a 100 byte block gets a token, but the
+	// BlockStore refuses the block, so nothing is confirmed
+	falseToken, err := m.GetBlockToken(ctx, &BlockTokenRequest{WriteHashes: []string{hash}, File: file, BlockSizes: []int32{1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receipts, err := putBlock(falseToken.GetToken()); status.Code(err) != codes.PermissionDenied || len(receipts) != 0 {
+		t.Errorf("PutBlock with a false size = %v receipts, %v, want %v", receipts, err, codes.PermissionDenied)
+	}
+	if _, err := m.UpdateFile(ctx, file); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("UpdateFile after a false claim: got %v, want %v", err, codes.InvalidArgument)
+	}
+	if used := usedBytes(); used != 0 {
+		t.Errorf("usage after a false claim = %d bytes, want 0", used)
+	}
+
+	// the false claim does not stand in the way of the real size
+	honestToken, err := m.GetBlockToken(ctx, &BlockTokenRequest{WriteHashes: []string{hash}, File: file, BlockSizes: []int32{100}})
+	if err != nil {
+		t.Fatalf("GetBlockToken after a false claim: %v", err)
+	}
+	receipts, err := putBlock(honestToken.GetToken())
+	if err != nil || len(receipts) != 1 {
+		t.Fatalf("PutBlock = %v receipts, %v, want 1 receipt", receipts, err)
+	}
+
+	// receipts only confirm the claims of the user they were issued for
+	if _, err := m.ConfirmBlocks(userContext("bob"), &BlockReceipts{Receipts: receipts}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.UpdateFile(ctx, file); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("UpdateFile after another user's confirmation: got %v, want %v", err, codes.InvalidArgument)
+	}
+	if _, err := m.ConfirmBlocks(ctx, &BlockReceipts{Receipts: []string{receipts[0] + "x"}}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("ConfirmBlocks with a forged receipt: got %v, want %v", err, codes.InvalidArgument)
+	}
+
+	if _, err := m.ConfirmBlocks(ctx, &BlockReceipts{Receipts: receipts}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.UpdateFile(ctx, file); err != nil {
+		t.Fatalf("UpdateFile after confirmation: %v", err)
+	}
+	if used := usedBytes(); used != 100 {
+		t.Errorf("usage after confirmation = %d bytes, want 100", used)
+	}
+	if len(m.claims) != 1 {
+		t.Errorf("%d claims pending, want only the refused one", len(m.claims))
+	}
+}
+
+func TestExpiredBlockClaim(t *testing.T) {
+	m := NewMetaStore("")
+	m.BlockTokenKey = testBlockTokenKey
+	m.claims["expired"] = &blockClaim{user: "alice", owner: "alice", sizes: map[string]int32{"h": 5}, expiry: time.Now().Add(-time.Second)}
+	m.claims["live"] = &blockClaim{user: "alice", owner: "alice", sizes: map[string]int32{"g": 5}, expiry: time.Now().Add(time.Minute)}
+
+	var receipts []string
+	for tokenID, hash := range map[string]string{"expired": "h", "live": "g"} {
+		receipt, err := signBlockReceipt(testBlockTokenKey, &blockReceipt{TokenID: tokenID, Hash: hash, Size: 5})
+		if err != nil {
+			t.Fatal(err)
+		}
+		receipts = append(receipts, receipt)
+	}
+	if _, err := m.ConfirmBlocks(userContext("alice"), &BlockReceipts{Receipts: receipts}); err != nil {
+		t.Fatal(err)
+	}
+	sizes := m.ownerUsage("alice").sizes
+	if _, confirmed := sizes["h"]; confirmed {
+		t.Errorf("receipt of an expired claim was confirmed")
+	}
+	if sizes["g"] != 5 {
+		t.Errorf("receipt of a live claim was not confirmed")
+	}
+	if len(m.claims) != 0 {
+		t.Errorf("claims left after confirmation: %v", m.claims)
+	}
+}
@@ -2,78 +2,173 @@ package surfstore
 
 import (
 	context "context"
+	"crypto/tls"
 	"time"
 
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/protobuf/types/known/emptypb"
 )
 
+const DEFAULT_RPC_TIMEOUT time.Duration = time.Second
+
 type RPCClient struct {
 	MetaStoreAddr string
 	BaseDir       string
 	BlockSize     int
+
+	// Rehash makes ClientSync read every file instead of trusting the size,
+	// mtime and inode recorded in the local index
+	Rehash bool
+
+	// TLSConfig enables TLS for every connection when set
+	TLSConfig *tls.Config
+
+	// Token authenticates the client to servers that require it, and can
+	// only be sent over TLS
+	Token string
+
+	// BlockToken is sent with every BlockStore RPC, see GetBlockToken
+	BlockToken string
+
+	// BlockReceipts collects the receipts PutBlock gets for stored blocks,
+	// see ConfirmBlocks
+	BlockReceipts []string
+
+	// Compression compresses uploaded blocks that get smaller by it
+	Compression Compression
+
+	// Timeout bounds every RPC, DEFAULT_RPC_TIMEOUT if zero
+	Timeout time.Duration
+
+	// Encryption encrypts blocks, and optionally file names, before they are
+	// sent to the servers
+	Encryption *ClientEncryption
+
+	// Context is the parent of every RPC, carrying the trace span of the
+	// sync step making it. context.Background() if nil.
+	Context context.Context
+}
+
+func (surfClient *RPCClient) context() context.Context {
+	if surfClient.Context == nil {
+		return context.Background()
+	}
+	return surfClient.Context
+}
+
+func (surfClient *RPCClient) timeout() time.Duration {
+	if surfClient.Timeout <= 0 {
+		return DEFAULT_RPC_TIMEOUT
+	}
+	return surfClient.Timeout
+}
+
+// withBlockToken attaches the client's block token to a BlockStore RPC.
+func (surfClient *RPCClient) withBlockToken(ctx context.Context) context.Context {
+	if surfClient.BlockToken == "" {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, BLOCK_TOKEN_METADATA_KEY, surfClient.BlockToken)
+}
+
+// encryptSharePath returns a copy of share naming the encrypted path.
+func (surfClient *RPCClient) encryptSharePath(share *Share) (*Share, error) {
+	path, err := surfClient.Encryption.EncryptName(share.GetPath())
+	if err != nil {
+		return nil, err
+	}
+	return &Share{Owner: share.GetOwner(), Path: path, User: share.GetUser(), Permission: share.GetPermission()}, nil
+}
+
+// dial connects to a MetaStore or BlockStore, over TLS if it is configured,
+// tracing every RPC and tagging it with a request id.
+func (surfClient *RPCClient) dial(addr string) (*grpc.ClientConn, error) {
+	opts := []grpc.DialOption{grpc.WithChainUnaryInterceptor(otelgrpc.UnaryClientInterceptor(), requestIDUnaryClientInterceptor, retryRateLimitedUnaryClientInterceptor)}
+	if surfClient.TLSConfig != nil {
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(surfClient.TLSConfig)))
+	} else {
+		opts = append(opts, grpc.WithInsecure())
+	}
+	if surfClient.Token != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(tokenCredentials{token: surfClient.Token}))
+	}
+	return grpc.Dial(addr, opts...)
 }
 
+// GetBlock fetches a block, failing with ErrBlockNotFound if the BlockStore
+// does not have it.
 func (surfClient *RPCClient) GetBlock(blockHash string, blockStoreAddr string, block *Block) error {
 	// connect to the server
-	conn, err := grpc.Dial(blockStoreAddr, grpc.WithInsecure())
+	conn, err := surfClient.dial(blockStoreAddr)
 	if err != nil {
 		return err
 	}
 	c := NewBlockStoreClient(conn)
 
 	// perform the call
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	ctx, cancel := context.WithTimeout(surfClient.context(), surfClient.timeout())
 	defer cancel()
+	ctx = surfClient.withBlockToken(ctx)
+
 	b, err := c.GetBlock(ctx, &BlockHash{Hash: blockHash})
 	if err != nil {
 		conn.Close()
-		return err
+		return translateError(err, ErrBlockNotFound)
 	}
 	block.BlockData = b.BlockData
 	block.BlockSize = b.BlockSize
+	block.Compression = b.Compression
 
 	// close the connection
 	return conn.Close()
 }
 
+// PutBlock stores a block, adding the BlockStore's receipt for it, if any,
+// to BlockReceipts.
 func (surfClient *RPCClient) PutBlock(block *Block, blockStoreAddr string, succ *bool) error {
-	conn, err := grpc.Dial(blockStoreAddr, grpc.WithInsecure())
+	conn, err := surfClient.dial(blockStoreAddr)
 	if err != nil {
 		return err
 	}
 	c := NewBlockStoreClient(conn)
 
 	// perform the call
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	ctx, cancel := context.WithTimeout(surfClient.context(), surfClient.timeout())
 	defer cancel()
+	ctx = surfClient.withBlockToken(ctx)
 
-	s, err := c.PutBlock(ctx, block)
+	var header metadata.MD
+	s, err := c.PutBlock(ctx, block, grpc.Header(&header))
 	if err != nil {
 		conn.Close()
-		return err
+		return translateError(err, nil)
 	}
 	*succ = s.Flag
+	surfClient.BlockReceipts = append(surfClient.BlockReceipts, header.Get(BLOCK_RECEIPT_METADATA_KEY)...)
 
 	return conn.Close()
 	// panic("todo")
 }
 
 func (surfClient *RPCClient) HasBlocks(blockHashesIn []string, blockStoreAddr string, blockHashesOut *[]string) error {
-	conn, err := grpc.Dial(blockStoreAddr, grpc.WithInsecure())
+	conn, err := surfClient.dial(blockStoreAddr)
 	if err != nil {
 		return err
 	}
 	c := NewBlockStoreClient(conn)
 
 	// perform the call
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	ctx, cancel := context.WithTimeout(surfClient.context(), surfClient.timeout())
 	defer cancel()
+	ctx = surfClient.withBlockToken(ctx)
 
 	blockHashes, err := c.HasBlocks(ctx, &BlockHashes{Hashes: blockHashesIn})
 	if err != nil {
 		conn.Close()
-		return err
+		return translateError(err, nil)
 	}
 	*blockHashesOut = blockHashes.Hashes
 
@@ -82,65 +177,130 @@ func (surfClient *RPCClient) HasBlocks(blockHashesIn []string, blockStoreAddr st
 }
 
 func (surfClient *RPCClient) GetFileInfoMap(serverFileInfoMap *map[string]*FileMetaData) error {
-	conn, err := grpc.Dial(surfClient.MetaStoreAddr, grpc.WithInsecure())
+	var revision, baseRevision int64
+	return surfClient.getFileInfoMap(serverFileInfoMap, &revision, &baseRevision)
+}
+
+// getFileInfoMap is GetFileInfoMap, also returning the server's revision at
+// the time of the map and the revision the server started at.
+func (surfClient *RPCClient) getFileInfoMap(serverFileInfoMap *map[string]*FileMetaData, revision, baseRevision *int64) error {
+	conn, err := surfClient.dial(surfClient.MetaStoreAddr)
 	if err != nil {
 		return err
 	}
 	c := NewMetaStoreClient(conn)
 
 	// perform the call
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	ctx, cancel := context.WithTimeout(surfClient.context(), surfClient.timeout())
 	defer cancel()
 
 	fim, err := c.GetFileInfoMap(ctx, &emptypb.Empty{})
 	if err != nil {
 		conn.Close()
-		return err
+		return translateError(err, nil)
 	}
-	*serverFileInfoMap = fim.FileInfoMap
+	*serverFileInfoMap = make(map[string]*FileMetaData, len(fim.FileInfoMap))
+	for _, fileMetaData := range fim.FileInfoMap {
+		if err := surfClient.Encryption.decryptFileMetaData(fileMetaData); err != nil {
+			conn.Close()
+			return err
+		}
+		(*serverFileInfoMap)[fileMetaData.GetFilename()] = fileMetaData
+	}
+	*revision, *baseRevision = fim.Revision, fim.BaseRevision
 
 	return conn.Close()
 	// panic("todo")
 }
 
+// UpdateFile stores new metadata for a file and records the server's
+// revision of the change in fileMetaData. If the server has a newer version,
+// it fails with ErrVersionConflict and an RPCError holding that version.
 func (surfClient *RPCClient) UpdateFile(fileMetaData *FileMetaData, latestVersion *int32) error {
-	conn, err := grpc.Dial(surfClient.MetaStoreAddr, grpc.WithInsecure())
+	stored := fileMetaData
+	fileMetaData, err := surfClient.Encryption.encryptFileMetaData(fileMetaData)
+	if err != nil {
+		return err
+	}
+
+	conn, err := surfClient.dial(surfClient.MetaStoreAddr)
 	if err != nil {
 		return err
 	}
 	c := NewMetaStoreClient(conn)
 
 	// perform the call
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	ctx, cancel := context.WithTimeout(surfClient.context(), surfClient.timeout())
 	defer cancel()
 
 	version, err := c.UpdateFile(ctx, fileMetaData)
 	if err != nil {
 		conn.Close()
-		return err
+		return translateError(err, nil)
 	}
 
 	*latestVersion = version.Version
+	stored.Revision = version.Revision
 
 	return conn.Close()
 	// panic("todo")
 }
 
+// RenameFile moves a file on the server. It fails with ErrVersionConflict if
+// version is not the server's version of oldFilename, ErrFileNotFound if
+// oldFilename does not exist and ErrFileExists if the new name does.
+func (surfClient *RPCClient) RenameFile(oldFilename string, newFileMetaData *FileMetaData, version int32, latestVersion *int32) error {
+	oldFilename, err := surfClient.Encryption.EncryptName(oldFilename)
+	if err != nil {
+		return err
+	}
+	newFilename, err := surfClient.Encryption.EncryptName(newFileMetaData.GetFilename())
+	if err != nil {
+		return err
+	}
+
+	conn, err := surfClient.dial(surfClient.MetaStoreAddr)
+	if err != nil {
+		return err
+	}
+	c := NewMetaStoreClient(conn)
+
+	// perform the call
+	ctx, cancel := context.WithTimeout(surfClient.context(), surfClient.timeout())
+	defer cancel()
+
+	v, err := c.RenameFile(ctx, &RenameRequest{
+		OldFilename: oldFilename,
+		NewFilename: newFilename,
+		Version:     version,
+		Mode:        newFileMetaData.GetMode(),
+		Mtime:       newFileMetaData.GetMtime(),
+	})
+	if err != nil {
+		conn.Close()
+		return translateError(err, ErrFileNotFound)
+	}
+
+	*latestVersion = v.Version
+
+	return conn.Close()
+}
+
 func (surfClient *RPCClient) GetBlockStoreAddr(blockStoreAddr *string) error {
-	conn, err := grpc.Dial(surfClient.MetaStoreAddr, grpc.WithInsecure())
+	conn, err := surfClient.dial(surfClient.MetaStoreAddr)
 	if err != nil {
 		return err
 	}
 	c := NewMetaStoreClient(conn)
 
 	// perform the call
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	ctx, cancel := context.WithTimeout(surfClient.context(), surfClient.timeout())
 	defer cancel()
 
 	bStoreAddr, err := c.GetBlockStoreAddr(ctx, &emptypb.Empty{})
 	if err != nil {
 		conn.Close()
-		return err
+		return translateError(err, nil)
 	}
 
 	*blockStoreAddr = bStoreAddr.Addr
@@ -149,6 +309,238 @@ func (surfClient *RPCClient) GetBlockStoreAddr(blockStoreAddr *string) error {
 	// panic("todo")
 }
 
+func (surfClient *RPCClient) ShareFolder(share *Share, succ *bool) error {
+	share, err := surfClient.encryptSharePath(share)
+	if err != nil {
+		return err
+	}
+
+	conn, err := surfClient.dial(surfClient.MetaStoreAddr)
+	if err != nil {
+		return err
+	}
+	c := NewMetaStoreClient(conn)
+
+	// perform the call
+	ctx, cancel := context.WithTimeout(surfClient.context(), surfClient.timeout())
+	defer cancel()
+
+	s, err := c.ShareFolder(ctx, share)
+	if err != nil {
+		conn.Close()
+		return translateError(err, nil)
+	}
+	*succ = s.Flag
+
+	return conn.Close()
+}
+
+func (surfClient *RPCClient) RevokeShare(share *Share, succ *bool) error {
+	share, err := surfClient.encryptSharePath(share)
+	if err != nil {
+		return err
+	}
+
+	conn, err := surfClient.dial(surfClient.MetaStoreAddr)
+	if err != nil {
+		return err
+	}
+	c := NewMetaStoreClient(conn)
+
+	// perform the call
+	ctx, cancel := context.WithTimeout(surfClient.context(), surfClient.timeout())
+	defer cancel()
+
+	s, err := c.RevokeShare(ctx, share)
+	if err != nil {
+		conn.Close()
+		return translateError(err, nil)
+	}
+	*succ = s.Flag
+
+	return conn.Close()
+}
+
+func (surfClient *RPCClient) ListShares(shares *[]*Share) error {
+	conn, err := surfClient.dial(surfClient.MetaStoreAddr)
+	if err != nil {
+		return err
+	}
+	c := NewMetaStoreClient(conn)
+
+	// perform the call
+	ctx, cancel := context.WithTimeout(surfClient.context(), surfClient.timeout())
+	defer cancel()
+
+	s, err := c.ListShares(ctx, &emptypb.Empty{})
+	if err != nil {
+		conn.Close()
+		return translateError(err, nil)
+	}
+	for _, share := range s.Shares {
+		if share.Path, err = surfClient.Encryption.DecryptName(share.Path); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	*shares = s.Shares
+
+	return conn.Close()
+}
+
+func (surfClient *RPCClient) GetBlockToken(readHashes, writeHashes []string, file *FileMetaData, blockSizes []int32, blockToken *string) error {
+	if file != nil {
+		var err error
+		if file, err = surfClient.Encryption.encryptFileMetaData(file); err != nil {
+			return err
+		}
+	}
+
+	conn, err := surfClient.dial(surfClient.MetaStoreAddr)
+	if err != nil {
+		return err
+	}
+	c := NewMetaStoreClient(conn)
+
+	// perform the call
+	ctx, cancel := context.WithTimeout(surfClient.context(), surfClient.timeout())
+	defer cancel()
+
+	t, err := c.GetBlockToken(ctx, &BlockTokenRequest{ReadHashes: readHashes, WriteHashes: writeHashes, File: file, BlockSizes: blockSizes})
+	if err != nil {
+		conn.Close()
+		return translateError(err, nil)
+	}
+	*blockToken = t.Token
+
+	return conn.Close()
+}
+
+// ConfirmBlocks hands the receipts of stored blocks to the MetaStore, which
+// only counts blocks against quotas once the BlockStore confirmed their size.
+func (surfClient *RPCClient) ConfirmBlocks(receipts []string) error {
+	conn, err := surfClient.dial(surfClient.MetaStoreAddr)
+	if err != nil {
+		return err
+	}
+	c := NewMetaStoreClient(conn)
+
+	// perform the call
+	ctx, cancel := context.WithTimeout(surfClient.context(), surfClient.timeout())
+	defer cancel()
+
+	if _, err := c.ConfirmBlocks(ctx, &BlockReceipts{Receipts: receipts}); err != nil {
+		conn.Close()
+		return translateError(err, nil)
+	}
+
+	return conn.Close()
+}
+
+func (surfClient *RPCClient) GetUsage(usage *Usage) error {
+	conn, err := surfClient.dial(surfClient.MetaStoreAddr)
+	if err != nil {
+		return err
+	}
+	c := NewMetaStoreClient(conn)
+
+	// perform the call
+	ctx, cancel := context.WithTimeout(surfClient.context(), surfClient.timeout())
+	defer cancel()
+
+	u, err := c.GetUsage(ctx, &emptypb.Empty{})
+	if err != nil {
+		conn.Close()
+		return translateError(err, nil)
+	}
+	usage.Files, usage.LogicalBytes, usage.UniqueBlockBytes, usage.QuotaBytes = u.Files, u.LogicalBytes, u.UniqueBlockBytes, u.QuotaBytes
+
+	return conn.Close()
+}
+
+func (surfClient *RPCClient) QueryAuditLog(query *AuditQuery, entries *[]*AuditEntry) error {
+	conn, err := surfClient.dial(surfClient.MetaStoreAddr)
+	if err != nil {
+		return err
+	}
+	c := NewMetaStoreClient(conn)
+
+	// perform the call
+	ctx, cancel := context.WithTimeout(surfClient.context(), surfClient.timeout())
+	defer cancel()
+
+	e, err := c.QueryAuditLog(ctx, query)
+	if err != nil {
+		conn.Close()
+		return translateError(err, nil)
+	}
+	*entries = e.Entries
+
+	return conn.Close()
+}
+
+// AcknowledgeRevision tells the MetaStore that the client with clientID
+// synced every change up to revision.
+func (surfClient *RPCClient) AcknowledgeRevision(clientID string, revision int64) error {
+	conn, err := surfClient.dial(surfClient.MetaStoreAddr)
+	if err != nil {
+		return err
+	}
+	c := NewMetaStoreClient(conn)
+
+	// perform the call
+	ctx, cancel := context.WithTimeout(surfClient.context(), surfClient.timeout())
+	defer cancel()
+
+	_, err = c.AcknowledgeRevision(ctx, &Acknowledgement{ClientId: clientID, Revision: revision})
+	if err != nil {
+		conn.Close()
+		return translateError(err, nil)
+	}
+
+	return conn.Close()
+}
+
+// RotateBlockKeys starts rotating the blocks stored by a BlockStore to its
+// current master key, filling in the status of the rotation.
+func (surfClient *RPCClient) RotateBlockKeys(blockStoreAddr string, rotationStatus *RotationStatus) error {
+	return surfClient.rotationStatus(blockStoreAddr, true, rotationStatus)
+}
+
+// GetRotationStatus fills in the status of a BlockStore's running or last
+// rotation.
+func (surfClient *RPCClient) GetRotationStatus(blockStoreAddr string, rotationStatus *RotationStatus) error {
+	return surfClient.rotationStatus(blockStoreAddr, false, rotationStatus)
+}
+
+func (surfClient *RPCClient) rotationStatus(blockStoreAddr string, start bool, rotationStatus *RotationStatus) error {
+	conn, err := surfClient.dial(blockStoreAddr)
+	if err != nil {
+		return err
+	}
+	c := NewBlockStoreAdminClient(conn)
+
+	// perform the call
+	ctx, cancel := context.WithTimeout(surfClient.context(), surfClient.timeout())
+	defer cancel()
+
+	var s *RotationStatus
+	if start {
+		s, err = c.RotateBlockKeys(ctx, &emptypb.Empty{})
+	} else {
+		s, err = c.GetRotationStatus(ctx, &emptypb.Empty{})
+	}
+	if err != nil {
+		conn.Close()
+		return translateError(err, nil)
+	}
+	rotationStatus.Running, rotationStatus.KeyId, rotationStatus.Error = s.Running, s.KeyId, s.Error
+	rotationStatus.Checked, rotationStatus.Rotated = s.Checked, s.Rotated
+	rotationStatus.Started, rotationStatus.Finished = s.Started, s.Finished
+
+	return conn.Close()
+}
+
 // This line guarantees all method for RPCClient are implemented
 var _ ClientInterface = new(RPCClient)
 
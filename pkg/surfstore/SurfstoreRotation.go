@@ -0,0 +1,122 @@
+package surfstore
+
+import (
+	context "context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+)
+
+var errRotationRunning = errors.New("a rotation is already running")
+
+// KeyRotator rotates the blocks stored in a BlockDir to the current master
+// key, one rotation at a time, and reports how far the last one got. It
+// serves BlockStoreAdmin.
+type KeyRotator struct {
+	BlockDir *BlockDir
+	// KeyFile is reloaded before every rotation when set
+	KeyFile string
+	// Admins are the users allowed to rotate. Servers that do not
+	// authenticate clients let anyone rotate.
+	Admins map[string]bool
+
+	mu     sync.Mutex
+	status *RotationStatus
+	UnimplementedBlockStoreAdminServer
+}
+
+// Rotate reloads the keys and rotates the stored blocks, returning the final
+// status once done. The outcome is logged.
+func (r *KeyRotator) Rotate() (*RotationStatus, error) {
+	if err := r.start(); err != nil {
+		slog.Error("Not rotating stored blocks", "error", err)
+		return nil, err
+	}
+	return r.run()
+}
+
+// RotateBlockKeys starts a rotation in the background and returns its
+// status, or the status of the rotation already running.
+func (r *KeyRotator) RotateBlockKeys(ctx context.Context, _ *emptypb.Empty) (*RotationStatus, error) {
+	if user := UserFromContext(ctx); user != "" && !r.Admins[user] {
+		return nil, status.Error(codes.PermissionDenied, "only admins can rotate block keys")
+	}
+	if err := r.start(); err == nil {
+		go r.run()
+	} else if err != errRotationRunning {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return r.currentStatus(), nil
+}
+
+// GetRotationStatus returns the status of the running or last rotation.
+func (r *KeyRotator) GetRotationStatus(ctx context.Context, _ *emptypb.Empty) (*RotationStatus, error) {
+	if user := UserFromContext(ctx); user != "" && !r.Admins[user] {
+		return nil, status.Error(codes.PermissionDenied, "only admins can rotate block keys")
+	}
+	return r.currentStatus(), nil
+}
+
+func (r *KeyRotator) currentStatus() *RotationStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.status == nil {
+		return &RotationStatus{}
+	}
+	return proto.Clone(r.status).(*RotationStatus)
+}
+
+// start reloads the keys and marks a rotation to the current key as running,
+// failing if one already is.
+func (r *KeyRotator) start() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.status.GetRunning() {
+		return errRotationRunning
+	}
+	if r.BlockDir.Keys == nil {
+		return errors.New("no key ring to rotate to")
+	}
+	if r.KeyFile != "" {
+		if err := r.BlockDir.Keys.Reload(r.KeyFile); err != nil {
+			return err
+		}
+	}
+	r.status = &RotationStatus{Running: true, KeyId: r.BlockDir.Keys.CurrentID(), Started: time.Now().UnixNano()}
+	return nil
+}
+
+// run does the rotation marked as running by start.
+func (r *KeyRotator) run() (*RotationStatus, error) {
+	slog.Info("Rotating stored blocks", "key", r.currentStatus().KeyId)
+	_, err := r.BlockDir.Rotate(func(checked, rotated int) {
+		r.mu.Lock()
+		r.status.Checked, r.status.Rotated = int64(checked), int64(rotated)
+		r.mu.Unlock()
+	})
+
+	r.mu.Lock()
+	r.status.Running = false
+	r.status.Finished = time.Now().UnixNano()
+	if err != nil {
+		r.status.Error = err.Error()
+	}
+	r.mu.Unlock()
+
+	final := r.currentStatus()
+	if err != nil {
+		slog.Error("Rotating stored blocks failed", "rotated", final.Rotated, "error", err)
+	} else {
+		slog.Info("Rotated stored blocks", "rotated", final.Rotated, "checked", final.Checked, "key", final.KeyId)
+	}
+	return final, err
+}
+
+// This line guarantees all method for KeyRotator are implemented
+var _ BlockStoreAdminInterface = new(KeyRotator)
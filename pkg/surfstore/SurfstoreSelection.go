@@ -0,0 +1,140 @@
+package surfstore
+
+import (
+	"bufio"
+	"os"
+	"strings"
+)
+
+const SELECTION_INCLUDE_PREFIX string = "+"
+const SELECTION_EXCLUDE_PREFIX string = "-"
+
+// Selection restricts which remote paths a client keeps locally. A path is
+// selected by the longest include or exclude prefix that matches it; paths
+// matching no prefix are selected only if there are no include prefixes.
+type Selection struct {
+	Include []string
+	Exclude []string
+}
+
+// NewSelection builds a Selection from raw path prefixes, dropping empty ones.
+func NewSelection(include, exclude []string) *Selection {
+	sel := &Selection{}
+	for _, prefix := range include {
+		if prefix = cleanPathPrefix(prefix); prefix != "" {
+			sel.Include = append(sel.Include, prefix)
+		}
+	}
+	for _, prefix := range exclude {
+		if prefix = cleanPathPrefix(prefix); prefix != "" {
+			sel.Exclude = append(sel.Exclude, prefix)
+		}
+	}
+	return sel
+}
+
+func cleanPathPrefix(prefix string) string {
+	prefix = strings.TrimSpace(prefix)
+	prefix = strings.TrimPrefix(prefix, "./")
+	return strings.Trim(prefix, "/")
+}
+
+// hasPathPrefix reports whether prefix names filename or one of its parent
+// directories.
+func hasPathPrefix(filename, prefix string) bool {
+	return filename == prefix || strings.HasPrefix(filename, prefix+"/")
+}
+
+// Selected reports whether filename is part of the selection.
+func (s *Selection) Selected(filename string) bool {
+	if s == nil {
+		return true
+	}
+
+	selected := len(s.Include) == 0
+	longest := -1
+	for _, prefix := range s.Include {
+		if hasPathPrefix(filename, prefix) && len(prefix) > longest {
+			selected, longest = true, len(prefix)
+		}
+	}
+	for _, prefix := range s.Exclude {
+		if hasPathPrefix(filename, prefix) && len(prefix) > longest {
+			selected, longest = false, len(prefix)
+		}
+	}
+	return selected
+}
+
+// SelectedDir reports whether anything below dir can be selected, so the
+// walk of the base directory can skip whole unselected subtrees.
+func (s *Selection) SelectedDir(dir string) bool {
+	if s.Selected(dir) {
+		return true
+	}
+	for _, prefix := range s.Include {
+		if hasPathPrefix(prefix, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadSelection reads the selection stored next to the local index. A missing
+// file means everything is selected.
+func LoadSelection(baseDir string) (*Selection, error) {
+	selFD, err := os.Open(ConcatPath(baseDir, DEFAULT_SELECTION_FILENAME))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &Selection{}, nil
+		}
+		return nil, err
+	}
+	defer selFD.Close()
+
+	var include, exclude []string
+	scanner := bufio.NewScanner(selFD)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, SELECTION_INCLUDE_PREFIX) {
+			include = append(include, line[len(SELECTION_INCLUDE_PREFIX):])
+		} else if strings.HasPrefix(line, SELECTION_EXCLUDE_PREFIX) {
+			exclude = append(exclude, line[len(SELECTION_EXCLUDE_PREFIX):])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return NewSelection(include, exclude), nil
+}
+
+// WriteSelection stores the selection next to the local index, removing the
+// file when everything is selected.
+func WriteSelection(sel *Selection, baseDir string) error {
+	selPath := ConcatPath(baseDir, DEFAULT_SELECTION_FILENAME)
+	if len(sel.Include) == 0 && len(sel.Exclude) == 0 {
+		if err := os.Remove(selPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	outFD, err := os.Create(selPath)
+	if err != nil {
+		return err
+	}
+	defer outFD.Close()
+
+	for _, prefix := range sel.Include {
+		if _, err := outFD.WriteString(SELECTION_INCLUDE_PREFIX + prefix + "\n"); err != nil {
+			return err
+		}
+	}
+	for _, prefix := range sel.Exclude {
+		if _, err := outFD.WriteString(SELECTION_EXCLUDE_PREFIX + prefix + "\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
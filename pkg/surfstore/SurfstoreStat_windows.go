@@ -0,0 +1,11 @@
+package surfstore
+
+import (
+	"os"
+)
+
+// fileInode returns 0 since FileInfo does not expose file IDs on Windows, so
+// unchanged files are only recognized by size and modification time.
+func fileInode(fileInfo os.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,216 @@
+package surfstore
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA is a certificate authority created for a test.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string
+}
+
+var testSerial int64
+
+// writePEM writes a single PEM block of the given type to dir/name.
+func writePEM(t *testing.T, dir, name, blockType string, der []byte) string {
+	t.Helper()
+	file := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// newTestCA creates a self-signed CA and writes its certificate to dir.
+func newTestCA(t *testing.T, dir, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSerial++
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(testSerial),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, file: writePEM(t, dir, name+".pem", "CERTIFICATE", der)}
+}
+
+// issue creates a certificate for localhost signed by ca and writes it and its
+// key to dir, returning both file names.
+func (ca *testCA) issue(t *testing.T, dir, name string, usage x509.ExtKeyUsage) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSerial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(testSerial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return writePEM(t, dir, name+".pem", "CERTIFICATE", der), writePEM(t, dir, name+".key", "EC PRIVATE KEY", keyDER)
+}
+
+// handshake connects a client with clientConfig to a server with
+// serverConfig over TCP and returns the handshake errors of both sides.
+func handshake(t *testing.T, serverConfig, clientConfig *tls.Config) (serverErr, clientErr error) {
+	t.Helper()
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	serverDone := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			serverDone <- err
+			return
+		}
+		defer conn.Close()
+		serverDone <- conn.(*tls.Conn).Handshake()
+	}()
+
+	conn, clientErr := tls.Dial("tcp", listener.Addr().String(), clientConfig)
+	if clientErr == nil {
+		// with TLS 1.3 the client is done before the server checked its
+		// certificate, so wait for the server before hanging up
+		serverErr = <-serverDone
+		conn.Close()
+		return serverErr, nil
+	}
+	return <-serverDone, clientErr
+}
+
+func TestTLSHandshake(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir, "ca")
+	serverCert, serverKey := ca.issue(t, dir, "server", x509.ExtKeyUsageServerAuth)
+	clientCert, clientKey := ca.issue(t, dir, "client", x509.ExtKeyUsageClientAuth)
+
+	for _, mutual := range []bool{false, true} {
+		clientCAFile, certFile, keyFile := "", "", ""
+		if mutual {
+			clientCAFile, certFile, keyFile = ca.file, clientCert, clientKey
+		}
+		serverConfig, err := NewServerTLSConfig(serverCert, serverKey, clientCAFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clientConfig, err := NewClientTLSConfig(ca.file, certFile, keyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if serverErr, clientErr := handshake(t, serverConfig, clientConfig); serverErr != nil || clientErr != nil {
+			t.Errorf("mutual=%v: handshake failed: server %v, client %v", mutual, serverErr, clientErr)
+		}
+	}
+}
+
+func TestTLSRejectsMissingClientCert(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir, "ca")
+	serverCert, serverKey := ca.issue(t, dir, "server", x509.ExtKeyUsageServerAuth)
+
+	serverConfig, err := NewServerTLSConfig(serverCert, serverKey, ca.file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConfig, err := NewClientTLSConfig(ca.file, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serverErr, _ := handshake(t, serverConfig, clientConfig); serverErr == nil {
+		t.Error("server accepted a client without a certificate")
+	}
+}
+
+func TestTLSRejectsWrongCA(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir, "ca")
+	otherCA := newTestCA(t, dir, "other-ca")
+	serverCert, serverKey := ca.issue(t, dir, "server", x509.ExtKeyUsageServerAuth)
+	clientCert, clientKey := ca.issue(t, dir, "client", x509.ExtKeyUsageClientAuth)
+	otherServerCert, otherServerKey := otherCA.issue(t, dir, "other-server", x509.ExtKeyUsageServerAuth)
+	otherClientCert, otherClientKey := otherCA.issue(t, dir, "other-client", x509.ExtKeyUsageClientAuth)
+
+	serverConfig, err := NewServerTLSConfig(serverCert, serverKey, ca.file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConfig, err := NewClientTLSConfig(ca.file, otherClientCert, otherClientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serverErr, _ := handshake(t, serverConfig, clientConfig); serverErr == nil {
+		t.Error("server accepted a client certificate signed by another CA")
+	}
+
+	serverConfig, err = NewServerTLSConfig(otherServerCert, otherServerKey, ca.file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConfig, err = NewClientTLSConfig(ca.file, clientCert, clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, clientErr := handshake(t, serverConfig, clientConfig); clientErr == nil {
+		t.Error("client accepted a server certificate signed by another CA")
+	}
+}
+
+func TestTLSConfigNeedsCertAndKey(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir, "ca")
+	certFile, _ := ca.issue(t, dir, "server", x509.ExtKeyUsageServerAuth)
+
+	if _, err := NewServerTLSConfig(certFile, "", ""); err == nil {
+		t.Error("server config without a key was accepted")
+	}
+	if _, err := NewClientTLSConfig(ca.file, certFile, ""); err == nil {
+		t.Error("client config without a key was accepted")
+	}
+}
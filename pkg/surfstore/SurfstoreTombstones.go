@@ -0,0 +1,231 @@
+package surfstore
+
+import (
+	context "context"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DEFAULT_CLIENT_EXPIRY is how long a client can stay away before the
+// MetaStore stops waiting for it to acknowledge deletions
+const DEFAULT_CLIENT_EXPIRY time.Duration = 90 * 24 * time.Hour
+
+// TOMBSTONE_COMPACTION_INTERVAL is how often tombstones are purged at most
+const TOMBSTONE_COMPACTION_INTERVAL time.Duration = 10 * time.Minute
+
+// MAX_CLIENT_ID_LENGTH bounds the client ids the MetaStore keeps
+const MAX_CLIENT_ID_LENGTH int = 64
+
+// MAX_CLIENTS_PER_USER bounds the clients kept per user. A new client beyond
+// it makes the MetaStore forget the user's least recently seen client.
+const MAX_CLIENTS_PER_USER int = 32
+
+// clientAck is the latest revision a client synced completely.
+type clientAck struct {
+	revision int64
+	lastSeen time.Time
+}
+
+// noteRevision stamps fileMetaData, just stored as filename of owner, with
+// a new revision and tracks when it became a tombstone. Tombstones are
+// flagged and carry the hash list [TOMBSTONE_HASH], whichever of the two
+// the client sent, and the server's deletion time. The caller must hold
+// m.mu.
+func (m *MetaStore) noteRevision(owner, filename string, fileMetaData *FileMetaData, revision int64) {
+	fileMetaData.Revision = revision
+	if m.deletedAt == nil {
+		m.deletedAt = make(map[string]map[string]time.Time)
+	}
+	if !isDeleted(fileMetaData) {
+		fileMetaData.DeletedTime = 0
+		delete(m.deletedAt[owner], filename)
+		return
+	}
+	fileMetaData.Deleted = true
+	fileMetaData.DeletedTime = time.Now().UnixNano()
+	fileMetaData.BlockHashList = []string{TOMBSTONE_HASH}
+	if m.deletedAt[owner] == nil {
+		m.deletedAt[owner] = make(map[string]time.Time)
+	}
+	m.deletedAt[owner][filename] = time.Unix(0, fileMetaData.GetDeletedTime())
+}
+
+// AcknowledgeRevision records that the calling client synced everything up
+// to revision, so tombstones up to it need not be kept for that client.
+func (m *MetaStore) AcknowledgeRevision(ctx context.Context, ack *Acknowledgement) (*Success, error) {
+	if ack.GetClientId() == "" || len(ack.GetClientId()) > MAX_CLIENT_ID_LENGTH {
+		return nil, status.Errorf(codes.InvalidArgument, "client id must have 1 to %d bytes", MAX_CLIENT_ID_LENGTH)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if ack.GetRevision() > m.revision {
+		return nil, status.Errorf(codes.InvalidArgument, "revision %d is ahead of the server's %d", ack.GetRevision(), m.revision)
+	}
+	if m.clients == nil {
+		m.clients = make(map[string]map[string]*clientAck)
+	}
+	// clients are kept per user, so no user can act for another's client
+	user := UserFromContext(ctx)
+	if m.clients[user] == nil {
+		m.clients[user] = make(map[string]*clientAck)
+	}
+	delete(m.expiredUsers, user)
+	clients := m.clients[user]
+	client, exists := clients[ack.GetClientId()]
+	if !exists {
+		if len(clients) >= MAX_CLIENTS_PER_USER {
+			forgetLeastRecentClient(clients)
+		}
+		client = &clientAck{}
+		clients[ack.GetClientId()] = client
+		loggerFromContext(ctx).Info("New client", "client", ack.GetClientId())
+	}
+	if ack.GetRevision() > client.revision {
+		client.revision = ack.GetRevision()
+	}
+	client.lastSeen = time.Now()
+
+	return &Success{Flag: true}, nil
+}
+
+// forgetLeastRecentClient drops the client of clients seen least recently.
+func forgetLeastRecentClient(clients map[string]*clientAck) {
+	var oldestID string
+	var oldest *clientAck
+	for clientID, client := range clients {
+		if oldest == nil || client.lastSeen.Before(oldest.lastSeen) {
+			oldestID, oldest = clientID, client
+		}
+	}
+	delete(clients, oldestID)
+	slog.Info("Forgot client", "client", oldestID, "last_seen", oldest.lastSeen)
+}
+
+// CompactTombstones forgets clients not seen for ClientExpiry and purges the
+// tombstones older than TombstoneRetention that every client able to see
+// them has acknowledged: the clients of their owner and of the users the
+// owner shares them with. A user without clients has not seen the deletion
+// yet, unless their clients expired. Every purge is recorded in the audit
+// log, if there is one, before it is done. It returns the number of purged
+// tombstones.
+func (m *MetaStore) CompactTombstones() int {
+	ctx := context.Background()
+	purged, sequence := m.purgeTombstones(ctx)
+	atomic.AddUint64(&m.purged, uint64(purged))
+	if err := m.syncAudit(ctx, sequence, nil); err != nil {
+		slog.Error("Purged tombstones without recording them", "tombstones", purged, "error", err)
+	}
+	return purged
+}
+
+// purgeTombstones does CompactTombstones under m.mu, returning the sequence
+// number of the last audit entry, 0 for none.
+func (m *MetaStore) purgeTombstones(ctx context.Context) (int, int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.TombstoneRetention <= 0 {
+		return 0, 0
+	}
+	if m.expiredUsers == nil {
+		m.expiredUsers = make(map[string]bool)
+	}
+	now := time.Now()
+	userAcked := make(map[string]int64)
+	for user, clients := range m.clients {
+		for clientID, client := range clients {
+			if m.ClientExpiry > 0 && now.Sub(client.lastSeen) > m.ClientExpiry {
+				delete(clients, clientID)
+				slog.Info("Forgot client", "client", user+"/"+clientID, "last_seen", client.lastSeen)
+				continue
+			}
+			if acked, exists := userAcked[user]; !exists || client.revision < acked {
+				userAcked[user] = client.revision
+			}
+		}
+		if len(clients) == 0 {
+			delete(m.clients, user)
+			m.expiredUsers[user] = true
+		}
+	}
+
+	purged := 0
+	var lastSequence int64
+	for owner, deletedAt := range m.deletedAt {
+		for filename, deleted := range deletedAt {
+			fileMetaData := m.FileMetaMaps[owner][filename]
+			if now.Sub(deleted) < m.TombstoneRetention || fileMetaData.GetRevision() > m.ackedBy(m.usersSeeing(owner, filename), userAcked) {
+				continue
+			}
+			entry := &AuditEntry{
+				Action:        AuditAction_PURGE,
+				Owner:         owner,
+				OwnerFilename: filename,
+				OldVersion:    fileMetaData.GetVersion(),
+			}
+			sequence, err := m.audit(ctx, entry, nil)
+			if err != nil {
+				return purged, lastSequence
+			}
+			if sequence != 0 {
+				lastSequence = sequence
+			}
+			delete(m.FileMetaMaps[owner], filename)
+			delete(deletedAt, filename)
+			purged++
+		}
+	}
+	return purged, lastSequence
+}
+
+// ackedBy returns the revision every one of users acknowledged, going by the
+// least revision each user's clients acknowledged in userAcked. Users
+// without clients acknowledged nothing, unless their clients expired. The
+// caller must hold m.mu.
+func (m *MetaStore) ackedBy(users []string, userAcked map[string]int64) int64 {
+	acked := m.revision
+	for _, user := range users {
+		userAck, exists := userAcked[user]
+		if !exists {
+			if m.expiredUsers[user] {
+				continue
+			}
+			return 0
+		}
+		if userAck < acked {
+			acked = userAck
+		}
+	}
+	return acked
+}
+
+// usersSeeing returns owner and the users owner shares filename with. The
+// caller must hold m.mu.
+func (m *MetaStore) usersSeeing(owner, filename string) []string {
+	users := []string{owner}
+	for _, share := range m.Shares[owner] {
+		if hasPathPrefix(filename, share.Path) {
+			users = append(users, share.User)
+		}
+	}
+	return users
+}
+
+// CompactPeriodically purges tombstones for as long as the server runs.
+func (m *MetaStore) CompactPeriodically() {
+	interval := TOMBSTONE_COMPACTION_INTERVAL
+	if m.TombstoneRetention < interval {
+		interval = m.TombstoneRetention
+	}
+	for range time.Tick(interval) {
+		if purged := m.CompactTombstones(); purged > 0 {
+			slog.Info("Purged tombstones", "tombstones", purged)
+		}
+	}
+}
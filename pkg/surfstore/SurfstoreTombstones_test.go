@@ -0,0 +1,336 @@
+package surfstore
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestAcknowledgeRevision(t *testing.T) {
+	m := NewMetaStore("")
+	version, err := m.UpdateFile(userContext("alice"), &FileMetaData{Filename: "a", Version: 1, BlockHashList: []string{"h"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		clientID string
+		revision int64
+		code     codes.Code
+	}{
+		{"current revision", "laptop", version.Revision, codes.OK},
+		{"older revision", "laptop", version.Revision - 1, codes.OK},
+		{"ahead of the server", "laptop", version.Revision + 1, codes.InvalidArgument},
+		{"no client id", "", version.Revision, codes.InvalidArgument},
+		{"longest client id", strings.Repeat("c", MAX_CLIENT_ID_LENGTH), version.Revision, codes.OK},
+		{"client id too long", strings.Repeat("c", MAX_CLIENT_ID_LENGTH+1), version.Revision, codes.InvalidArgument},
+	}
+	for _, test := range tests {
+		_, err := m.AcknowledgeRevision(userContext("alice"), &Acknowledgement{ClientId: test.clientID, Revision: test.revision})
+		if status.Code(err) != test.code {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.code)
+		}
+	}
+	// acknowledgements never go back
+	if got := m.clients["alice"]["laptop"].revision; got != version.Revision {
+		t.Errorf("laptop acknowledged %d, want %d", got, version.Revision)
+	}
+
+	// clients of one user are kept apart from those of others
+	if _, err := m.AcknowledgeRevision(userContext("bob"), &Acknowledgement{ClientId: "laptop", Revision: 0}); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.clients["alice"]["laptop"].revision; got != version.Revision {
+		t.Errorf("bob's laptop changed alice's acknowledgement to %d", got)
+	}
+
+	// a user's clients are bounded, forgetting the least recently seen one
+	for i := 0; i < MAX_CLIENTS_PER_USER; i++ {
+		if _, err := m.AcknowledgeRevision(userContext("carol"), &Acknowledgement{ClientId: string(rune('a' + i)), Revision: 0}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := m.AcknowledgeRevision(userContext("carol"), &Acknowledgement{ClientId: "new", Revision: 0}); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := m.clients["carol"]["a"]; exists || len(m.clients["carol"]) != MAX_CLIENTS_PER_USER {
+		t.Errorf("carol has %d clients including the first one %v, want %d without it", len(m.clients["carol"]), exists, MAX_CLIENTS_PER_USER)
+	}
+}
+
+func TestCompactTombstones(t *testing.T) {
+	const (
+		// acknowledge the revision before the deletion or the deletion
+		before = iota
+		after
+	)
+	type ack struct {
+		user, clientID string
+		when           int
+		// expired backdates the client beyond ClientExpiry
+		expired bool
+	}
+	tests := []struct {
+		name      string
+		retention time.Duration
+		// shareWith gets alice's folder docs shared with them
+		shareWith string
+		acks      []ack
+		purged    bool
+	}{
+		{"synced by the owner", time.Nanosecond, "", []ack{{"alice", "laptop", after, false}}, true},
+		{"retention disabled", 0, "", []ack{{"alice", "laptop", after, false}}, false},
+		{"within retention", time.Hour, "", []ack{{"alice", "laptop", after, false}}, false},
+		{"owner not seen yet", time.Nanosecond, "", nil, false},
+		{"owner behind", time.Nanosecond, "", []ack{{"alice", "laptop", before, false}}, false},
+		{"one client behind", time.Nanosecond, "", []ack{{"alice", "laptop", after, false}, {"alice", "phone", before, false}}, false},
+		{"client behind expired", time.Nanosecond, "", []ack{{"alice", "laptop", after, false}, {"alice", "phone", before, true}}, true},
+		{"every client of the owner expired", time.Nanosecond, "", []ack{{"alice", "laptop", before, true}}, true},
+		{"share not seen yet", time.Nanosecond, "bob", []ack{{"alice", "laptop", after, false}}, false},
+		{"share behind", time.Nanosecond, "bob", []ack{{"alice", "laptop", after, false}, {"bob", "desktop", before, false}}, false},
+		{"share synced", time.Nanosecond, "bob", []ack{{"alice", "laptop", after, false}, {"bob", "desktop", after, false}}, true},
+		{"share expired", time.Nanosecond, "bob", []ack{{"alice", "laptop", after, false}, {"bob", "desktop", before, true}}, true},
+		{"unrelated user behind", time.Nanosecond, "", []ack{{"alice", "laptop", after, false}, {"bob", "desktop", before, false}}, true},
+	}
+	for _, test := range tests {
+		m := NewMetaStore("")
+		m.TombstoneRetention = test.retention
+		m.ClientExpiry = time.Hour
+		alice := userContext("alice")
+		if test.shareWith != "" {
+			if _, err := m.ShareFolder(alice, &Share{Path: "docs", User: test.shareWith, Permission: Permission_READ}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		created, err := m.UpdateFile(alice, &FileMetaData{Filename: "docs/a", Version: 1, BlockHashList: []string{"h"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		deleted, err := m.UpdateFile(alice, &FileMetaData{Filename: "docs/a", Version: 2, BlockHashList: []string{"0"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, a := range test.acks {
+			revision := created.Revision
+			if a.when == after {
+				revision = deleted.Revision
+			}
+			if _, err := m.AcknowledgeRevision(userContext(a.user), &Acknowledgement{ClientId: a.clientID, Revision: revision}); err != nil {
+				t.Fatal(err)
+			}
+			if a.expired {
+				m.clients[a.user][a.clientID].lastSeen = time.Now().Add(-2 * m.ClientExpiry)
+			}
+		}
+
+		purged := 0
+		if test.purged {
+			purged = 1
+		}
+		if got := m.CompactTombstones(); got != purged {
+			t.Errorf("%s: CompactTombstones = %d, want %d", test.name, got, purged)
+		}
+		if _, exists := m.FileMetaMaps["alice"]["docs/a"]; exists == test.purged {
+			t.Errorf("%s: tombstone kept = %v, want %v", test.name, exists, !test.purged)
+		}
+		if stats := m.Stats(); stats.Purged != uint64(purged) || stats.Tombstones != 1-purged {
+			t.Errorf("%s: Stats = %+v, want %d purged and %d tombstones", test.name, stats, purged, 1-purged)
+		}
+	}
+}
+
+func TestCompactTombstonesAudit(t *testing.T) {
+	m := NewMetaStore("")
+	a, err := OpenAuditLog(filepath.Join(t.TempDir(), "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	m.AuditLog = a
+	m.TombstoneRetention = time.Nanosecond
+	alice := userContext("alice")
+	if _, err := m.UpdateFile(alice, &FileMetaData{Filename: "a", Version: 1, BlockHashList: []string{"h"}}); err != nil {
+		t.Fatal(err)
+	}
+	deleted, err := m.UpdateFile(alice, &FileMetaData{Filename: "a", Version: 2, BlockHashList: []string{"0"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.AcknowledgeRevision(alice, &Acknowledgement{ClientId: "laptop", Revision: deleted.Revision}); err != nil {
+		t.Fatal(err)
+	}
+	if purged := m.CompactTombstones(); purged != 1 {
+		t.Fatalf("CompactTombstones = %d, want 1", purged)
+	}
+
+	entries, err := a.Query(&AuditQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := entries[len(entries)-1]
+	if len(entries) != 3 || last.Action != AuditAction_PURGE || last.Owner != "alice" || last.OwnerFilename != "a" ||
+		last.OldVersion != 2 || !last.Accepted {
+		t.Errorf("audit log holds %d entries ending in %v, want the purge of a at version 2 last", len(entries), last)
+	}
+}
+
+// startTestServers serves bs and m on ports of their own and returns the
+// address of the MetaStore. Stopping them is left to the test cleanup.
+func startTestServers(t *testing.T, m *MetaStore, bs *BlockStore) string {
+	t.Helper()
+	serve := func(register func(s *grpc.Server)) string {
+		lis, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := grpc.NewServer()
+		register(s)
+		go s.Serve(lis)
+		t.Cleanup(s.Stop)
+		return lis.Addr().String()
+	}
+	m.BlockStoreAddr = serve(func(s *grpc.Server) { RegisterBlockStoreServer(s, bs) })
+	return serve(func(s *grpc.Server) { RegisterMetaStoreServer(s, m) })
+}
+
+func TestTombstonePurgeVersusResurrection(t *testing.T) {
+	tests := []struct {
+		name string
+		// expire forgets the laptop before the tombstone is compacted
+		expire bool
+		// edit changes the laptop's copy while it is away
+		edit bool
+		// restart replaces the MetaStore by an empty one before the laptop
+		// syncs again
+		restart bool
+		// kept is whether the laptop keeps its copy, and onServer whether
+		// the server has the file afterwards
+		kept, onServer bool
+	}{
+		{"tombstone kept for the away client", false, false, false, false, false},
+		{"purged while away", true, false, false, false, false},
+		{"edited while away", true, true, false, true, true},
+		{"server restarted", false, false, true, true, true},
+	}
+	for _, test := range tests {
+		m := NewMetaStore("")
+		m.TombstoneRetention = time.Nanosecond
+		m.ClientExpiry = time.Hour
+		bs := NewBlockStore()
+		addr := startTestServers(t, m, bs)
+		desktop := NewSurfstoreRPCClient(addr, t.TempDir(), 1024)
+		laptop := NewSurfstoreRPCClient(addr, t.TempDir(), 1024)
+		laptopFile := filepath.Join(laptop.BaseDir, "a.txt")
+
+		writeTestFiles(t, desktop.BaseDir, map[string]string{"a.txt": "hello"})
+		for _, client := range []RPCClient{desktop, laptop} {
+			if err := ClientSync(client); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := os.Remove(filepath.Join(desktop.BaseDir, "a.txt")); err != nil {
+			t.Fatal(err)
+		}
+		// the second sync acknowledges the deletion pushed by the first
+		for i := 0; i < 2; i++ {
+			if err := ClientSync(desktop); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if test.expire {
+			for _, client := range m.clients[""] {
+				if client.revision < m.revision {
+					client.lastSeen = time.Now().Add(-2 * m.ClientExpiry)
+				}
+			}
+		}
+		wantPurged := 0
+		if test.expire {
+			wantPurged = 1
+		}
+		if purged := m.CompactTombstones(); purged != wantPurged {
+			t.Errorf("%s: CompactTombstones = %d, want %d", test.name, purged, wantPurged)
+		}
+		if test.edit {
+			// a different size, so the change is noticed within the mtime
+			// granularity
+			if err := ioutil.WriteFile(laptopFile, []byte("hello again"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if test.restart {
+			m = NewMetaStore("")
+			laptop.MetaStoreAddr = startTestServers(t, m, bs)
+		}
+
+		if err := ClientSync(laptop); err != nil {
+			t.Fatalf("%s: ClientSync: %v", test.name, err)
+		}
+		if _, err := os.Stat(laptopFile); (err == nil) != test.kept {
+			t.Errorf("%s: laptop kept a.txt = %v, want %v", test.name, err == nil, test.kept)
+		}
+		fileMetaData, exists := m.FileMetaMaps[""]["a.txt"]
+		if onServer := exists && !isDeleted(fileMetaData); onServer != test.onServer {
+			t.Errorf("%s: a.txt on the server = %v, want %v", test.name, onServer, test.onServer)
+		}
+	}
+}
+
+func TestDeletedFlag(t *testing.T) {
+	tests := []struct {
+		name string
+		// update is stored over version 1 of a, nil to rename a to b instead
+		update  *FileMetaData
+		deleted bool
+	}{
+		{"flag", &FileMetaData{Filename: "a", Version: 2, BlockHashList: []string{}, Deleted: true}, true},
+		{"tombstone hash of older clients", &FileMetaData{Filename: "a", Version: 2, BlockHashList: []string{TOMBSTONE_HASH}}, true},
+		{"flag and tombstone hash", &FileMetaData{Filename: "a", Version: 2, BlockHashList: []string{TOMBSTONE_HASH}, Deleted: true}, true},
+		{"empty file", &FileMetaData{Filename: "a", Version: 2, BlockHashList: []string{}}, false},
+		{"changed file", &FileMetaData{Filename: "a", Version: 2, BlockHashList: []string{"g"}}, false},
+		{"renamed", nil, true},
+	}
+	for _, test := range tests {
+		m := NewMetaStore("")
+		alice := userContext("alice")
+		if _, err := m.UpdateFile(alice, &FileMetaData{Filename: "a", Version: 1, BlockHashList: []string{"h"}}); err != nil {
+			t.Fatal(err)
+		}
+		var err error
+		if test.update != nil {
+			_, err = m.UpdateFile(alice, test.update)
+		} else {
+			_, err = m.RenameFile(alice, &RenameRequest{OldFilename: "a", NewFilename: "b", Version: 1})
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		got := m.FileMetaMaps["alice"]["a"]
+		if isDeleted(got) != test.deleted || got.GetDeleted() != test.deleted || (got.GetDeletedTime() != 0) != test.deleted {
+			t.Errorf("%s: stored %v, want deleted %v with a deletion time", test.name, got, test.deleted)
+		}
+		// older clients still recognize tombstones by their hash list
+		if test.deleted && !reflect.DeepEqual(got.GetBlockHashList(), []string{TOMBSTONE_HASH}) {
+			t.Errorf("%s: tombstone has hash list %v, want [%s]", test.name, got.GetBlockHashList(), TOMBSTONE_HASH)
+		}
+
+		// recreating the file clears both
+		if _, err := m.UpdateFile(alice, &FileMetaData{Filename: "a", Version: got.GetVersion() + 1, BlockHashList: []string{"h"}}); err != nil {
+			t.Fatal(err)
+		}
+		if got := m.FileMetaMaps["alice"]["a"]; isDeleted(got) || got.GetDeletedTime() != 0 {
+			t.Errorf("%s: recreated file stored as %v", test.name, got)
+		}
+	}
+}
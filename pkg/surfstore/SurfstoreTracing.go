@@ -0,0 +1,104 @@
+package surfstore
+
+import (
+	context "context"
+	"fmt"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const TRACER_NAME string = "cse224/proj4/pkg/surfstore"
+
+// Trace exporters, given as "file:<path>", "otlp" or "otlp:<host:port>"
+const (
+	TRACE_EXPORTER_FILE string = "file"
+	TRACE_EXPORTER_OTLP string = "otlp"
+)
+
+func tracer() trace.Tracer {
+	return otel.Tracer(TRACER_NAME)
+}
+
+// endSpan records err, if any, on span and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// parseTraceExporter splits an exporter setting into its kind and target.
+func parseTraceExporter(exporter string) (kind, target string, err error) {
+	kind, target = exporter, ""
+	if i := strings.Index(exporter, ":"); i >= 0 {
+		kind, target = exporter[:i], exporter[i+1:]
+	}
+	switch {
+	case kind == TRACE_EXPORTER_FILE && target != "":
+	case kind == TRACE_EXPORTER_OTLP:
+	default:
+		return "", "", fmt.Errorf("unknown trace exporter %q, expected file:<path>, otlp or otlp:<host:port>", exporter)
+	}
+	return kind, target, nil
+}
+
+// StartTracing records the spans of serviceName and sends them to exporter:
+// "file:<path>" appends them to a file as JSON, "otlp" sends them to the
+// OpenTelemetry collector configured by the OTEL_EXPORTER_OTLP_* environment
+// variables and "otlp:<host:port>" to a collector at host:port without TLS.
+// Trace context is propagated to the servers in the gRPC metadata. The
+// returned function flushes the remaining spans.
+func StartTracing(serviceName, exporter string) (func(context.Context) error, error) {
+	kind, target, err := parseTraceExporter(exporter)
+	if err != nil {
+		return nil, err
+	}
+
+	var spanExporter sdktrace.SpanExporter
+	var traceFile *os.File
+	switch kind {
+	case TRACE_EXPORTER_FILE:
+		traceFile, err = os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		spanExporter, err = stdouttrace.New(stdouttrace.WithWriter(traceFile))
+	case TRACE_EXPORTER_OTLP:
+		var opts []otlptracegrpc.Option
+		if target != "" {
+			opts = append(opts, otlptracegrpc.WithEndpoint(target), otlptracegrpc.WithInsecure())
+		}
+		spanExporter, err = otlptracegrpc.New(context.Background(), opts...)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(spanExporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(serviceName))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if traceFile != nil {
+			if closeErr := traceFile.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		return err
+	}, nil
+}
@@ -6,21 +6,68 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"os"
+	"path"
+	"path/filepath"
+	"sort"
 	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
-func uploadFile(filename, blockStoreAddr string, client RPCClient) error {
-	log.Println("Uploading...")
-	filepath := ConcatPath(client.BaseDir, filename)
-	f, _ := os.Open(filepath)
+func uploadFile(fileMetaData *FileMetaData, blockStoreAddr string, client RPCClient) (err error) {
+	if isDeleted(fileMetaData) || fileMetaData.GetFileType() != FileType_REGULAR {
+		return nil
+	}
+	ctx, span := tracer().Start(client.context(), "uploadFile", trace.WithAttributes(attribute.String("file", fileMetaData.GetFilename())))
+	defer func() { endSpan(span, err) }()
+	client.Context = ctx
+	client.BlockReceipts = nil
+
+	slog.Debug("Uploading", "file", fileMetaData.GetFilename())
+	filepath := ConcatPath(client.BaseDir, fileMetaData.GetFilename())
+	blockCipher, err := client.Encryption.blockCipher(fileMetaData)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(filepath)
+	if err != nil {
+		return err
+	}
 	dataBlocks := getDataBlocks(f, client.BlockSize)
+	span.SetAttributes(attribute.Int("blocks", len(dataBlocks)))
+	// the MetaStore checks the quota with these sizes, which the BlockStore
+	// then holds the blocks to
+	blockSizes := make([]int32, len(dataBlocks))
+	for i, dataBlock := range dataBlocks {
+		dataBlocks[i] = string(blockCipher.seal([]byte(dataBlock)))
+		blockSizes[i] = int32(len(dataBlocks[i]))
+	}
 	var block Block
 	var succ bool
-	for _, dataBlock := range dataBlocks {
+	for i, dataBlock := range dataBlocks {
+		// the BlockStore only accepts blocks named by a block token
+		if i%BLOCK_TOKEN_BATCH_SIZE == 0 {
+			writeHashes := make([]string, 0, BLOCK_TOKEN_BATCH_SIZE)
+			for j := i; j < len(dataBlocks) && j < i+BLOCK_TOKEN_BATCH_SIZE; j++ {
+				writeHashes = append(writeHashes, GetBlockHashString([]byte(dataBlocks[j])))
+			}
+			if err := client.GetBlockToken(nil, writeHashes, fileMetaData, blockSizes, &client.BlockToken); err != nil {
+				return err
+			}
+		}
+
 		block.BlockData = []byte(dataBlock)
 		block.BlockSize = int32(len([]byte(dataBlock)))
+		block.Compression = Compression_NONE
+		if err := CompressBlock(&block, client.Compression); err != nil {
+			return err
+		}
 
 		err := client.PutBlock(&block, blockStoreAddr, &succ)
 		if err != nil {
@@ -31,6 +78,10 @@ func uploadFile(filename, blockStoreAddr string, client RPCClient) error {
 		}
 	}
 
+	// the MetaStore only counts blocks the BlockStore confirmed storing
+	if len(client.BlockReceipts) > 0 {
+		return client.ConfirmBlocks(client.BlockReceipts)
+	}
 	return nil
 }
 
@@ -38,25 +89,228 @@ func updateLocalIndex(filename string, remoteFileMetaData *FileMetaData, newReco
 	newRecord.Filename = filename
 	newRecord.BlockHashList = remoteFileMetaData.GetBlockHashList()
 	newRecord.Version = remoteFileMetaData.GetVersion()
+	newRecord.Mode = remoteFileMetaData.GetMode()
+	newRecord.Mtime = remoteFileMetaData.GetMtime()
+	newRecord.Size = remoteFileMetaData.GetSize()
+	newRecord.FileType = remoteFileMetaData.GetFileType()
+	newRecord.LinkTarget = remoteFileMetaData.GetLinkTarget()
+	newRecord.EncryptedKey = remoteFileMetaData.GetEncryptedKey()
+	newRecord.Revision = remoteFileMetaData.GetRevision()
+	newRecord.Deleted = remoteFileMetaData.GetDeleted()
+	newRecord.DeletedTime = remoteFileMetaData.GetDeletedTime()
 }
 
-func downloadFile(filename, blockStoreAddr string, hashList []string, client RPCClient) {
-	log.Println("Downloading...")
-	filepath := ConcatPath(client.BaseDir, filename)
-	file, _ := os.Create(filepath)
-	defer file.Close()
+// errUnsafePath is returned for remote entries that would be written outside
+// the base dir or over the files the client keeps there. They are skipped
+// rather than synced.
+var errUnsafePath = errors.New("unsafe path")
+
+// reservedFilename reports whether filename is one of the files the client
+// keeps in the base dir, which are neither synced nor overwritten.
+func reservedFilename(filename string) bool {
+	switch filename {
+	case DEFAULT_META_FILENAME, DEFAULT_SELECTION_FILENAME, DEFAULT_CLIENT_ID_FILENAME,
+		DEFAULT_ENCRYPTION_SALT_FILENAME, DEFAULT_KEY_ID_FILENAME:
+		return true
+	}
+	return false
+}
 
-	consolidatedData := make([]string, 0)
-	var block Block
-	for _, hash := range hashList {
-		err := client.GetBlock(hash, blockStoreAddr, &block)
+// localPath returns where filename lives in the base dir. It fails with
+// errUnsafePath if filename is not a clean relative path, is reserved for
+// the client or a directory on the way is a symlink, which could lead
+// anywhere.
+func localPath(filename string, client RPCClient) (string, error) {
+	if filename == "" || path.IsAbs(filename) || path.Clean(filename) != filename ||
+		filename == ".." || strings.HasPrefix(filename, "../") {
+		return "", fmt.Errorf("%s leads outside the base dir: %w", filename, errUnsafePath)
+	}
+	if reservedFilename(filename) {
+		return "", fmt.Errorf("%s is reserved for the client: %w", filename, errUnsafePath)
+	}
+	for dir := path.Dir(filename); dir != "."; dir = path.Dir(dir) {
+		if info, err := os.Lstat(ConcatPath(client.BaseDir, dir)); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("%s leads outside the base dir: %w", filename, errUnsafePath)
+		}
+	}
+	return ConcatPath(client.BaseDir, filename), nil
+}
+
+// linkTargetEscapes reports whether a symlink at filename pointing to target
+// could lead outside the base dir. ".." may only lead the target, since it
+// could climb out of a directory reached through another symlink.
+func linkTargetEscapes(filename, target string) bool {
+	if target == "" || path.IsAbs(target) || filepath.IsAbs(target) {
+		return true
+	}
+	depth := strings.Count(filename, "/")
+	leading := true
+	for _, elem := range strings.Split(filepath.ToSlash(target), "/") {
+		switch elem {
+		case "", ".":
+		case "..":
+			depth--
+			if !leading || depth < 0 {
+				return true
+			}
+		default:
+			leading = false
+		}
+	}
+	return false
+}
+
+// setFileAttributes restores the mode and modification time of a downloaded
+// file or directory.
+func setFileAttributes(filepath string, fileMetaData *FileMetaData) error {
+	// entries synced by clients that did not track attributes have no mode
+	if fileMetaData.GetMode() != 0 {
+		if err := os.Chmod(filepath, FileModeFromPosix(fileMetaData.GetMode())); err != nil {
+			return err
+		}
+	}
+	if fileMetaData.GetMtime() != 0 {
+		mtime := time.Unix(0, fileMetaData.GetMtime())
+		if err := os.Chtimes(filepath, mtime, mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreDirAttributes sets the attributes of downloaded directories, deepest
+// first, once nothing is written into them anymore.
+func restoreDirAttributes(dirs []*FileMetaData, client RPCClient) error {
+	sort.Slice(dirs, func(i, j int) bool {
+		return strings.Count(dirs[i].GetFilename(), "/") > strings.Count(dirs[j].GetFilename(), "/")
+	})
+	for _, dir := range dirs {
+		dirPath, err := localPath(dir.GetFilename(), client)
 		if err != nil {
-			log.Fatal(err)
+			continue
+		}
+		if err := setFileAttributes(dirPath, dir); err != nil {
+			return err
 		}
-		consolidatedData = append(consolidatedData, string(block.BlockData)) // Storing each block in the same variable might cause problems
 	}
+	return nil
+}
 
-	file.Write([]byte(strings.Join(consolidatedData, "")))
+// downloadFile recreates a remote file, directory or symlink in the base dir
+// along with its mode and modification time. The attributes of directories
+// are left to restoreDirAttributes, since downloading their contents changes
+// them. Entries that would be written outside the base dir fail with
+// errUnsafePath.
+func downloadFile(fileMetaData *FileMetaData, blockStoreAddr string, client RPCClient) (err error) {
+	filename := fileMetaData.GetFilename()
+	slog.Debug("Downloading", "file", filename)
+	ctx, span := tracer().Start(client.context(), "downloadFile", trace.WithAttributes(
+		attribute.String("file", filename), attribute.Int("blocks", len(fileMetaData.GetBlockHashList()))))
+	defer func() { endSpan(span, err) }()
+	client.Context = ctx
+	filepath, err := localPath(filename, client)
+	if err != nil {
+		return err
+	}
+	if dir := path.Dir(filename); dir != "." {
+		if err := os.MkdirAll(ConcatPath(client.BaseDir, dir), 0755); err != nil {
+			return err
+		}
+	}
+
+	switch fileMetaData.GetFileType() {
+	case FileType_DIRECTORY:
+		if info, err := os.Lstat(filepath); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			os.Remove(filepath)
+		}
+		return os.MkdirAll(filepath, 0755)
+	case FileType_SYMLINK:
+		if linkTargetEscapes(filename, fileMetaData.GetLinkTarget()) {
+			return fmt.Errorf("%s -> %s leads outside the base dir: %w", filename, fileMetaData.GetLinkTarget(), errUnsafePath)
+		}
+		os.Remove(filepath)
+		// symlinks have no mode of their own and Chtimes would follow them
+		return os.Symlink(fileMetaData.GetLinkTarget(), filepath)
+	default:
+		if info, err := os.Lstat(filepath); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			os.Remove(filepath)
+		}
+		blockCipher, err := client.Encryption.blockCipher(fileMetaData)
+		if err != nil {
+			return fmt.Errorf("%s: %w", filename, err)
+		}
+
+		consolidatedData := make([]string, 0)
+		var block Block
+		hashList := fileMetaData.GetBlockHashList()
+		for i, hash := range hashList {
+			// the BlockStore only serves blocks named by a block token
+			if i%BLOCK_TOKEN_BATCH_SIZE == 0 {
+				end := i + BLOCK_TOKEN_BATCH_SIZE
+				if end > len(hashList) {
+					end = len(hashList)
+				}
+				if err := client.GetBlockToken(hashList[i:end], nil, nil, nil, &client.BlockToken); err != nil {
+					return err
+				}
+			}
+
+			err := client.GetBlock(hash, blockStoreAddr, &block)
+			if err != nil {
+				return fmt.Errorf("%s: %w", filename, err)
+			}
+			blockData, err := DecompressBlock(&block, 0)
+			if err != nil {
+				return fmt.Errorf("%s: %w", filename, err)
+			}
+			// never write a block the BlockStore corrupted or lost
+			if GetBlockHashString(blockData) != hash {
+				return fmt.Errorf("%s: block %s does not match its hash", filename, hash)
+			}
+			blockData, err = blockCipher.open(blockData)
+			if err != nil {
+				return fmt.Errorf("%s: %w", filename, err)
+			}
+			consolidatedData = append(consolidatedData, string(blockData)) // Storing each block in the same variable might cause problems
+		}
+
+		// the file is only replaced once all its blocks were fetched and verified
+		if err := ioutil.WriteFile(filepath, []byte(strings.Join(consolidatedData, "")), 0666); err != nil {
+			return err
+		}
+	}
+
+	return setFileAttributes(filepath, fileMetaData)
+}
+
+// removeLocalFile deletes a file that was deleted remotely. Directories are
+// returned instead of removed, since their contents may not have been
+// deleted yet; they are removed by removeLocalDirs at the end of the sync.
+// Files outside the base dir are left alone.
+func removeLocalFile(filename string, client RPCClient) (dir string) {
+	filepath, err := localPath(filename, client)
+	if err != nil {
+		slog.Warn("Not removing file", "error", err)
+		return ""
+	}
+	if info, err := os.Lstat(filepath); err == nil && info.IsDir() {
+		return filename
+	}
+	os.Remove(filepath)
+	return ""
+}
+
+// removeLocalDirs removes deleted directories deepest first. Directories that
+// still hold files, e.g. ignored ones, are kept.
+func removeLocalDirs(dirs []string, client RPCClient) {
+	sort.Slice(dirs, func(i, j int) bool {
+		return strings.Count(dirs[i], "/") > strings.Count(dirs[j], "/")
+	})
+	for _, dir := range dirs {
+		if dirPath, err := localPath(dir, client); err == nil {
+			os.Remove(dirPath)
+		}
+	}
 }
 
 func getDataBlocks(file *os.File, blockSize int) []string {
@@ -84,11 +338,13 @@ func getDataBlocks(file *os.File, blockSize int) []string {
 	return blocks
 }
 
-func getHashList(file *os.File, blockSize int) []string {
+// getHashList hashes the blocks of file as they are uploaded, i.e. after
+// encrypting them with blockCipher if it is not nil.
+func getHashList(file *os.File, blockSize int, blockCipher *deterministicCipher) []string {
 	blocks := getDataBlocks(file, blockSize)
 	var hashList = make([]string, 0)
 	for _, block := range blocks {
-		hashList = append(hashList, GetBlockHashString([]byte(block)))
+		hashList = append(hashList, GetBlockHashString(blockCipher.seal([]byte(block))))
 	}
 
 	return hashList
@@ -106,99 +362,416 @@ func hashListsEqual(hashList1, hashList2 []string) bool {
 	return true
 }
 
+// newFileMetaData describes the file in the base dir at filename, hashing its
+// contents if it is a regular file. The version is left for the caller, and
+// indexed is the file's local index entry, if any.
+func newFileMetaData(filename string, fileInfo os.FileInfo, indexed *FileMetaData, client RPCClient) (*FileMetaData, error) {
+	fileMetaData := &FileMetaData{
+		Filename:      filename,
+		BlockHashList: []string{},
+		Mode:          PosixMode(fileInfo.Mode()),
+		Mtime:         fileInfo.ModTime().UnixNano(),
+	}
+
+	switch {
+	case fileInfo.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(ConcatPath(client.BaseDir, filename))
+		if err != nil {
+			return nil, err
+		}
+		fileMetaData.FileType = FileType_SYMLINK
+		fileMetaData.LinkTarget = target
+		fileMetaData.Size = int64(len(target))
+	case fileInfo.IsDir():
+		fileMetaData.FileType = FileType_DIRECTORY
+	default:
+		fileMetaData.FileType = FileType_REGULAR
+		if err := client.Encryption.assignFileKey(fileMetaData, indexed); err != nil {
+			return nil, err
+		}
+		blockCipher, err := client.Encryption.blockCipher(fileMetaData)
+		if err != nil {
+			return nil, err
+		}
+		f, err := os.Open(ConcatPath(client.BaseDir, filename))
+		if err != nil {
+			return nil, err
+		}
+		_, span := tracer().Start(client.context(), "hashFile", trace.WithAttributes(
+			attribute.String("file", filename), attribute.Int64("size", fileInfo.Size())))
+		fileMetaData.BlockHashList = getHashList(f, client.BlockSize, blockCipher)
+		span.End()
+		fileMetaData.Size = fileInfo.Size()
+	}
+
+	return fileMetaData, nil
+}
+
+// statUnchanged reports whether a regular file still has the size, mtime,
+// mode and inode recorded in the local index, in which case its recorded hash
+// list can be trusted without reading it again.
+func statUnchanged(indexed *FileMetaData, indexedInode uint64, fileInfo os.FileInfo) bool {
+	if isDeleted(indexed) || indexed.GetFileType() != FileType_REGULAR || !fileInfo.Mode().IsRegular() {
+		return false
+	}
+	return indexed.GetSize() == fileInfo.Size() &&
+		indexed.GetMtime() == fileInfo.ModTime().UnixNano() &&
+		indexed.GetMode() == PosixMode(fileInfo.Mode()) &&
+		indexedInode == fileInode(fileInfo)
+}
+
+// recordLocalInodes returns the inode of every regular file whose size and
+// mtime match its local index entry, for use by the next sync. Files that do
+// not match were changed during the sync and get no inode, so they are
+// rehashed next time.
+func recordLocalInodes(localFileMetaMap map[string]*FileMetaData, client RPCClient) map[string]uint64 {
+	inodes := make(map[string]uint64)
+	for filename, fileMetaData := range localFileMetaMap {
+		fileInfo, err := os.Lstat(ConcatPath(client.BaseDir, filename))
+		if err != nil || !fileInfo.Mode().IsRegular() {
+			continue
+		}
+		if fileMetaData.GetSize() == fileInfo.Size() && fileMetaData.GetMtime() == fileInfo.ModTime().UnixNano() {
+			inodes[filename] = fileInode(fileInfo)
+		}
+	}
+	return inodes
+}
+
+// fileChanged reports whether the file described by current differs from its
+// entry in the local index. Modification times alone do not count as a change.
+func fileChanged(indexed, current *FileMetaData) bool {
+	if !hashListsEqual(indexed.GetBlockHashList(), current.GetBlockHashList()) {
+		return true
+	}
+	if indexed.GetFileType() != current.GetFileType() || indexed.GetLinkTarget() != current.GetLinkTarget() {
+		return true
+	}
+	// entries written before modes were tracked only compare content
+	return indexed.GetMode() != 0 && indexed.GetMode() != current.GetMode()
+}
+
+// isDeleted reports whether fileMetaData marks a deleted file, either by its
+// flag or, coming from clients predating the flag, by the hash list
+// [TOMBSTONE_HASH]. Empty files have an empty hash list.
 func isDeleted(fileMetaData *FileMetaData) bool {
+	if fileMetaData.GetDeleted() {
+		return true
+	}
 	hashList := fileMetaData.GetBlockHashList()
-	return (len(hashList) == 1 && hashList[0] == "0")
+	return len(hashList) == 1 && hashList[0] == TOMBSTONE_HASH
+}
+
+// newTombstone returns the entry of filename deleted at version.
+func newTombstone(filename string, version int32) *FileMetaData {
+	return &FileMetaData{
+		Filename:      filename,
+		Version:       version,
+		BlockHashList: []string{TOMBSTONE_HASH},
+		Deleted:       true,
+		DeletedTime:   time.Now().UnixNano(),
+	}
 }
 
-func syncLocalAndBase(fileMap map[string]os.FileInfo, localFileMetaMap map[string]*FileMetaData, client RPCClient) {
-	for filename := range fileMap {
-		if filename == DEFAULT_META_FILENAME {
+// walkBaseDir collects the files, directories and symlinks below dir
+// (relative to baseDir) into fileMap,
+// keyed by their slash separated path relative to baseDir. Ignored and
+// unselected files and directories are skipped, and each directory's
+// .surfignore is loaded before its entries are visited.
+func walkBaseDir(baseDir, dir string, ignore *IgnoreMatcher, sel *Selection, fileMap map[string]os.FileInfo) error {
+	if err := ignore.LoadIgnoreFile(baseDir, dir); err != nil {
+		return err
+	}
+
+	dirPath := baseDir
+	if dir != "" {
+		dirPath = ConcatPath(baseDir, dir)
+	}
+	files, err := ioutil.ReadDir(dirPath)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		relPath := file.Name()
+		if dir != "" {
+			relPath = dir + "/" + file.Name()
+		}
+		if reservedFilename(relPath) {
+			continue
+		}
+		if ignore.Ignored(relPath, file.IsDir()) {
 			continue
 		}
 
-		f, err := os.Open(ConcatPath(client.BaseDir, filename))
+		if file.IsDir() {
+			if !sel.SelectedDir(relPath) {
+				continue
+			}
+			if err := walkBaseDir(baseDir, relPath, ignore, sel, fileMap); err != nil {
+				return err
+			}
+		}
+		if sel.Selected(relPath) {
+			fileMap[relPath] = file
+		}
+	}
+	return nil
+}
+
+// syncLocalAndBase updates the local index with the changes made in the base
+// dir since the last sync. Files whose stat data matches the index are not
+// rehashed unless client.Rehash is set. Deleted files whose content reappears
+// under exactly one new name are reported as renames, keyed by the new name.
+func syncLocalAndBase(fileMap map[string]os.FileInfo, localFileMetaMap map[string]*FileMetaData, inodes map[string]uint64, ignore *IgnoreMatcher, client RPCClient) (map[string]string, error) {
+	newFiles := make(map[string][]string)
+	for filename, fileInfo := range fileMap {
+		if reservedFilename(filename) {
+			continue
+		}
+
+		if fileMetaData, exists := localFileMetaMap[filename]; exists && !client.Rehash {
+			if statUnchanged(fileMetaData, inodes[filename], fileInfo) {
+				continue
+			}
+		}
+
+		currFileMeta, err := newFileMetaData(filename, fileInfo, localFileMetaMap[filename], client)
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
-		fileHashList := getHashList(f, client.BlockSize)
+		key := strings.Join(currFileMeta.GetBlockHashList(), HASH_DELIMITER)
 		if fileMetaData, exists := localFileMetaMap[filename]; exists {
-			if !hashListsEqual(fileHashList, fileMetaData.GetBlockHashList()) { // there are local changes
-				localFileMetaMap[filename] = &FileMetaData{
-					Filename:      filename,
-					Version:       int32(fileMetaData.GetVersion() + 1),
-					BlockHashList: fileHashList,
+			if fileChanged(fileMetaData, currFileMeta) { // there are local changes
+				if isDeleted(fileMetaData) {
+					newFiles[key] = append(newFiles[key], filename)
 				}
+				currFileMeta.Version = int32(fileMetaData.GetVersion() + 1)
+			} else {
+				// unchanged entries stay known to the server until synced again
+				currFileMeta.Revision = fileMetaData.GetRevision()
+				currFileMeta.Version = fileMetaData.GetVersion()
 			}
 		} else { // new files
-			localFileMetaMap[filename] = &FileMetaData{
-				Filename:      filename,
-				Version:       int32(1),
-				BlockHashList: fileHashList,
-			}
+			newFiles[key] = append(newFiles[key], filename)
+			currFileMeta.Version = int32(1)
 		}
+		localFileMetaMap[filename] = currFileMeta
 	}
 
 	// check for deleted files
+	deletedFiles := make(map[string][]string)
 	for filename, fileMetaData := range localFileMetaMap {
 		if isDeleted(fileMetaData) {
 			continue
 		}
+		// files that became ignored are left alone rather than deleted remotely
+		if ignore.IgnoredPath(filename) {
+			continue
+		}
 
 		if _, exists := fileMap[filename]; !exists {
-			localFileMetaMap[filename] = &FileMetaData{
-				Filename:      filename,
-				Version:       int32(fileMetaData.GetVersion() + 1),
-				BlockHashList: []string{"0"},
-			}
+			key := strings.Join(fileMetaData.GetBlockHashList(), HASH_DELIMITER)
+			deletedFiles[key] = append(deletedFiles[key], filename)
+			localFileMetaMap[filename] = newTombstone(filename, fileMetaData.GetVersion()+1)
+			localFileMetaMap[filename].Revision = fileMetaData.GetRevision()
+		}
+	}
+
+	// pair up deleted and new files with the same content; empty files,
+	// directories, symlinks and ambiguous matches stay plain deletes and creates
+	renames := make(map[string]string)
+	for key, newNames := range newFiles {
+		oldNames := deletedFiles[key]
+		if key == "" || len(newNames) != 1 || len(oldNames) != 1 {
+			continue
 		}
+		renames[newNames[0]] = oldNames[0]
+	}
+	return renames, nil
+}
+
+// pushLocalChange uploads a locally changed file and its new metadata. If the
+// server rejects the change, because another client updated the file first
+// or because the file is in a folder shared read-only, the server's version
+// of the file is restored locally. Changes over the owner's quota are kept
+// locally and tried again on the next sync, which uploads no blocks until the
+// quota allows them. Changes the server refuses as invalid, such as files
+// over its limits, and changes to files the server has no version of to
+// restore are noted in rejected and not pushed again until they change.
+func pushLocalChange(localFileMetaData *FileMetaData, blockStoreAddr string, localFileMetaMap map[string]*FileMetaData, rejected map[string]int32, client RPCClient) error {
+	filename := localFileMetaData.GetFilename()
+	if rejected[filename] == localFileMetaData.GetVersion() {
+		return nil
+	}
+	// the MetaStore rejects updates of read-only shares before their blocks
+	// are uploaded
+	err := uploadFile(localFileMetaData, blockStoreAddr, client)
+	if err == nil {
+		var latestVersion int32
+		err = client.UpdateFile(localFileMetaData, &latestVersion)
+	}
+	if err == nil {
+		delete(rejected, filename)
+		return nil
+	}
+	if errors.Is(err, ErrQuotaExceeded) {
+		// the local change stays ahead of the server in the index and is
+		// pushed again on the next sync
+		slog.Warn("Local change not synced, over quota", "file", filename, "error", err)
+		return nil
+	}
+	if errors.Is(err, ErrInvalidArgument) {
+		slog.Warn("Local change rejected, not syncing it until it changes", "file", filename, "error", err)
+		rejected[filename] = localFileMetaData.GetVersion()
+		return nil
+	}
+	if !errors.Is(err, ErrVersionConflict) && !errors.Is(err, ErrPermissionDenied) {
+		return err
+	}
+
+	var tempRemoteFileMetaMap map[string]*FileMetaData
+	if err := client.GetFileInfoMap(&tempRemoteFileMetaMap); err != nil {
+		return err
+	}
+	tempRemoteFileMetaData, exists := tempRemoteFileMetaMap[filename]
+	if !exists {
+		slog.Warn("Local change rejected, not syncing it until it changes", "file", filename, "error", err)
+		rejected[filename] = localFileMetaData.GetVersion()
+		return nil
+	}
+	slog.Warn("Local change rejected, restoring the server's version", "file", filename, "error", err)
+	if isDeleted(tempRemoteFileMetaData) {
+		removeLocalFile(filename, client)
+	} else if err := downloadFile(tempRemoteFileMetaData, blockStoreAddr, client); errors.Is(err, errUnsafePath) {
+		slog.Warn("Not syncing remote file", "error", err)
+		return nil
+	} else if err != nil {
+		return err
+	} else if err := restoreDirAttributes([]*FileMetaData{tempRemoteFileMetaData}, client); err != nil {
+		return err
 	}
+
+	var modRecord FileMetaData
+	updateLocalIndex(filename, tempRemoteFileMetaData, &modRecord)
+	localFileMetaMap[filename] = &modRecord
+	return nil
 }
 
-// Implement the logic for a client syncing with the server here.
-func ClientSync(client RPCClient) {
+// ClientSync syncs the base dir of client with the server, stopping at the
+// first error. The local index is only written after a complete sync, so an
+// interrupted sync is redone the next time.
+func ClientSync(client RPCClient) (err error) {
+	ctx, span := tracer().Start(client.context(), "ClientSync", trace.WithAttributes(attribute.String("baseDir", client.BaseDir)))
+	defer func() { endSpan(span, err) }()
+	client.Context = ctx
+
 	// First, we update local index
 	// get local file meta map
-	localFileMetaMap, _ := LoadMetaFromMetaFile(client.BaseDir)
+	localFileMetaMap, inodes, rejected, err := LoadLocalIndex(client.BaseDir)
+	if err != nil {
+		return err
+	}
 
-	// access all files in base dir
-	files, err := ioutil.ReadDir(client.BaseDir)
+	// hashes computed without encryption or under other keys no longer match
+	// what would be uploaded, so every file is hashed and encrypted again
+	keyID := client.Encryption.KeyID()
+	indexKeyID, err := LoadIndexKeyID(client.BaseDir)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	if keyID != indexKeyID && len(localFileMetaMap) > 0 {
+		slog.Info("Encryption changed since the last sync, rehashing every file")
+		client.Rehash = true
+		for _, fileMetaData := range localFileMetaMap {
+			fileMetaData.EncryptedKey = nil
+		}
 	}
 
-	// Create a filename: fileInfo map
-	fileMap := make(map[string]os.FileInfo)
-	for _, file := range files {
-		if file.Name() == DEFAULT_META_FILENAME {
-			continue
+	// files outside the selective sync selection are neither synced nor
+	// tracked, so they are never treated as deleted
+	sel, err := LoadSelection(client.BaseDir)
+	if err != nil {
+		return err
+	}
+	for filename := range localFileMetaMap {
+		if !sel.Selected(filename) {
+			delete(localFileMetaMap, filename)
 		}
-		fileMap[file.Name()] = file
+	}
+
+	// Create a filename: fileInfo map of all files in base dir that are not ignored
+	ignore := NewIgnoreMatcher()
+	fileMap := make(map[string]os.FileInfo)
+	err = walkBaseDir(client.BaseDir, "", ignore, sel, fileMap)
+	if err != nil {
+		return err
 	}
 	// sync local index and base dir
-	syncLocalAndBase(fileMap, localFileMetaMap, client)
+	renames, err := syncLocalAndBase(fileMap, localFileMetaMap, inodes, ignore, client)
+	if err != nil {
+		return err
+	}
 
 	var blockStoreAddr string
 	err = client.GetBlockStoreAddr(&blockStoreAddr)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	// Connect to server and download FileInfoMap
 	var remoteFileMetaMap map[string]*FileMetaData
-	client.GetFileInfoMap(&remoteFileMetaMap)
+	var revision, baseRevision int64
+	if err := client.getFileInfoMap(&remoteFileMetaMap, &revision, &baseRevision); err != nil {
+		return err
+	}
+
+	// Move renamed files on the server so they keep their history and their
+	// blocks are not uploaded again; the moved entry takes the attributes of
+	// the file at its new path
+	if len(renames) > 0 {
+		for newName, oldName := range renames {
+			var latestVersion int32
+			err = client.RenameFile(oldName, localFileMetaMap[newName], localFileMetaMap[oldName].GetVersion()-1, &latestVersion)
+			if errors.Is(err, ErrVersionConflict) || errors.Is(err, ErrFileNotFound) || errors.Is(err, ErrFileExists) ||
+				errors.Is(err, ErrPermissionDenied) || errors.Is(err, ErrInvalidArgument) {
+				// someone else changed either file, or it cannot be moved, so
+				// sync it as a delete and a new file
+				slog.Info("Syncing rename as delete and create", "from", oldName, "to", newName, "error", err)
+				continue
+			} else if err != nil {
+				return err
+			}
+			localFileMetaMap[newName].Version = latestVersion
+		}
+		if err := client.getFileInfoMap(&remoteFileMetaMap, &revision, &baseRevision); err != nil {
+			return err
+		}
+	}
 
 	// Check if remote file exists locally
+	deletedDirs := make([]string, 0)
+	downloadedDirs := make([]*FileMetaData, 0)
 	for filename, remoteFileMetaData := range remoteFileMetaMap {
+		if !sel.Selected(filename) {
+			continue
+		}
 		if localFileMetaData, exists := localFileMetaMap[filename]; exists { // if it exists
 			// first we check if the remote version is greater than local version
 			remoteVersion := remoteFileMetaData.GetVersion()
 			localVersion := localFileMetaData.GetVersion()
 			if remoteVersion > localVersion { // if the remote version is higher, merely download the file and add the corresponding entry to the local index
 				if isDeleted(remoteFileMetaData) {
-					os.Remove(ConcatPath(client.BaseDir, filename))
-				} else {
-					downloadFile(filename, blockStoreAddr, remoteFileMetaData.GetBlockHashList(), client)
+					if dir := removeLocalFile(filename, client); dir != "" {
+						deletedDirs = append(deletedDirs, dir)
+					}
+				} else if err := downloadFile(remoteFileMetaData, blockStoreAddr, client); errors.Is(err, errUnsafePath) {
+					slog.Warn("Not syncing remote file", "error", err)
+					continue
+				} else if err != nil {
+					return err
+				} else if remoteFileMetaData.GetFileType() == FileType_DIRECTORY {
+					downloadedDirs = append(downloadedDirs, remoteFileMetaData)
 				}
 
 				var modRecord FileMetaData
@@ -211,39 +784,40 @@ func ClientSync(client RPCClient) {
 
 				if !hashListsEqual(remoteHashList, localHashList) { // if the hashlists are unequal, that means someone else must have changed it, therefore we have to download
 					if isDeleted(remoteFileMetaData) {
-						os.Remove(ConcatPath(client.BaseDir, filename))
-					} else {
-						downloadFile(filename, blockStoreAddr, remoteFileMetaData.GetBlockHashList(), client)
+						if dir := removeLocalFile(filename, client); dir != "" {
+							deletedDirs = append(deletedDirs, dir)
+						}
+					} else if err := downloadFile(remoteFileMetaData, blockStoreAddr, client); errors.Is(err, errUnsafePath) {
+						slog.Warn("Not syncing remote file", "error", err)
+						continue
+					} else if err != nil {
+						return err
+					} else if remoteFileMetaData.GetFileType() == FileType_DIRECTORY {
+						downloadedDirs = append(downloadedDirs, remoteFileMetaData)
 					}
 
 					var modRecord FileMetaData
 					updateLocalIndex(filename, remoteFileMetaData, &modRecord)
 
 					localFileMetaMap[filename] = &modRecord
+				} else {
+					// entries indexed before revisions were tracked, or just
+					// pushed, learn theirs
+					localFileMetaData.Revision = remoteFileMetaData.GetRevision()
 				}
-			} else { // if the remote version is less than the local version, we upload
-				if !isDeleted(localFileMetaData) {
-					err = uploadFile(filename, blockStoreAddr, client)
-					if err != nil {
-						log.Fatal(err)
-					}
-				}
-
-				var latestVersion int32
-				err = client.UpdateFile(localFileMetaData, &latestVersion)
-				if err != nil {
-					log.Fatal(err)
-				}
-				if latestVersion == -1 { // This signals version error
-					var tempRemoteFileMetaMap map[string]*FileMetaData
-					client.GetFileInfoMap(&tempRemoteFileMetaMap)
-					tempRemoteFileMetaData := tempRemoteFileMetaMap[filename]
-					downloadFile(filename, blockStoreAddr, tempRemoteFileMetaData.GetBlockHashList(), client)
-				}
+			} else if err := pushLocalChange(localFileMetaData, blockStoreAddr, localFileMetaMap, rejected, client); err != nil { // if the remote version is less than the local version, we upload
+				return err
 			}
 		} else { // if it DNE, download it and add the corresponding entry to the local index
 			if !isDeleted(remoteFileMetaData) {
-				downloadFile(filename, blockStoreAddr, remoteFileMetaData.GetBlockHashList(), client)
+				if err := downloadFile(remoteFileMetaData, blockStoreAddr, client); errors.Is(err, errUnsafePath) {
+					slog.Warn("Not syncing remote file", "error", err)
+					continue
+				} else if err != nil {
+					return err
+				} else if remoteFileMetaData.GetFileType() == FileType_DIRECTORY {
+					downloadedDirs = append(downloadedDirs, remoteFileMetaData)
+				}
 			}
 
 			var modRecord FileMetaData
@@ -256,27 +830,51 @@ func ClientSync(client RPCClient) {
 	// Check if local file exists remotely
 	for filename, localFileMetaData := range localFileMetaMap {
 		if _, exists := remoteFileMetaMap[filename]; !exists { // if local file DNE remotely, we upload it
-			err = uploadFile(filename, blockStoreAddr, client)
-			if err != nil {
-				log.Fatal(err)
-			}
-
-			var latestVersion int32
-			err = client.UpdateFile(localFileMetaData, &latestVersion)
-			if err != nil {
-				log.Fatal(err)
+			if localFileMetaData.GetRevision() > baseRevision {
+				// the server had the file since it started, so it was
+				// deleted and its tombstone purged since this client last
+				// synced, or its share was revoked. Files synced with a
+				// server that restarted since are uploaded again.
+				if !isDeleted(localFileMetaData) {
+					slog.Info("Removing file gone from the server", "file", filename)
+					if dir := removeLocalFile(filename, client); dir != "" {
+						deletedDirs = append(deletedDirs, dir)
+					}
+				}
+				delete(localFileMetaMap, filename)
+				continue
 			}
-			if latestVersion == -1 { // This signals version error
-				var tempRemoteFileMetaMap map[string]*FileMetaData
-				client.GetFileInfoMap(&tempRemoteFileMetaMap)
-				tempRemoteFileMetaData := tempRemoteFileMetaMap[filename]
-				downloadFile(filename, blockStoreAddr, tempRemoteFileMetaData.GetBlockHashList(), client)
+			if err := pushLocalChange(localFileMetaData, blockStoreAddr, localFileMetaMap, rejected, client); err != nil {
+				return err
 			}
 		}
 	}
 
-	err = WriteMetaFile(localFileMetaMap, client.BaseDir)
+	removeLocalDirs(deletedDirs, client)
+	if err := restoreDirAttributes(downloadedDirs, client); err != nil {
+		return err
+	}
+
+	if err := WriteLocalIndex(localFileMetaMap, recordLocalInodes(localFileMetaMap, client), rejected, client.BaseDir); err != nil {
+		return err
+	}
+	if err := WriteIndexKeyID(client.BaseDir, keyID); err != nil {
+		return err
+	}
+	return acknowledgeRevision(revision, client)
+}
+
+// acknowledgeRevision tells the server this client has synced every change
+// up to revision, so it can purge the tombstones up to it. Servers without
+// tombstone compaction need no acknowledgement.
+func acknowledgeRevision(revision int64, client RPCClient) error {
+	clientID, err := LoadClientID(client.BaseDir)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	err = client.AcknowledgeRevision(clientID, revision)
+	if status.Code(err) == codes.Unimplemented {
+		return nil
 	}
+	return err
 }
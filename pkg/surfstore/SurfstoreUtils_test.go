@@ -0,0 +1,223 @@
+package surfstore
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeTestFiles creates the given files, keyed by slash separated path,
+// below baseDir.
+func writeTestFiles(t *testing.T, baseDir string, files map[string]string) {
+	t.Helper()
+	for filename, content := range files {
+		filePath := filepath.Join(baseDir, filepath.FromSlash(filename))
+		if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filePath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// scanBaseDir walks baseDir and updates localFileMetaMap like a sync does,
+// returning the detected renames.
+func scanBaseDir(t *testing.T, localFileMetaMap map[string]*FileMetaData, client RPCClient) map[string]string {
+	t.Helper()
+	ignore := NewIgnoreMatcher()
+	fileMap := make(map[string]os.FileInfo)
+	if err := walkBaseDir(client.BaseDir, "", ignore, nil, fileMap); err != nil {
+		t.Fatal(err)
+	}
+	renames, err := syncLocalAndBase(fileMap, localFileMetaMap, nil, ignore, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return renames
+}
+
+func TestSyncLocalAndBaseDetectsRenames(t *testing.T) {
+	tests := []struct {
+		name    string
+		before  map[string]string
+		remove  []string
+		after   map[string]string
+		renames map[string]string
+	}{
+		{
+			name:    "rename",
+			before:  map[string]string{"a.txt": "hello"},
+			remove:  []string{"a.txt"},
+			after:   map[string]string{"b.txt": "hello"},
+			renames: map[string]string{"b.txt": "a.txt"},
+		},
+		{
+			name:    "move into directory",
+			before:  map[string]string{"a.txt": "hello"},
+			remove:  []string{"a.txt"},
+			after:   map[string]string{"dir/a.txt": "hello"},
+			renames: map[string]string{"dir/a.txt": "a.txt"},
+		},
+		{
+			name:    "changed while moved",
+			before:  map[string]string{"a.txt": "hello"},
+			remove:  []string{"a.txt"},
+			after:   map[string]string{"b.txt": "hello world"},
+			renames: map[string]string{},
+		},
+		{
+			name:    "copy",
+			before:  map[string]string{"a.txt": "hello"},
+			after:   map[string]string{"b.txt": "hello"},
+			renames: map[string]string{},
+		},
+		{
+			name:    "ambiguous new names",
+			before:  map[string]string{"a.txt": "hello"},
+			remove:  []string{"a.txt"},
+			after:   map[string]string{"b.txt": "hello", "c.txt": "hello"},
+			renames: map[string]string{},
+		},
+		{
+			name:    "ambiguous old names",
+			before:  map[string]string{"a.txt": "hello", "b.txt": "hello"},
+			remove:  []string{"a.txt", "b.txt"},
+			after:   map[string]string{"c.txt": "hello"},
+			renames: map[string]string{},
+		},
+		{
+			name:    "empty file",
+			before:  map[string]string{"a.txt": ""},
+			remove:  []string{"a.txt"},
+			after:   map[string]string{"b.txt": ""},
+			renames: map[string]string{},
+		},
+		{
+			name:    "delete",
+			before:  map[string]string{"a.txt": "hello"},
+			remove:  []string{"a.txt"},
+			renames: map[string]string{},
+		},
+	}
+	for _, test := range tests {
+		client := RPCClient{BaseDir: t.TempDir(), BlockSize: 4}
+		localFileMetaMap := make(map[string]*FileMetaData)
+		writeTestFiles(t, client.BaseDir, test.before)
+		scanBaseDir(t, localFileMetaMap, client)
+
+		for _, filename := range test.remove {
+			if err := os.Remove(filepath.Join(client.BaseDir, filepath.FromSlash(filename))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		writeTestFiles(t, client.BaseDir, test.after)
+		renames := scanBaseDir(t, localFileMetaMap, client)
+		if !reflect.DeepEqual(renames, test.renames) {
+			t.Errorf("%s: renames = %v, want %v", test.name, renames, test.renames)
+		}
+		for _, filename := range test.remove {
+			if fileMetaData := localFileMetaMap[filename]; !isDeleted(fileMetaData) || fileMetaData.GetVersion() != 2 {
+				t.Errorf("%s: %s is %v, want a tombstone at version 2", test.name, filename, fileMetaData)
+			}
+		}
+	}
+}
+
+func TestLocalPath(t *testing.T) {
+	baseDir := t.TempDir()
+	outside := t.TempDir()
+	if err := os.Mkdir(filepath.Join(baseDir, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(baseDir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	client := RPCClient{BaseDir: baseDir}
+
+	tests := []struct {
+		filename string
+		safe     bool
+	}{
+		{"file", true},
+		{"dir/file", true},
+		{"new/dir/file", true},
+		{"", false},
+		{"/etc/passwd", false},
+		{"..", false},
+		{"../file", false},
+		{"dir/../../file", false},
+		{"dir//file", false},
+		{"./file", false},
+		{"link/file", false},
+		{"link/dir/file", false},
+		{DEFAULT_META_FILENAME, false},
+		{DEFAULT_SELECTION_FILENAME, false},
+		{"dir/" + DEFAULT_META_FILENAME, true},
+	}
+	for _, test := range tests {
+		got, err := localPath(test.filename, client)
+		if test.safe {
+			if err != nil || got != ConcatPath(baseDir, test.filename) {
+				t.Errorf("localPath(%q) = %q, %v, want %q", test.filename, got, err, ConcatPath(baseDir, test.filename))
+			}
+		} else if !errors.Is(err, errUnsafePath) {
+			t.Errorf("localPath(%q) = %q, %v, want errUnsafePath", test.filename, got, err)
+		}
+	}
+}
+
+func TestLinkTargetEscapes(t *testing.T) {
+	tests := []struct {
+		filename, target string
+		escapes          bool
+	}{
+		{"link", "file", false},
+		{"link", "dir/file", false},
+		{"link", "./file", false},
+		{"dir/link", "../file", false},
+		{"a/b/link", "../../file", false},
+		{"link", "", true},
+		{"link", "/etc/passwd", true},
+		{"link", "..", true},
+		{"link", "../file", true},
+		{"dir/link", "../../file", true},
+		{"dir/link", "sub/../../file", true},
+		{"a/b/link", "../x/../file", true},
+	}
+	for _, test := range tests {
+		if got := linkTargetEscapes(test.filename, test.target); got != test.escapes {
+			t.Errorf("linkTargetEscapes(%q, %q) = %v, want %v", test.filename, test.target, got, test.escapes)
+		}
+	}
+}
+
+func TestDownloadFileSkipsUnsafeEntries(t *testing.T) {
+	baseDir := t.TempDir()
+	outside := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(baseDir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	client := RPCClient{BaseDir: baseDir}
+
+	tests := []*FileMetaData{
+		{Filename: "link/dir", Version: 1, FileType: FileType_DIRECTORY},
+		{Filename: "../dir", Version: 1, FileType: FileType_DIRECTORY},
+		{Filename: "escape", Version: 1, FileType: FileType_SYMLINK, LinkTarget: "../secret"},
+		{Filename: DEFAULT_META_FILENAME, Version: 1, FileType: FileType_DIRECTORY},
+	}
+	for _, fileMetaData := range tests {
+		if err := downloadFile(fileMetaData, "", client); !errors.Is(err, errUnsafePath) {
+			t.Errorf("downloadFile(%q) = %v, want errUnsafePath", fileMetaData.GetFilename(), err)
+		}
+	}
+	if files, _ := ioutil.ReadDir(outside); len(files) != 0 {
+		t.Errorf("downloadFile wrote %d entries outside the base dir", len(files))
+	}
+	if _, err := os.Lstat(filepath.Join(baseDir, "escape")); !os.IsNotExist(err) {
+		t.Errorf("downloadFile created a symlink leading outside the base dir")
+	}
+}